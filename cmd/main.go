@@ -4,18 +4,44 @@ import (
 	"context"
 	TinyFaaS "github.com/ChaosRez/go-tinyfaas"
 	log "github.com/sirupsen/logrus"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
+	Agent "umbilical-choir-core/internal/app/agent"
 	"umbilical-choir-core/internal/app/config"
 	FaaS "umbilical-choir-core/internal/app/faas"
+	Journal "umbilical-choir-core/internal/app/journal"
 	Manager "umbilical-choir-core/internal/app/manager"
-	Poller "umbilical-choir-core/internal/app/poller"
 	Strategy "umbilical-choir-core/internal/app/strategy"
+	Tracing "umbilical-choir-core/internal/app/tracing"
 	GCP "umbilical-choir-core/internal/pkg/gcp"
+	Knative "umbilical-choir-core/internal/pkg/knative"
+	Lambda "umbilical-choir-core/internal/pkg/lambda"
+	OpenFaaS "umbilical-choir-core/internal/pkg/openfaas"
 )
 
 var cfg *config.Config
 
 func main() {
+	// SIGINT/SIGTERM cancel the running release, which rolls back its running stage
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	shutdownTracing, err := Tracing.Setup(ctx, cfg)
+	if err != nil {
+		log.Fatalf("Failed to set up tracing: %v", err)
+	}
+	flushTraces := func() {
+		flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(flushCtx); err != nil {
+			log.Warnf("Failed to flush the traces: %v", err)
+		}
+	}
+	defer flushTraces()
+	log.RegisterExitHandler(flushTraces) // on log.Fatal
+
 	var faasAdapter FaaS.FaaS
 	switch cfg.FaaS.Type {
 	case "tinyfaas":
@@ -23,52 +49,106 @@ func main() {
 		//tf.WipeFunctions()
 		faasAdapter = FaaS.NewTinyFaaSAdapter(tf, cfg.FaaS.ProxyHost)
 	case "gcp":
-		ctx := context.Background()
 		gcp, err := GCP.NewGCP(ctx, cfg.FaaS.ProjectID, cfg.FaaS.Location, cfg.FaaS.Credentials)
 		if err != nil {
 			log.Fatalf("Failed to initialize GCP client: %v", err)
 		}
 		defer gcp.Close()
 		faasAdapter = &FaaS.GCPAdapter{GCP: gcp}
+	case "lambda":
+		credentials := Lambda.Credentials{
+			AccessKeyID:     cfg.FaaS.AccessKeyID,
+			SecretAccessKey: cfg.FaaS.SecretAccessKey,
+			SessionToken:    cfg.FaaS.SessionToken,
+		}
+		if credentials.AccessKeyID == "" { // fall back to the standard AWS environment variables
+			credentials = Lambda.Credentials{
+				AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+				SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+				SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+			}
+		}
+		lambda, err := Lambda.NewLambda(cfg.FaaS.Region, cfg.FaaS.Endpoint, cfg.FaaS.Role, credentials)
+		if err != nil {
+			log.Fatalf("Failed to initialize Lambda client: %v", err)
+		}
+		faasAdapter = &FaaS.LambdaAdapter{Lambda: lambda}
+	case "openfaas":
+		openFaaS := OpenFaaS.NewOpenFaaS(cfg.FaaS.Endpoint, cfg.FaaS.Namespace, cfg.FaaS.Username, cfg.FaaS.Password)
+		builder := &FaaS.ImageBuilder{Registry: cfg.FaaS.Registry, Tool: cfg.FaaS.BuildTool}
+		faasAdapter = FaaS.NewOpenFaaSAdapter(openFaaS, builder, cfg.FaaS.ProxyHost)
+	case "knative":
+		knative, err := Knative.NewKnative(cfg.FaaS.Endpoint, cfg.FaaS.Namespace, cfg.FaaS.Token, cfg.FaaS.CAFile, cfg.FaaS.Insecure)
+		if err != nil {
+			log.Fatalf("Failed to initialize Knative client: %v", err)
+		}
+		builder := &FaaS.ImageBuilder{Registry: cfg.FaaS.Registry, Tool: cfg.FaaS.BuildTool}
+		faasAdapter = &FaaS.KnativeAdapter{Knative: knative, Builder: builder}
+	case "mock": // in-process functions, e.g. to try a strategy out
+		mock, err := FaaS.NewMockAdapter("")
+		if err != nil {
+			log.Fatalf("Failed to start the mock FaaS: %v", err)
+		}
+		defer mock.Close()
+		faasAdapter = mock
 	default:
 		log.Fatalf("Unsupported FaaS type: %s", cfg.FaaS.Type)
 	}
-	manager := Manager.New(faasAdapter, cfg)
+	manager, err := Manager.New(FaaS.Instrument(faasAdapter), cfg) // the deployments are measured on '/metrics', and traced
+	if err != nil {
+		log.Fatalf("Failed to create the manager: %v", err)
+	}
+	defer manager.Close()
 
-	if cfg.StrategyPath == "" { // default behavior
-		pollRes := Poller.PollParent(cfg.Parent.Host, cfg.Parent.Port, "", manager.ServiceAreaPolygon)
-		manager.ID = pollRes.ID
+	// a release left in progress by a previous run (e.g. a crash)
+	var pending *Journal.Journal
+	if cfg.Agent.DataDir != "" {
+		var err error
+		pending, err = Journal.Load(cfg.Agent.DataDir)
+		if err != nil {
+			log.Errorf("Failed to load the journal: %v", err)
+		}
+	}
+
+	// clean up what the previous runs left behind on the FaaS (except the pending release), and again on SIGUSR1
+	reconcile(ctx, manager)
+	reconcileSignal := make(chan os.Signal, 1)
+	signal.Notify(reconcileSignal, syscall.SIGUSR1)
+	go func() {
 		for {
-			if pollRes.NewReleaseID == "" {
-				log.Debugf("No new release strategy available for me")
-			} else {
-				log.Infof("New release available at '%s'", pollRes.NewReleaseID)
-				strategyPath, err := Poller.DownloadRelease(cfg, manager.ID, pollRes.NewReleaseID)
-				if err != nil {
-					log.Fatalf("Failed to download release: %v", err)
-				}
-				strategy, err := Strategy.LoadStrategy(strategyPath)
-				if err != nil {
-					log.Fatalf("Failed to load strategy: %v", err)
-				}
-				fnsPath, err := Poller.DownloadReleaseFunctions(cfg, strategy.ID)
-				if err != nil {
-					log.Fatalf("Failed to download functions: %v", err)
-				}
-				log.Debugf("Functions downloaded to: %s", fnsPath)
-				manager.RunReleaseStrategy(strategy) // sends the result to the parent
-				//break
+			select {
+			case <-ctx.Done():
+				return
+			case <-reconcileSignal:
+				reconcile(ctx, manager)
 			}
-			time.Sleep(3 * time.Second)
-			pollRes = Poller.PollParent(cfg.Parent.Host, cfg.Parent.Port, manager.ID, manager.ServiceAreaPolygon)
 		}
+	}()
+
+	if cfg.StrategyPath == "" { // default behavior
+		if err := Agent.Run(ctx, cfg, manager, pending); err != nil {
+			log.Info(err)
+		}
+	} else if pending != nil {
+		log.Warnf("resuming the release left in progress instead of running the strategy from config")
+		manager.ResumeRelease(ctx, pending)
 	} else {
 		log.Warnf("running the strategy from config. StrategyPath: %s", cfg.StrategyPath)
 		strategy, err := Strategy.LoadStrategy(cfg.StrategyPath)
 		if err != nil {
 			log.Fatalf("Failed to load strategy: %v", err)
 		}
-		manager.RunReleaseStrategy(strategy)
+		manager.RunReleaseStrategy(ctx, strategy)
+	}
+}
+
+func reconcile(ctx context.Context, manager *Manager.Manager) {
+	restored, err := manager.Reconcile(ctx)
+	if err != nil {
+		log.Errorf("Failed to reconcile the functions: %v", err)
+	}
+	if restored > 0 {
+		log.Infof("Reconciled %d function(s) left mid-test", restored)
 	}
 }
 
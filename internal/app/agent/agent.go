@@ -0,0 +1,82 @@
+// Package agent runs the agent as a child of its parent: it polls the parent for new releases, downloads them and runs their strategies
+package agent
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"umbilical-choir-core/internal/app/config"
+	Journal "umbilical-choir-core/internal/app/journal"
+	Manager "umbilical-choir-core/internal/app/manager"
+	Poller "umbilical-choir-core/internal/app/poller"
+	Strategy "umbilical-choir-core/internal/app/strategy"
+	Tracing "umbilical-choir-core/internal/app/tracing"
+)
+
+// PollInterval is the time between two polls of the parent for a new release
+var PollInterval = 3 * time.Second
+
+// Run registers the agent with the parent, resumes the pending release (if any, left in progress by a previous run),
+// and then runs the releases the parent hands out until the context is cancelled.
+// It returns an error if it stopped before registering
+func Run(ctx context.Context, cfg *config.Config, manager *Manager.Manager, pending *Journal.Journal) error {
+	agentID := "" // a new child
+	if pending != nil {
+		agentID = pending.AgentID // keep the ID given by the parent before the restart
+	}
+	pollRes, err := Poller.PollParent(ctx, cfg.Parent.Host, cfg.Parent.Port, agentID, manager.ServiceAreaPolygon)
+	if err != nil {
+		return fmt.Errorf("stopped before registering with the parent: %w", err)
+	}
+	manager.ID = pollRes.ID
+	if pending != nil {
+		manager.ResumeRelease(ctx, pending) // sends the result to the parent
+	}
+	for ctx.Err() == nil {
+		if pollRes.NewReleaseID == "" {
+			log.Debugf("No new release strategy available for me")
+		} else {
+			log.Infof("New release available at '%s'", pollRes.NewReleaseID)
+			releaseCtx := Tracing.WithAttributes(ctx, Tracing.ReleaseID.String(pollRes.NewReleaseID))
+			releaseCtx, span := Tracing.Start(releaseCtx, "Release")
+			err := runRelease(releaseCtx, cfg, manager, pollRes.NewReleaseID)
+			if err != nil { // e.g. a bad release file. the agent keeps polling for the next one
+				log.Errorf("Failed to start release '%s': %v", pollRes.NewReleaseID, err)
+				manager.FailRelease(releaseCtx, pollRes.NewReleaseID, err)
+			}
+			Tracing.End(span, err)
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(PollInterval):
+		}
+		pollRes, err = Poller.PollParent(ctx, cfg.Parent.Host, cfg.Parent.Port, manager.ID, manager.ServiceAreaPolygon)
+		if err != nil {
+			break
+		}
+	}
+	log.Info("Stopped polling the parent")
+	return nil
+}
+
+// runRelease downloads a release and its functions, and runs its strategy, which sends the result to the parent.
+// It returns an error if the release could not be started, and nothing of it was deployed
+func runRelease(ctx context.Context, cfg *config.Config, manager *Manager.Manager, releaseID string) error {
+	strategyPath, err := Poller.DownloadRelease(ctx, cfg, manager.ID, releaseID)
+	if err != nil {
+		return fmt.Errorf("failed to download release: %w", err)
+	}
+	strategy, err := Strategy.LoadStrategy(strategyPath)
+	if err != nil {
+		return fmt.Errorf("failed to load strategy: %w", err)
+	}
+	fnsPath, err := Poller.DownloadReleaseFunctions(ctx, cfg, strategy.ID)
+	if err != nil {
+		return fmt.Errorf("failed to download functions: %w", err)
+	}
+	log.Debugf("Functions downloaded to: %s", fnsPath)
+	manager.RunReleaseStrategy(ctx, strategy)
+	return nil
+}
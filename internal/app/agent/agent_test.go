@@ -0,0 +1,175 @@
+package agent
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"umbilical-choir-core/internal/app/config"
+	FaaS "umbilical-choir-core/internal/app/faas"
+	"umbilical-choir-core/internal/app/fakeparent"
+	Manager "umbilical-choir-core/internal/app/manager"
+	MetricAgg "umbilical-choir-core/internal/app/metric_aggregator"
+)
+
+func TestMain(m *testing.M) {
+	log.SetLevel(log.ErrorLevel)
+	PollInterval = 50 * time.Millisecond
+	os.Exit(m.Run())
+}
+
+const serviceArea = `{"type":"FeatureCollection","features":[{"type":"Feature","properties":{},"geometry":{"coordinates":[[[13.34,52.49],[13.47,52.49],[13.47,52.55],[13.34,52.55],[13.34,52.49]]],"type":"Polygon"}}]}`
+
+const releaseStrategy = `
+id: "1"
+name: test-release
+type: minor
+functions:
+  - name: sieve
+    base_version:
+      path: fns/base
+      env: nodejs
+    new_version:
+      path: fns/new
+      env: nodejs
+stages:
+  - name: canary
+    type: Canary
+    func_name: sieve
+    trafficPercentage: 20
+    metrics_conditions:
+      - name: errorRate
+        threshold: "<0.1"
+    end_conditions:
+      - name: minCalls
+        threshold: "10"
+    end_action:
+      onSuccess: rollout
+      onFailure: rollback
+rollback:
+  action:
+    function: base_version
+`
+
+// releaseFunctions zips the functions of the release, as the parent serves them
+func releaseFunctions(t *testing.T) []byte {
+	t.Helper()
+	dir := t.TempDir()
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	for _, version := range []string{"base", "new"} {
+		if err := os.MkdirAll(filepath.Join("fns", version), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join("fns", version, "index.js"), []byte("module.exports = (req, res) => {\n  res.send('"+version+"');\n}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	functions, err := fakeparent.ZipDir("fns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return functions
+}
+
+func TestRunReleasesFromParent(t *testing.T) {
+	functions := releaseFunctions(t)
+	parent := fakeparent.New()
+	defer parent.Close()
+	parent.AddRelease(fakeparent.Release{ID: "1", Strategy: []byte(releaseStrategy), Functions: functions})
+	parent.AddRelease(fakeparent.Release{ID: "2", Strategy: []byte("id: \"2\"\nname: no-functions\n")}) // reported as an Error
+
+	dir := t.TempDir()
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil { // the releases and their functions are downloaded to the working directory
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	cfg := &config.Config{}
+	cfg.Agent.Host, cfg.Agent.MetricAddr, cfg.Agent.ServiceArea = "127.0.0.1", "127.0.0.1:0", serviceArea
+	cfg.Agent.DataDir = filepath.Join(dir, "data")
+	cfg.Parent.Host, cfg.Parent.Port = parent.Host, parent.Port
+
+	mock, err := FaaS.NewMockAdapter("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+	if _, err := mock.Upload(context.Background(), "sieve", "fns/base", "nodejs", "http", true, nil); err != nil {
+		t.Fatal(err)
+	}
+	manager, err := Manager.New(FaaS.Instrument(mock), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stopped := make(chan error)
+	go func() { stopped <- Run(ctx, cfg, manager, nil) }()
+	go func() { // calls the function (the proxy, during the stage)
+		for ctx.Err() == nil {
+			mock.Call("sieve", "10")
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+
+	results, err := parent.WaitForResults(2, 30*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); len(parent.Polls()) < 3 && time.Now().Before(deadline); { // keeps polling after the failed release
+		time.Sleep(PollInterval)
+	}
+	cancel()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Errorf("stopped with %v after registering", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("still running after the context was cancelled")
+	}
+
+	if manager.ID == "" || results[0].ID != manager.ID {
+		t.Errorf("registered as '%s', but the results are of '%s'", manager.ID, results[0].ID)
+	}
+	want := []struct {
+		releaseID string
+		status    MetricAgg.StageStatus
+	}{
+		{"1", MetricAgg.Completed},
+		{"2", MetricAgg.Error},
+	}
+	for i, w := range want {
+		if results[i].ReleaseID != w.releaseID || len(results[i].StageSummaries) != 1 || results[i].StageSummaries[0].Status != w.status {
+			t.Errorf("result %d: got %+v, want release '%s' %v", i, results[i], w.releaseID, w.status)
+		}
+	}
+	if path := mock.Path("sieve"); path != "fns/new" {
+		t.Errorf("'sieve' is deployed from '%s', want the rolled out 'fns/new'", path)
+	}
+	if polls := parent.Polls(); len(polls) < 3 || polls[0].ID != "" || polls[len(polls)-1].ID != manager.ID {
+		t.Errorf("the parent received %+v, want a registration and polls of the agent", polls)
+	}
+}
+
+func TestRunStopsBeforeRegistering(t *testing.T) {
+	parent := fakeparent.New()
+	parent.Close() // unreachable, retried until cancelled
+	cfg := &config.Config{}
+	cfg.Parent.Host, cfg.Parent.Port = parent.Host, parent.Port
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if err := Run(ctx, cfg, &Manager.Manager{}, nil); err == nil {
+		t.Error("got no error without a parent")
+	}
+}
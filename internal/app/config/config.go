@@ -23,18 +23,59 @@ type Config struct {
 		ProjectID   string `yaml:"projectID,omitempty"`
 		Location    string `yaml:"location,omitempty"`
 		Credentials string `yaml:"credentials,omitempty"`
+		// lambda, openfaas, knative
+		Endpoint string `yaml:"endpoint,omitempty"` // lambda: a local emulator (the AWS endpoint of the region if not set), openfaas: the gateway, knative: the kubernetes API server
+		// lambda
+		Region          string `yaml:"region,omitempty"`
+		Role            string `yaml:"role,omitempty"` // ARN of the functions' execution role
+		AccessKeyID     string `yaml:"accessKeyID,omitempty"`
+		SecretAccessKey string `yaml:"secretAccessKey,omitempty"`
+		SessionToken    string `yaml:"sessionToken,omitempty"`
+		// openfaas, knative
+		Namespace string `yaml:"namespace,omitempty"`
+		Registry  string `yaml:"registry,omitempty"`  // where the built function images are pushed, e.g. "registry.local:5000/uc"
+		BuildTool string `yaml:"buildTool,omitempty"` // docker (default) or podman
+		Username  string `yaml:"username,omitempty"`  // openfaas gateway's basic auth
+		Password  string `yaml:"password,omitempty"`
+		Token     string `yaml:"token,omitempty"`  // knative: bearer token of the API server
+		CAFile    string `yaml:"caFile,omitempty"` // knative: CA of the API server
+		Insecure  bool   `yaml:"insecure,omitempty"`
 	} `yaml:"faas"`
 	Agent struct {
 		Host        string `yaml:"host"`
 		ServiceArea string `yaml:"service_area"`
+		// the received metrics, the journal of the running release and the inventory of the released functions are kept here. DefaultDataDir if not set
+		DataDir string `yaml:"dataDir,omitempty"`
+		// a stage still running after this (e.g. "6h") is rolled back. 24h if not set
+		MaxStageDuration string `yaml:"maxStageDuration,omitempty"`
+		// the metric server listens on this for the metrics of the proxies (":9999" if not set). its port is passed to the proxy as AGENTPORT
+		MetricAddr string `yaml:"metricAddr,omitempty"`
+		// the proxies sign their metrics with a random secret of the stage (passed to them as PUSHSECRET), and the unsigned ones are rejected.
+		// true if not set. false only for the older proxy builds, which don't sign
+		MetricAuth bool `yaml:"metricAuth"`
+		// if set, the agent's Prometheus metrics ('/metrics') are served on this (e.g. "127.0.0.1:9100") instead of metricAddr, which the proxies reach
+		PrometheusAddr string `yaml:"prometheusAddr,omitempty"`
+		// if both set, the metric server serves TLS, and the proxies are given AGENTSCHEME=https
+		MetricTLSCert string `yaml:"metricTLSCert,omitempty"`
+		MetricTLSKey  string `yaml:"metricTLSKey,omitempty"`
 	} `yaml:"agent"`
 	Parent struct {
 		Host string `yaml:"host"`
 		Port string `yaml:"port"`
 	} `yaml:"parent"`
+	// the spans of the agent's phases (poll, download, deploy, test, report), see tracing.Setup
+	Tracing struct {
+		Exporter string `yaml:"exporter,omitempty"` // "otlp", "stdout" or "file". no tracing if not set
+		Endpoint string `yaml:"endpoint,omitempty"` // otlp: the collector's OTLP/HTTP endpoint (e.g. "localhost:4318"). OTEL_EXPORTER_OTLP_ENDPOINT if not set
+		Insecure bool   `yaml:"insecure,omitempty"` // otlp: without TLS
+		File     string `yaml:"file,omitempty"`     // file: the spans are appended to it as JSON
+	} `yaml:"tracing,omitempty"`
 	LogLevel string `yaml:"logLevel"`
 }
 
+// DefaultDataDir is the agent's data directory if not set, so that a release can be resumed and its leftovers reconciled after a crash
+const DefaultDataDir = "data"
+
 func LoadConfig(path string) (*Config, error) {
 	log.Infof("Loading config from %s", path)
 	file, err := os.Open(path)
@@ -44,10 +85,14 @@ func LoadConfig(path string) (*Config, error) {
 	defer file.Close()
 
 	var config Config
+	config.Agent.MetricAuth = true // unless set to false
 	decoder := yaml.NewDecoder(file)
 	if err := decoder.Decode(&config); err != nil {
 		return nil, err
 	}
+	if config.Agent.DataDir == "" {
+		config.Agent.DataDir = DefaultDataDir
+	}
 
 	return &config, nil
 }
@@ -1,6 +1,7 @@
 package faas
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os"
@@ -10,12 +11,17 @@ import (
 	"time"
 
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	Tracing "umbilical-choir-core/internal/app/tracing"
 )
 
 const jsFileName = "index.js"
 const pyFileName = "fn.py"
 
-func adaptFunction(path, platform, runtime string) (string, error) {
+// adaptFunction copies the source of a function to a temporary directory, adapted to the platform, and returns the directory
+func adaptFunction(ctx context.Context, path, platform, runtime string) (_ string, err error) {
+	_, span := Tracing.Start(ctx, "adaptFunction", attribute.String("uc.path", path), attribute.String("uc.platform", platform), attribute.String("uc.runtime", runtime))
+	defer func() { Tracing.End(span, err) }()
 	log.Debug("Creating a temporary directory with a timestamp")
 	timestamp := time.Now().Format("20060102150405")
 	tempDir, err := os.MkdirTemp("", fmt.Sprintf("adapted_function_%s_", timestamp))
@@ -48,7 +54,7 @@ func adaptFunction(path, platform, runtime string) (string, error) {
 		log.Debug("Adapting the js code based on the platform")
 		var adaptedCode string
 		switch platform {
-		case "tinyfaas":
+		case "tinyfaas", "container": // the container's server.js calls it as tinyFaaS does
 			adaptedCode = fmt.Sprintf(`module.exports = (req, res) => {
 %s
 }`, indent(innerCode, 1))
@@ -56,6 +62,29 @@ func adaptFunction(path, platform, runtime string) (string, error) {
 			adaptedCode = fmt.Sprintf(`exports.http = (req, res) => {
 %s
 }`, indent(innerCode, 1))
+		case "lambda":
+			// a function URL event is mapped to an express-like req, and the res calls to the handler's response
+			adaptedCode = fmt.Sprintf(`exports.handler = (event) => new Promise((resolve) => {
+  const http = (event.requestContext && event.requestContext.http) || {};
+  const req = {
+    method: http.method || "GET",
+    path: event.rawPath || "/",
+    headers: event.headers || {},
+    query: event.queryStringParameters || {},
+    body: event.isBase64Encoded ? Buffer.from(event.body || "", "base64").toString() : (event.body || ""),
+  };
+  const response = { statusCode: 200, headers: {}, body: "" };
+  const res = {
+    status: (code) => { response.statusCode = code; return res; },
+    set: (name, value) => { response.headers[name] = value; return res; },
+    send: (body) => { response.body = typeof body === "string" ? body : JSON.stringify(body); resolve(response); return res; },
+    json: (body) => res.set("Content-Type", "application/json").send(JSON.stringify(body)),
+    end: (body) => res.send(body || ""),
+  };
+  ((req, res) => {
+%s
+  })(req, res);
+});`, indent(innerCode, 2))
 		default:
 			return "", fmt.Errorf("unsupported platform: %s", platform)
 		}
@@ -79,10 +108,32 @@ func adaptFunction(path, platform, runtime string) (string, error) {
 			if err != nil {
 				return "", fmt.Errorf("error writing main.py: %v", err)
 			}
+		} else if platform == "lambda" {
+			log.Debug("Creating lambda_function.py for Lambda")
+			handlerPath := filepath.Join(tempDir, "lambda_function.py")
+			handlerContent := `import base64
+
+
+def handler(event, context):
+    body = event.get("body") or ""
+    if event.get("isBase64Encoded"):
+        body = base64.b64decode(body).decode("utf-8")
+    from fn import fn
+    result = fn(body, event.get("headers") or {})
+    return {"statusCode": 200, "body": result if result is not None else ""}
+`
+			err = os.WriteFile(handlerPath, []byte(handlerContent), 0644)
+			if err != nil {
+				return "", fmt.Errorf("error writing lambda_function.py: %v", err)
+			}
 		} else if platform == "tinyfaas" {
 			log.Debug("Assuming the python function is already in tinyFaaS format")
 			return tempDir, nil
+		} else if platform == "container" {
+			log.Debug("Assuming the python function is already in tinyFaaS format, called by the container's server.py")
 		}
+	} else if runtime == "go" && platform == "container" {
+		log.Debug("Assuming the go function is an HTTP server listening on $PORT")
 	} else {
 		// TODO add support for other runtimes
 		// https://cloud.google.com/functions/docs/create-deploy-http-go
@@ -90,6 +141,13 @@ func adaptFunction(path, platform, runtime string) (string, error) {
 		return path, nil
 	}
 
+	if platform == "container" {
+		log.Debug("Adding the HTTP server and the Dockerfile for the container")
+		if err := writeContainerFiles(tempDir, runtime); err != nil {
+			return "", err
+		}
+	}
+
 	log.Infof("Successfully adapted the source for platform: %s and runtime: %s", platform, runtime)
 	return tempDir, nil
 }
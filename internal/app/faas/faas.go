@@ -1,14 +1,17 @@
 package faas
 
+import "context"
+
+// FaaS is a FaaS platform the functions are deployed to. The context cancels the platform calls (e.g. a cancelled release)
 type FaaS interface {
-	WipeFunctions() error
-	Functions() (string, error)
+	WipeFunctions(ctx context.Context) error
+	Functions(ctx context.Context) (string, error)
 	Close() error
-	Log() (string, error)
+	Log(ctx context.Context) (string, error)
 	// Call(funcName string, data string) (string, error)
-	Upload(funcName, path, runtime string, entryPoint string, isFullPath bool, args []string) (string, error)
-	Update(funcName, path, runtime string, entryPoint string, isFullPath bool, args []string) (string, error)
-	Delete(funcName string) error
-	FunctionExists(funcName string) (bool, error)
-	FunctionUri(funcName string) (string, error)
+	Upload(ctx context.Context, funcName, path, runtime string, entryPoint string, isFullPath bool, args []string) (string, error)
+	Update(ctx context.Context, funcName, path, runtime string, entryPoint string, isFullPath bool, args []string) (string, error)
+	Delete(ctx context.Context, funcName string) error
+	FunctionExists(ctx context.Context, funcName string) (bool, error)
+	FunctionUri(ctx context.Context, funcName string) (string, error)
 }
@@ -17,16 +17,15 @@ type GCPAdapter struct {
 	GCP *GCP.GCP
 }
 
-func (g *GCPAdapter) WipeFunctions() error {
+func (g *GCPAdapter) WipeFunctions(ctx context.Context) error {
 	return fmt.Errorf("WipeFunctions not implemented for GCP")
 }
 
-func (g *GCPAdapter) Functions() (string, error) {
+func (g *GCPAdapter) Functions(ctx context.Context) (string, error) {
 	return "", fmt.Errorf("Functions not implemented for GCP")
 }
 
-func (g *GCPAdapter) FunctionExists(funcName string) (bool, error) {
-	ctx := context.Background()
+func (g *GCPAdapter) FunctionExists(ctx context.Context, funcName string) (bool, error) {
 	function := &GCP.Function{
 		Name:     funcName,
 		Location: g.GCP.Location,
@@ -41,8 +40,7 @@ func (g *GCPAdapter) FunctionExists(funcName string) (bool, error) {
 	return true, nil
 }
 
-func (g *GCPAdapter) FunctionUri(funcName string) (string, error) {
-	ctx := context.Background()
+func (g *GCPAdapter) FunctionUri(ctx context.Context, funcName string) (string, error) {
 	function := &GCP.Function{
 		Name:     funcName,
 		Location: g.GCP.Location,
@@ -60,19 +58,18 @@ func (g *GCPAdapter) FunctionUri(funcName string) (string, error) {
 func (g *GCPAdapter) Close() error {
 	return g.Close()
 }
-func (g *GCPAdapter) Log() (string, error) {
+func (g *GCPAdapter) Log(ctx context.Context) (string, error) {
 	return "", fmt.Errorf("Log not implemented for GCP")
 }
 
-func (g *GCPAdapter) Upload(funcName, path, runtime string, entryPoint string, isFullPath bool, args []string) (string, error) {
+func (g *GCPAdapter) Upload(ctx context.Context, funcName, path, runtime string, entryPoint string, isFullPath bool, args []string) (string, error) {
 	gcpRuntime, exists := gcpRuntimes[runtime]
 	if !exists {
 		return "", fmt.Errorf("runtime '%s' not supported", runtime)
 	}
-	ctx := context.Background()
 
 	// Adapt the code for GCP
-	adaptedCode, err := adaptFunction(path, "gcp", runtime)
+	adaptedCode, err := adaptFunction(ctx, path, "gcp", runtime)
 	if err != nil {
 		return "", fmt.Errorf("error adapting function: %v", err)
 	}
@@ -94,15 +91,14 @@ func (g *GCPAdapter) Upload(funcName, path, runtime string, entryPoint string, i
 	return g.GCP.CreateFunction(ctx, function)
 }
 
-func (g *GCPAdapter) Update(funcName, path, runtime string, entryPoint string, isFullPath bool, args []string) (string, error) {
+func (g *GCPAdapter) Update(ctx context.Context, funcName, path, runtime string, entryPoint string, isFullPath bool, args []string) (string, error) {
 	gcpRuntime, exists := gcpRuntimes[runtime]
 	if !exists {
 		return "", fmt.Errorf("runtime '%s' not supported", runtime)
 	}
-	ctx := context.Background()
 
 	// Adapt the code for GCP
-	adaptedCode, err := adaptFunction(path, "gcp", runtime)
+	adaptedCode, err := adaptFunction(ctx, path, "gcp", runtime)
 	if err != nil {
 		return "", fmt.Errorf("error adapting function: %v", err)
 	}
@@ -124,8 +120,7 @@ func (g *GCPAdapter) Update(funcName, path, runtime string, entryPoint string, i
 	return g.GCP.UpdateFunction(ctx, function)
 }
 
-func (g *GCPAdapter) Delete(funcName string) error {
-	ctx := context.Background()
+func (g *GCPAdapter) Delete(ctx context.Context, funcName string) error {
 	function := &GCP.Function{
 		Name:     funcName,
 		Location: g.GCP.Location,
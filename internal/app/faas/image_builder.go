@@ -0,0 +1,206 @@
+package faas
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// containerRuntimes are the base images of the container-based platforms (OpenFaaS, Knative)
+var containerRuntimes = map[string]string{
+	"python": "python:3.12-slim",
+	"nodejs": "node:20-slim",
+	"go":     "golang:1.22",
+}
+
+// ImageBuilder packages the source of a function as a container image, and pushes it to a registry the cluster can pull from.
+// The function is wrapped in a small HTTP server listening on $PORT (default 8080), which also answers OpenFaaS' '/_/health'
+type ImageBuilder struct {
+	Registry string // image prefix, e.g. "registry.local:5000/uc" or "docker.io/user"
+	Tool     string // "docker" (default) or a compatible CLI, e.g. "podman"
+}
+
+// Build builds and pushes the image of a function, and returns its reference. Each build has a new tag (its time and source hash), so an update always rolls out
+func (b *ImageBuilder) Build(ctx context.Context, funcName, path, runtime string) (string, error) {
+	if _, exists := containerRuntimes[runtime]; !exists {
+		return "", fmt.Errorf("runtime '%s' not supported", runtime)
+	}
+	if b.Registry == "" {
+		return "", fmt.Errorf("a registry is required to build the image of '%s'", funcName)
+	}
+	tool := b.Tool
+	if tool == "" {
+		tool = "docker"
+	}
+
+	adaptedCode, err := adaptFunction(ctx, path, "container", runtime)
+	if err != nil {
+		return "", fmt.Errorf("error adapting function: %v", err)
+	}
+	hash, err := sourceHash(adaptedCode)
+	if err != nil {
+		return "", fmt.Errorf("error hashing the source of '%s': %v", funcName, err)
+	}
+	// the time orders the builds, and the hash tells apart the versions built within the same second
+	image := fmt.Sprintf("%s/%s:%s-%s", strings.TrimSuffix(b.Registry, "/"), funcName, time.Now().Format("20060102150405"), hash[:12])
+
+	log.Infof("Building image '%s' from '%s'", image, path)
+	if out, err := exec.CommandContext(ctx, tool, "build", "-t", image, adaptedCode).CombinedOutput(); err != nil {
+		return "", fmt.Errorf("error building image '%s': %v\n%s", image, err, out)
+	}
+	log.Infof("Pushing image '%s'", image)
+	if out, err := exec.CommandContext(ctx, tool, "push", image).CombinedOutput(); err != nil {
+		return "", fmt.Errorf("error pushing image '%s': %v\n%s", image, err, out)
+	}
+	return image, nil
+}
+
+// sourceHash returns the hex SHA-256 of the files of a directory, by their relative paths and contents
+func sourceHash(dir string) (string, error) {
+	h := sha256.New()
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error { // in lexical order
+		if err != nil || info.IsDir() {
+			return err
+		}
+		relPath, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		fmt.Fprintf(h, "%s\x00%d\x00", filepath.ToSlash(relPath), info.Size())
+		_, err = io.Copy(h, file)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeContainerFiles writes the HTTP server wrapper and the Dockerfile of a function to its adapted source directory
+func writeContainerFiles(dir, runtime string) error {
+	files := map[string]string{}
+	switch runtime {
+	case "nodejs":
+		files["server.js"] = nodeServer
+		files["Dockerfile"] = fmt.Sprintf(nodeDockerfile, containerRuntimes[runtime])
+	case "python":
+		files["server.py"] = pythonServer
+		files["Dockerfile"] = fmt.Sprintf(pythonDockerfile, containerRuntimes[runtime])
+	case "go": // e.g. the proxy, which is an HTTP server itself
+		files["Dockerfile"] = fmt.Sprintf(goDockerfile, containerRuntimes[runtime])
+	default:
+		return fmt.Errorf("runtime '%s' not supported for containers", runtime)
+	}
+	for name, content := range files {
+		if _, err := os.Stat(filepath.Join(dir, name)); name == "Dockerfile" && err == nil {
+			log.Infof("Using the function's own Dockerfile")
+			continue
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			return fmt.Errorf("error writing %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+const nodeServer = `const http = require("http");
+const fn = require("./index.js");
+
+http.createServer((request, response) => {
+  if (request.url === "/_/health") {
+    response.end("OK");
+    return;
+  }
+  let body = "";
+  request.on("data", (chunk) => { body += chunk; });
+  request.on("end", () => {
+    const url = new URL(request.url, "http://localhost");
+    const req = { method: request.method, path: url.pathname, headers: request.headers, query: Object.fromEntries(url.searchParams), body: body };
+    const res = {
+      status: (code) => { response.statusCode = code; return res; },
+      set: (name, value) => { response.setHeader(name, value); return res; },
+      send: (data) => { response.end(typeof data === "string" ? data : JSON.stringify(data)); return res; },
+      json: (data) => res.set("Content-Type", "application/json").send(JSON.stringify(data)),
+      end: (data) => res.send(data || ""),
+    };
+    fn(req, res);
+  });
+}).listen(process.env.PORT || 8080);
+`
+
+const nodeDockerfile = `FROM %s
+WORKDIR /app
+COPY . .
+RUN if [ -f package.json ]; then npm install --omit=dev; fi
+ENV PORT=8080
+EXPOSE 8080
+CMD ["node", "server.js"]
+`
+
+const pythonServer = `import os
+from http.server import BaseHTTPRequestHandler, ThreadingHTTPServer
+
+from fn import fn
+
+
+class Handler(BaseHTTPRequestHandler):
+    def do_GET(self):
+        if self.path == "/_/health":
+            self.respond(200, "OK")
+            return
+        self.call()
+
+    def do_POST(self):
+        self.call()
+
+    def call(self):
+        length = int(self.headers.get("Content-Length") or 0)
+        body = self.rfile.read(length).decode("utf-8") if length > 0 else ""
+        result = fn(body, dict(self.headers))
+        self.respond(200, result if result is not None else "")
+
+    def respond(self, code, body):
+        data = body.encode("utf-8")
+        self.send_response(code)
+        self.send_header("Content-Length", str(len(data)))
+        self.end_headers()
+        self.wfile.write(data)
+
+
+ThreadingHTTPServer(("", int(os.environ.get("PORT", "8080"))), Handler).serve_forever()
+`
+
+const pythonDockerfile = `FROM %s
+WORKDIR /app
+COPY . .
+RUN if [ -f requirements.txt ]; then pip install --no-cache-dir -r requirements.txt; fi
+ENV PORT=8080
+EXPOSE 8080
+CMD ["python", "server.py"]
+`
+
+const goDockerfile = `FROM %s AS build
+WORKDIR /src
+COPY . .
+RUN if [ ! -f go.mod ]; then go mod init fn; fi && go mod tidy && CGO_ENABLED=0 go build -o /fn .
+
+FROM gcr.io/distroless/static
+COPY --from=build /fn /fn
+ENV PORT=8080
+EXPOSE 8080
+ENTRYPOINT ["/fn"]
+`
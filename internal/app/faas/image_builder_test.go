@@ -0,0 +1,142 @@
+package faas
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestMain(m *testing.M) {
+	log.SetLevel(log.WarnLevel)
+	os.Exit(m.Run())
+}
+
+// fakeTool writes a container CLI which logs its commands (and the files of a build's context), instead of building and pushing
+func fakeTool(t *testing.T) (tool string, commands func() []string) {
+	t.Helper()
+	dir := t.TempDir()
+	logFile := filepath.Join(dir, "commands.log")
+	tool = filepath.Join(dir, "docker")
+	script := fmt.Sprintf(`#!/bin/sh
+echo "$*" >> %[1]s
+if [ "$1" = "build" ]; then ls "$4" >> %[1]s; fi
+`, logFile)
+	if err := os.WriteFile(tool, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return tool, func() []string {
+		data, err := os.ReadFile(logFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Split(strings.TrimSpace(string(data)), "\n")
+	}
+}
+
+// nodeSource writes a function source directory with an index.js
+func nodeSource(t *testing.T, body string) string {
+	t.Helper()
+	dir := t.TempDir()
+	code := fmt.Sprintf("module.exports = (req, res) => {\n  res.send(%q);\n}", body)
+	if err := os.WriteFile(filepath.Join(dir, jsFileName), []byte(code), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestBuildTagsImage(t *testing.T) {
+	tool, commands := fakeTool(t)
+	b := &ImageBuilder{Registry: "registry.local:5000/uc/", Tool: tool}
+	ctx := context.Background()
+	tag := regexp.MustCompile(`^registry\.local:5000/uc/sieve:(\d{14})-([0-9a-f]{12})$`)
+
+	base := nodeSource(t, "base")
+	image, err := b.Build(ctx, "sieve", base, "nodejs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	match := tag.FindStringSubmatch(image)
+	if match == nil {
+		t.Fatalf("got image %s, want registry/name:time-hash", image)
+	}
+
+	ran := commands()
+	if len(ran) < 2 || !strings.HasPrefix(ran[0], "build -t "+image+" ") || ran[len(ran)-1] != "push "+image {
+		t.Fatalf("ran %q, want a build and a push of %s", ran, image)
+	}
+	if files := strings.Join(ran[1:len(ran)-1], " "); !strings.Contains(files, "Dockerfile") || !strings.Contains(files, "server.js") {
+		t.Errorf("built a context of %s, want the Dockerfile and the server", files)
+	}
+
+	// the same source has the same hash, and another source another one
+	again, err := b.Build(ctx, "sieve", base, "nodejs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash := tag.FindStringSubmatch(again); hash == nil || hash[2] != match[2] {
+		t.Errorf("got image %s for the same source, want the hash %s", again, match[2])
+	}
+	updated, err := b.Build(ctx, "sieve", nodeSource(t, "new"), "nodejs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash := tag.FindStringSubmatch(updated); hash == nil || hash[2] == match[2] {
+		t.Errorf("got image %s for a new source, want a new hash", updated)
+	}
+}
+
+func TestBuildErrors(t *testing.T) {
+	tool, _ := fakeTool(t)
+	tests := []struct {
+		name    string
+		builder ImageBuilder
+		runtime string
+		want    string
+	}{
+		{"unsupported runtime", ImageBuilder{Registry: "registry.local", Tool: tool}, "java", "runtime 'java' not supported"},
+		{"no registry", ImageBuilder{Tool: tool}, "nodejs", "a registry is required"},
+		{"failed build", ImageBuilder{Registry: "registry.local", Tool: "false"}, "nodejs", "error building image"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := test.builder.Build(context.Background(), "sieve", nodeSource(t, "base"), test.runtime)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("got %v, want %s", err, test.want)
+			}
+		})
+	}
+}
+
+func TestSourceHash(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hash := func() string {
+		h, err := sourceHash(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+
+	write("a", "bc")
+	first := hash()
+	if hash() != first {
+		t.Error("got another hash for the same files")
+	}
+	// the file names are hashed too, not only the contents
+	write("a", "b")
+	write("ac", "")
+	if hash() == first {
+		t.Error("got the same hash for other files")
+	}
+}
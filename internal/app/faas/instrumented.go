@@ -0,0 +1,70 @@
+package faas
+
+import (
+	"context"
+	"time"
+	Tracing "umbilical-choir-core/internal/app/tracing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var deployDurations = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "uc_agent_deploy_duration_seconds",
+	Help:    "Duration of the deployments on the FaaS, by operation (upload, update or delete) and result (ok or error).",
+	Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+}, []string{"operation", "result"})
+
+// instrumented is a FaaS whose deployments are measured and traced, see Instrument
+type instrumented struct {
+	FaaS
+}
+
+// Instrument returns the FaaS with the durations of its deployments (Upload, Update and Delete) on '/metrics', and each of them as a span.
+// Use Unwrap to get the adapter back, e.g. to switch on its type
+func Instrument(faas FaaS) FaaS {
+	return &instrumented{FaaS: faas}
+}
+
+// Unwrap returns the adapter of an instrumented FaaS, or the FaaS itself
+func Unwrap(faas FaaS) FaaS {
+	if i, ok := faas.(*instrumented); ok {
+		return i.FaaS
+	}
+	return faas
+}
+
+func (i *instrumented) Upload(ctx context.Context, funcName, path, runtime string, entryPoint string, isFullPath bool, args []string) (string, error) {
+	ctx, span := Tracing.Start(ctx, "FaaS.Upload", Tracing.Deployed.String(funcName), attribute.String("uc.path", path))
+	beginning := time.Now()
+	uri, err := i.FaaS.Upload(ctx, funcName, path, runtime, entryPoint, isFullPath, args)
+	observeDeploy("upload", beginning, span, err)
+	return uri, err
+}
+
+func (i *instrumented) Update(ctx context.Context, funcName, path, runtime string, entryPoint string, isFullPath bool, args []string) (string, error) {
+	ctx, span := Tracing.Start(ctx, "FaaS.Update", Tracing.Deployed.String(funcName), attribute.String("uc.path", path))
+	beginning := time.Now()
+	uri, err := i.FaaS.Update(ctx, funcName, path, runtime, entryPoint, isFullPath, args)
+	observeDeploy("update", beginning, span, err)
+	return uri, err
+}
+
+func (i *instrumented) Delete(ctx context.Context, funcName string) error {
+	ctx, span := Tracing.Start(ctx, "FaaS.Delete", Tracing.Deployed.String(funcName))
+	beginning := time.Now()
+	err := i.FaaS.Delete(ctx, funcName)
+	observeDeploy("delete", beginning, span, err)
+	return err
+}
+
+func observeDeploy(operation string, beginning time.Time, span trace.Span, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	deployDurations.WithLabelValues(operation, result).Observe(time.Since(beginning).Seconds())
+	Tracing.End(span, err)
+}
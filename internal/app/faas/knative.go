@@ -0,0 +1,69 @@
+package faas
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	Knative "umbilical-choir-core/internal/pkg/knative"
+)
+
+// KnativeAdapter deploys the functions as Knative services, as container images built from their sources (see ImageBuilder)
+type KnativeAdapter struct {
+	Knative *Knative.Knative
+	Builder *ImageBuilder
+}
+
+func (k *KnativeAdapter) WipeFunctions(ctx context.Context) error {
+	return fmt.Errorf("WipeFunctions not implemented for Knative")
+}
+
+func (k *KnativeAdapter) Functions(ctx context.Context) (string, error) {
+	names, err := k.Knative.List(ctx)
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(names, "\n"), nil
+}
+
+func (k *KnativeAdapter) FunctionExists(ctx context.Context, funcName string) (bool, error) {
+	_, err := k.Knative.URL(ctx, funcName)
+	if err != nil {
+		if err == Knative.ErrNotFound {
+			return false, nil
+		}
+		return false, fmt.Errorf("error checking if function '%s' exists: %v", funcName, err)
+	}
+	return true, nil
+}
+
+func (k *KnativeAdapter) FunctionUri(ctx context.Context, funcName string) (string, error) {
+	uri, err := k.Knative.URL(ctx, funcName)
+	if err != nil {
+		return "", fmt.Errorf("error retrieving function '%s' URL: %v", funcName, err)
+	}
+	return uri, nil
+}
+
+func (k *KnativeAdapter) Close() error {
+	return nil // no need to close anything
+}
+
+func (k *KnativeAdapter) Log(ctx context.Context) (string, error) {
+	return "", fmt.Errorf("Log not implemented for Knative")
+}
+
+func (k *KnativeAdapter) Upload(ctx context.Context, funcName, path, runtime string, entryPoint string, isFullPath bool, args []string) (string, error) {
+	image, err := k.Builder.Build(ctx, funcName, path, runtime)
+	if err != nil {
+		return "", err
+	}
+	return k.Knative.Apply(ctx, &Knative.Function{Name: funcName, Image: image, EnvironmentVariables: argsToEnv(args)})
+}
+
+func (k *KnativeAdapter) Update(ctx context.Context, funcName, path, runtime string, entryPoint string, isFullPath bool, args []string) (string, error) {
+	return k.Upload(ctx, funcName, path, runtime, entryPoint, isFullPath, args) // same as upload (creates or updates)
+}
+
+func (k *KnativeAdapter) Delete(ctx context.Context, funcName string) error {
+	return k.Knative.Delete(ctx, funcName)
+}
@@ -0,0 +1,124 @@
+package faas
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	Knative "umbilical-choir-core/internal/pkg/knative"
+)
+
+// newFakeAPIServer serves Knative services which are ready once applied, and returns the images they run
+func newFakeAPIServer(t *testing.T) (func() map[string]string, *httptest.Server) {
+	var mu sync.Mutex
+	images := map[string]string{}
+	const path = "/apis/serving.knative.dev/v1/namespaces/default/services"
+	write := func(w http.ResponseWriter, name string) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"metadata": map[string]any{"name": name, "generation": 1},
+			"status": map[string]any{
+				"observedGeneration": 1,
+				"address":            map[string]any{"url": "http://" + name + ".default.svc.cluster.local"},
+				"conditions":         []map[string]string{{"type": "Ready", "status": "True"}},
+			},
+		})
+	}
+	image := func(r *http.Request) (string, string) {
+		var request struct {
+			Metadata struct{ Name string }
+			Spec     struct {
+				Template struct {
+					Spec struct{ Containers []struct{ Image string } }
+				}
+			}
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+		return request.Metadata.Name, request.Spec.Template.Spec.Containers[0].Image
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST "+path, func(w http.ResponseWriter, r *http.Request) {
+		name, img := image(r)
+		mu.Lock()
+		defer mu.Unlock()
+		images[name] = img
+		write(w, name)
+	})
+	mux.HandleFunc("PATCH "+path+"/{name}", func(w http.ResponseWriter, r *http.Request) {
+		_, img := image(r)
+		mu.Lock()
+		defer mu.Unlock()
+		images[r.PathValue("name")] = img
+		write(w, r.PathValue("name"))
+	})
+	mux.HandleFunc("GET "+path+"/{name}", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if _, exists := images[r.PathValue("name")]; !exists {
+			http.NotFound(w, r)
+			return
+		}
+		write(w, r.PathValue("name"))
+	})
+	mux.HandleFunc("DELETE "+path+"/{name}", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		delete(images, r.PathValue("name"))
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return func() map[string]string {
+		mu.Lock()
+		defer mu.Unlock()
+		copied := map[string]string{}
+		for name, img := range images {
+			copied[name] = img
+		}
+		return copied
+	}, server
+}
+
+func TestKnativeAdapter(t *testing.T) {
+	images, server := newFakeAPIServer(t)
+	tool, _ := fakeTool(t)
+	client, err := Knative.NewKnative(server.URL, "", "", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := &KnativeAdapter{Knative: client, Builder: &ImageBuilder{Registry: "registry.local", Tool: tool}}
+	ctx := context.Background()
+
+	if exists, err := k.FunctionExists(ctx, "sieve"); err != nil || exists {
+		t.Errorf("got exists %v (%v) before the upload", exists, err)
+	}
+	uri, err := k.Upload(ctx, "sieve", nodeSource(t, "base"), "nodejs", "", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uri != "http://sieve.default.svc.cluster.local" {
+		t.Errorf("got URL %s", uri)
+	}
+	uploaded := images()["sieve"]
+
+	if _, err := k.Update(ctx, "sieve", nodeSource(t, "new"), "nodejs", "", false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if updated := images()["sieve"]; updated == "" || updated == uploaded {
+		t.Errorf("updated the image %s to %s, want a new one", uploaded, updated)
+	}
+	if uri, err := k.FunctionUri(ctx, "sieve"); err != nil || uri != "http://sieve.default.svc.cluster.local" {
+		t.Errorf("got URL %s (%v)", uri, err)
+	}
+
+	if err := k.Delete(ctx, "sieve"); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := k.FunctionExists(ctx, "sieve"); err != nil || exists {
+		t.Errorf("got exists %v (%v) after the delete", exists, err)
+	}
+	if _, err := k.FunctionUri(ctx, "sieve"); err == nil {
+		t.Error("got the URL of a deleted function")
+	}
+}
@@ -0,0 +1,118 @@
+package faas
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	Lambda "umbilical-choir-core/internal/pkg/lambda"
+)
+
+var lambdaRuntimes = map[string]string{
+	"python": "python3.12",
+	"nodejs": "nodejs20.x",
+	"go":     "provided.al2023", // a 'bootstrap' executable, e.g. the proxy
+}
+
+var lambdaHandlers = map[string]string{
+	"python": "lambda_function.handler",
+	"nodejs": "index.handler",
+	"go":     "bootstrap",
+}
+
+// LambdaAdapter deploys the functions to AWS Lambda, and uses their function URLs as the endpoints (e.g. for the proxy)
+type LambdaAdapter struct {
+	Lambda *Lambda.Lambda
+}
+
+func (l *LambdaAdapter) WipeFunctions(ctx context.Context) error {
+	return fmt.Errorf("WipeFunctions not implemented for Lambda")
+}
+
+func (l *LambdaAdapter) Functions(ctx context.Context) (string, error) {
+	names, err := l.Lambda.ListFunctions(ctx)
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(names, "\n"), nil
+}
+
+func (l *LambdaAdapter) FunctionExists(ctx context.Context, funcName string) (bool, error) {
+	_, err := l.Lambda.GetFunction(ctx, funcName)
+	if err != nil {
+		if Lambda.IsNotFound(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("error checking if function '%s' exists: %v", funcName, err)
+	}
+	return true, nil
+}
+
+func (l *LambdaAdapter) FunctionUri(ctx context.Context, funcName string) (string, error) {
+	uri, err := l.Lambda.FunctionURL(ctx, funcName)
+	if err != nil {
+		if Lambda.IsNotFound(err) {
+			return "", fmt.Errorf("function URL of '%s' not found", funcName)
+		}
+		return "", fmt.Errorf("error retrieving function '%s' URL: %v", funcName, err)
+	}
+	return uri, nil
+}
+
+func (l *LambdaAdapter) Close() error {
+	return nil // no need to close anything
+}
+
+func (l *LambdaAdapter) Log(ctx context.Context) (string, error) {
+	return "", fmt.Errorf("Log not implemented for Lambda")
+}
+
+func (l *LambdaAdapter) Upload(ctx context.Context, funcName, path, runtime string, entryPoint string, isFullPath bool, args []string) (string, error) {
+	function, err := l.function(ctx, funcName, path, runtime, args)
+	if err != nil {
+		return "", err
+	}
+	return l.Lambda.CreateFunction(ctx, function)
+}
+
+// Update updates the function, or creates it if it does not exist (e.g. the proxy on the first stage)
+func (l *LambdaAdapter) Update(ctx context.Context, funcName, path, runtime string, entryPoint string, isFullPath bool, args []string) (string, error) {
+	function, err := l.function(ctx, funcName, path, runtime, args)
+	if err != nil {
+		return "", err
+	}
+	exists, err := l.FunctionExists(ctx, funcName)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return l.Lambda.CreateFunction(ctx, function)
+	}
+	return l.Lambda.UpdateFunction(ctx, function)
+}
+
+func (l *LambdaAdapter) Delete(ctx context.Context, funcName string) error {
+	return l.Lambda.DeleteFunction(ctx, funcName)
+}
+
+// function adapts the source for Lambda, and returns the function to deploy with the args as its environment variables
+func (l *LambdaAdapter) function(ctx context.Context, funcName, path, runtime string, args []string) (*Lambda.Function, error) {
+	lambdaRuntime, exists := lambdaRuntimes[runtime]
+	if !exists {
+		return nil, fmt.Errorf("runtime '%s' not supported", runtime)
+	}
+
+	// Adapt the code for Lambda
+	adaptedCode, err := adaptFunction(ctx, path, "lambda", runtime)
+	if err != nil {
+		return nil, fmt.Errorf("error adapting function: %v", err)
+	}
+
+	function := &Lambda.Function{
+		Name:                 funcName,
+		SourceLocalPath:      adaptedCode,
+		Runtime:              lambdaRuntime,
+		Handler:              lambdaHandlers[runtime],
+		EnvironmentVariables: argsToEnv(args),
+	}
+	return function, nil
+}
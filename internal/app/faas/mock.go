@@ -0,0 +1,347 @@
+package faas
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// MockProxy is the path to deploy the built-in proxy from on a MockAdapter (see mockProxy)
+const MockProxy = "mock://proxy"
+
+// MockBehavior is how a function responds on a MockAdapter. The zero value responds immediately with the function's name
+type MockBehavior struct {
+	Latency   time.Duration // added to every call
+	Jitter    time.Duration // a random extra latency, up to this
+	ErrorRate float64       // ratio of the calls answered with a 500, in [0, 1]
+	Response  string        // the response body. the function's name if not set
+	Handler   http.Handler  // if set, handles the calls instead (the above is ignored)
+	Command   []string      // if set, the function runs as this child process instead, in its source directory, serving on $PORT
+	UpdateErr error         // if set, the updates to this version (or of this function) fail with it, e.g. a failed rollout
+}
+
+// MockAdapter is an in-process FaaS, for running release strategies without a FaaS platform (e.g. in go tests).
+// The functions are served by one local HTTP server as '/<func name>' (or run as child processes, see MockBehavior.Command),
+// and respond by the behavior set for their name or source path. The proxy is deployed from MockProxy
+type MockAdapter struct {
+	mutex     sync.Mutex
+	behaviors map[string]MockBehavior // by function name (e.g. 'sieve02') or source path
+	functions map[string]*mockFunction
+	history   []MockDeployment
+	server    *http.Server
+	url       string
+}
+
+// MockDeployment is a deployment on a MockAdapter, see Deployments
+type MockDeployment struct {
+	Operation string // "upload", "update" or "delete"
+	FuncName  string
+	Path      string // the source path. empty for a delete
+}
+
+type mockFunction struct {
+	name    string
+	path    string
+	env     map[string]string
+	handler http.Handler
+	process *exec.Cmd // only a child process
+	uri     string
+	calls   int
+}
+
+// NewMockAdapter starts serving the mock functions on the given address ("127.0.0.1:0", a random port, if not set)
+func NewMockAdapter(addr string) (*MockAdapter, error) {
+	if addr == "" {
+		addr = "127.0.0.1:0"
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("error starting the mock FaaS: %v", err)
+	}
+	m := &MockAdapter{
+		behaviors: make(map[string]MockBehavior),
+		functions: make(map[string]*mockFunction),
+		url:       "http://" + listener.Addr().String(),
+	}
+	m.server = &http.Server{Handler: http.HandlerFunc(m.route)}
+	go func() {
+		if err := m.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Errorf("Mock FaaS server stopped: %v", err)
+		}
+	}()
+	log.Infof("Mock FaaS serving the functions at '%s'", m.url)
+	return m, nil
+}
+
+// SetBehavior sets how the functions with the given name or source path respond, also the already deployed ones
+func (m *MockAdapter) SetBehavior(nameOrPath string, behavior MockBehavior) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.behaviors[nameOrPath] = behavior
+}
+
+// Calls returns the number of calls a function received since it was deployed
+func (m *MockAdapter) Calls(funcName string) int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if f, exists := m.functions[funcName]; exists {
+		return f.calls
+	}
+	return 0
+}
+
+// Deployments returns the uploads, updates and deletes of the functions so far, in order
+func (m *MockAdapter) Deployments() []MockDeployment {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]MockDeployment(nil), m.history...)
+}
+
+// Path returns the source path a function is deployed from (MockProxy for the proxy), or "" if it is not deployed
+func (m *MockAdapter) Path(funcName string) string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if f, exists := m.functions[funcName]; exists {
+		return f.path
+	}
+	return ""
+}
+
+// Call calls a function with the given body, and returns its response (e.g. to generate load on the proxy)
+func (m *MockAdapter) Call(funcName string, data string) (string, error) {
+	uri, err := m.FunctionUri(context.Background(), funcName)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.Post(uri, "text/plain", strings.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode >= 300 {
+		return string(body), fmt.Errorf("function '%s' responded %v", funcName, resp.Status)
+	}
+	return string(body), nil
+}
+
+func (m *MockAdapter) WipeFunctions(ctx context.Context) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for name, f := range m.functions {
+		f.stop()
+		delete(m.functions, name)
+	}
+	return nil
+}
+
+func (m *MockAdapter) Functions(ctx context.Context) (string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	names := make([]string, 0, len(m.functions))
+	for name := range m.functions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, "\n"), nil
+}
+
+func (m *MockAdapter) FunctionExists(ctx context.Context, funcName string) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	_, exists := m.functions[funcName]
+	return exists, nil
+}
+
+func (m *MockAdapter) FunctionUri(ctx context.Context, funcName string) (string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	f, exists := m.functions[funcName]
+	if !exists {
+		return "", fmt.Errorf("function '%s' not found", funcName)
+	}
+	return f.uri, nil
+}
+
+func (m *MockAdapter) Close() error {
+	m.WipeFunctions(context.Background())
+	return m.server.Close()
+}
+
+// Log returns the call count of each function
+func (m *MockAdapter) Log(ctx context.Context) (string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var lines []string
+	for name, f := range m.functions {
+		lines = append(lines, fmt.Sprintf("%s: %d calls", name, f.calls))
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n"), nil
+}
+
+func (m *MockAdapter) Upload(ctx context.Context, funcName, path, runtime string, entryPoint string, isFullPath bool, args []string) (string, error) {
+	return m.deploy(ctx, "upload", funcName, path, args)
+}
+
+func (m *MockAdapter) Update(ctx context.Context, funcName, path, runtime string, entryPoint string, isFullPath bool, args []string) (string, error) {
+	return m.deploy(ctx, "update", funcName, path, args) // same as upload (replaces the function)
+}
+
+// deploy deploys (or replaces) a function, and records it as the given operation
+func (m *MockAdapter) deploy(ctx context.Context, operation, funcName, path string, args []string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	f := &mockFunction{name: funcName, path: path, env: argsToEnv(args), uri: fmt.Sprintf("%s/%s", m.url, funcName)}
+	m.mutex.Lock()
+	behavior := m.behaviorOf(funcName, path)
+	m.mutex.Unlock()
+
+	if operation == "update" && behavior.UpdateErr != nil {
+		return "", behavior.UpdateErr
+	}
+
+	switch {
+	case path == MockProxy:
+		proxy, err := newMockProxy(f.env)
+		if err != nil {
+			return "", err
+		}
+		f.handler = proxy
+	case len(behavior.Command) > 0:
+		if err := f.start(behavior.Command, args); err != nil {
+			return "", fmt.Errorf("error starting '%s': %v", funcName, err)
+		}
+	default:
+		f.handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { m.respond(f, w, r) })
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if previous, exists := m.functions[funcName]; exists {
+		previous.stop()
+	}
+	m.functions[funcName] = f
+	m.history = append(m.history, MockDeployment{Operation: operation, FuncName: funcName, Path: path})
+	log.Debugf("Mock FaaS deployed '%s' from '%s' at '%s'", funcName, path, f.uri)
+	return f.uri, nil
+}
+
+func (m *MockAdapter) Delete(ctx context.Context, funcName string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	f, exists := m.functions[funcName]
+	if !exists {
+		return fmt.Errorf("function '%s' not found", funcName)
+	}
+	f.stop()
+	delete(m.functions, funcName)
+	m.history = append(m.history, MockDeployment{Operation: "delete", FuncName: funcName})
+	return nil
+}
+
+// route passes a call of '/<func name>' to the function
+func (m *MockAdapter) route(w http.ResponseWriter, r *http.Request) {
+	funcName := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)[0]
+	m.mutex.Lock()
+	f, exists := m.functions[funcName]
+	if exists {
+		f.calls++
+	}
+	m.mutex.Unlock()
+	if !exists || f.handler == nil {
+		http.NotFound(w, r)
+		return
+	}
+	f.handler.ServeHTTP(w, r)
+}
+
+// respond answers a call by the function's current behavior
+func (m *MockAdapter) respond(f *mockFunction, w http.ResponseWriter, r *http.Request) {
+	m.mutex.Lock()
+	behavior := m.behaviorOf(f.name, f.path)
+	m.mutex.Unlock()
+	if behavior.Handler != nil {
+		behavior.Handler.ServeHTTP(w, r)
+		return
+	}
+
+	latency := behavior.Latency
+	if behavior.Jitter > 0 {
+		latency += time.Duration(rand.Int63n(int64(behavior.Jitter)))
+	}
+	time.Sleep(latency)
+	if rand.Float64() < behavior.ErrorRate {
+		http.Error(w, "injected error", http.StatusInternalServerError)
+		return
+	}
+	response := behavior.Response
+	if response == "" {
+		response = f.name
+	}
+	fmt.Fprint(w, response)
+}
+
+func (m *MockAdapter) behaviorOf(funcName, path string) MockBehavior {
+	if behavior, exists := m.behaviors[funcName]; exists {
+		return behavior
+	}
+	return m.behaviors[path]
+}
+
+// start runs the function as a child process serving on a free port, and waits until it accepts connections
+func (f *mockFunction) start(command []string, args []string) error {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	f.process = exec.Command(command[0], command[1:]...)
+	f.process.Dir = f.path
+	f.process.Env = append(append(os.Environ(), "PORT="+addr[strings.LastIndex(addr, ":")+1:]), args...)
+	var output bytes.Buffer
+	f.process.Stdout, f.process.Stderr = &output, &output
+	if err := f.process.Start(); err != nil {
+		return err
+	}
+	f.uri = "http://" + addr
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		if time.Now().After(deadline) {
+			f.stop()
+			return fmt.Errorf("not serving on %s after 10s: %s", addr, strings.TrimSpace(output.String()))
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func (f *mockFunction) stop() {
+	if f.process != nil && f.process.Process != nil {
+		f.process.Process.Kill()
+		f.process.Wait()
+	}
+}
@@ -0,0 +1,166 @@
+package faas
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// mockProxy is a Go port of the umbilical-choir proxy, deployed on a MockAdapter.
+// It splits the calls between the tested versions ('F<n>ENDPOINT') by their chances ('F<n>CHANCE', or 'BCHANCE' for f2 of the
+// older two-version builds), and pushes the metrics of each call to the metric server at 'AGENTSCHEME'://'AGENTHOST':'AGENTPORT',
+// as 'PROGRAM' of 'STAGE' (also in the 'X-UC-Program' header), signed by 'PUSHSECRET' (if set)
+type mockProxy struct {
+	program   string
+	stage     string
+	secret    string
+	pushURL   string
+	endpoints []string
+	chances   []float64 // traffic percentage of each version
+	client    *http.Client
+}
+
+type mockMetric struct {
+	MetricName string  `json:"metric_name"`
+	Value      float64 `json:"value"`
+}
+
+func newMockProxy(env map[string]string) (*mockProxy, error) {
+	count := 2
+	if fcount, exists := env["FCOUNT"]; exists {
+		n, err := strconv.Atoi(fcount)
+		if err != nil {
+			return nil, fmt.Errorf("invalid FCOUNT '%s': %v", fcount, err)
+		}
+		count = n
+	}
+	port := env["AGENTPORT"]
+	if port == "" { // an older agent
+		port = "9999"
+	}
+	scheme := env["AGENTSCHEME"]
+	if scheme == "" {
+		scheme = "http"
+	}
+	p := &mockProxy{
+		program: env["PROGRAM"],
+		stage:   env["STAGE"],
+		secret:  env["PUSHSECRET"],
+		pushURL: fmt.Sprintf("%s://%s/push", scheme, net.JoinHostPort(env["AGENTHOST"], port)),
+		client:  &http.Client{Timeout: 30 * time.Second},
+	}
+	hasChances := false
+	for i := 1; i <= count; i++ {
+		endpoint := env[fmt.Sprintf("F%dENDPOINT", i)]
+		if endpoint == "" {
+			return nil, fmt.Errorf("no endpoint for f%d (F%dENDPOINT)", i, i)
+		}
+		p.endpoints = append(p.endpoints, endpoint)
+		chance, exists := env[fmt.Sprintf("F%dCHANCE", i)]
+		hasChances = hasChances || exists
+		value, _ := strconv.ParseFloat(chance, 64)
+		p.chances = append(p.chances, value)
+	}
+	if !hasChances { // an older build's args: f2 gets 'BCHANCE', f1 the rest
+		bChance, err := strconv.ParseFloat(env["BCHANCE"], 64)
+		if err != nil || count != 2 {
+			return nil, fmt.Errorf("no F<n>CHANCE, and an invalid BCHANCE '%s' for %d versions", env["BCHANCE"], count)
+		}
+		p.chances = []float64{100 - bChance, bChance}
+	}
+	return p, nil
+}
+
+func (p *mockProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	beginning := time.Now()
+	body, _ := io.ReadAll(r.Body)
+	n := p.pick()
+
+	status, response, err := p.forward(r, p.endpoints[n], body)
+	fnTime := float64(time.Since(beginning).Microseconds()) / 1000
+	if err != nil {
+		log.Debugf("Mock proxy failed to call f%d: %v", n+1, err)
+		status, response = http.StatusBadGateway, []byte(err.Error())
+	}
+	w.WriteHeader(status)
+	w.Write(response)
+
+	metrics := []mockMetric{
+		{MetricName: "call_count", Value: 1},
+		{MetricName: "proxy_time", Value: float64(time.Since(beginning).Microseconds()) / 1000},
+		{MetricName: fmt.Sprintf("f%d_count", n+1), Value: 1},
+	}
+	if err != nil || status >= 500 {
+		metrics = append(metrics, mockMetric{MetricName: fmt.Sprintf("f%d_error_count", n+1), Value: 1})
+	} else {
+		metrics = append(metrics, mockMetric{MetricName: fmt.Sprintf("f%d_time", n+1), Value: fnTime})
+	}
+	p.push(metrics)
+}
+
+// pick returns the index of the version to call, by the chances
+func (p *mockProxy) pick() int {
+	r := rand.Float64() * 100
+	for i, chance := range p.chances {
+		if r < chance {
+			return i
+		}
+		r -= chance
+	}
+	return 0 // the chances don't sum up to 100
+}
+
+func (p *mockProxy) forward(r *http.Request, endpoint string, body []byte) (int, []byte, error) {
+	req, err := http.NewRequest(r.Method, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header = r.Header.Clone()
+	req.URL.RawQuery = r.URL.RawQuery
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	response, err := io.ReadAll(resp.Body)
+	return resp.StatusCode, response, err
+}
+
+func (p *mockProxy) push(metrics []mockMetric) {
+	payload, _ := json.Marshal(map[string]any{"program": p.program, "stage": p.stage, "metrics": metrics})
+	req, err := http.NewRequest(http.MethodPost, p.pushURL, bytes.NewReader(payload))
+	if err != nil {
+		log.Warnf("Mock proxy failed to push the metrics: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-UC-Program", p.program)
+	if p.secret != "" { // "sha256=" and the hex HMAC-SHA256 of the timestamp, "." and the body
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		mac := hmac.New(sha256.New, []byte(p.secret))
+		mac.Write([]byte(timestamp + "."))
+		mac.Write(payload)
+		req.Header.Set("X-UC-Timestamp", timestamp)
+		req.Header.Set("X-UC-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		log.Warnf("Mock proxy failed to push the metrics: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Warnf("Mock proxy's metrics were rejected: %v", resp.Status)
+	}
+}
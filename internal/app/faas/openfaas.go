@@ -0,0 +1,103 @@
+package faas
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	OpenFaaS "umbilical-choir-core/internal/pkg/openfaas"
+)
+
+// OpenFaaSAdapter deploys the functions through the OpenFaaS gateway, as container images built from their sources (see ImageBuilder)
+type OpenFaaSAdapter struct {
+	OpenFaaS       *OpenFaaS.OpenFaaS
+	Builder        *ImageBuilder
+	FunctionsRoute string // the gateway the proxy reaches the functions through, e.g. the in-cluster 'http://gateway.openfaas:8080'
+}
+
+func NewOpenFaaSAdapter(openFaaS *OpenFaaS.OpenFaaS, builder *ImageBuilder, proxyGateway string) *OpenFaaSAdapter {
+	if proxyGateway == "" {
+		proxyGateway = openFaaS.Gateway
+	}
+	return &OpenFaaSAdapter{OpenFaaS: openFaaS, Builder: builder, FunctionsRoute: proxyGateway}
+}
+
+func (o *OpenFaaSAdapter) WipeFunctions(ctx context.Context) error {
+	return fmt.Errorf("WipeFunctions not implemented for OpenFaaS")
+}
+
+func (o *OpenFaaSAdapter) Functions(ctx context.Context) (string, error) {
+	names, err := o.OpenFaaS.Functions(ctx)
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(names, "\n"), nil
+}
+
+func (o *OpenFaaSAdapter) FunctionExists(ctx context.Context, funcName string) (bool, error) {
+	_, err := o.OpenFaaS.Function(ctx, funcName)
+	if err != nil {
+		if err == OpenFaaS.ErrNotFound {
+			return false, nil
+		}
+		return false, fmt.Errorf("error checking if function '%s' exists: %v", funcName, err)
+	}
+	return true, nil
+}
+
+func (o *OpenFaaSAdapter) FunctionUri(ctx context.Context, funcName string) (string, error) {
+	return o.OpenFaaS.FunctionURL(o.FunctionsRoute, funcName), nil
+}
+
+func (o *OpenFaaSAdapter) Close() error {
+	return nil // no need to close anything
+}
+
+func (o *OpenFaaSAdapter) Log(ctx context.Context) (string, error) {
+	return "", fmt.Errorf("Log not implemented for OpenFaaS")
+}
+
+func (o *OpenFaaSAdapter) Upload(ctx context.Context, funcName, path, runtime string, entryPoint string, isFullPath bool, args []string) (string, error) {
+	return o.deploy(ctx, funcName, path, runtime, args, false)
+}
+
+// Update updates the function, or deploys it if it does not exist (e.g. the proxy on the first stage)
+func (o *OpenFaaSAdapter) Update(ctx context.Context, funcName, path, runtime string, entryPoint string, isFullPath bool, args []string) (string, error) {
+	exists, err := o.FunctionExists(ctx, funcName)
+	if err != nil {
+		return "", err
+	}
+	return o.deploy(ctx, funcName, path, runtime, args, exists)
+}
+
+func (o *OpenFaaSAdapter) Delete(ctx context.Context, funcName string) error {
+	return o.OpenFaaS.Delete(ctx, funcName)
+}
+
+func (o *OpenFaaSAdapter) deploy(ctx context.Context, funcName, path, runtime string, args []string, update bool) (string, error) {
+	image, err := o.Builder.Build(ctx, funcName, path, runtime)
+	if err != nil {
+		return "", err
+	}
+	function := &OpenFaaS.Function{
+		Service:              funcName,
+		Image:                image,
+		EnvironmentVariables: argsToEnv(args),
+		Labels:               map[string]string{"app.kubernetes.io/managed-by": "umbilical-choir"},
+	}
+	if err := o.OpenFaaS.Deploy(ctx, function, update); err != nil {
+		return "", err
+	}
+	return o.FunctionUri(ctx, funcName)
+}
+
+// argsToEnv converts 'KEY=value' args to environment variables
+func argsToEnv(args []string) map[string]string {
+	env := map[string]string{}
+	for _, arg := range args {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) == 2 {
+			env[parts[0]] = parts[1]
+		}
+	}
+	return env
+}
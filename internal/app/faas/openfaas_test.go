@@ -0,0 +1,118 @@
+package faas
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+
+	OpenFaaS "umbilical-choir-core/internal/pkg/openfaas"
+)
+
+// fakeGateway is an OpenFaaS gateway whose functions are ready once deployed, and which records the deploy requests
+type fakeGateway struct {
+	mu        sync.Mutex
+	functions map[string]OpenFaaS.Function
+	methods   []string // of the deploy requests
+}
+
+func newFakeGateway(t *testing.T) (*fakeGateway, *httptest.Server) {
+	g := &fakeGateway{functions: map[string]OpenFaaS.Function{}}
+	mux := http.NewServeMux()
+	deploy := func(w http.ResponseWriter, r *http.Request) {
+		var f OpenFaaS.Function
+		json.NewDecoder(r.Body).Decode(&f)
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		if _, exists := g.functions[f.Service]; exists == (r.Method == http.MethodPost) {
+			http.Error(w, "conflict or not found", map[bool]int{true: http.StatusConflict, false: http.StatusNotFound}[exists])
+			return
+		}
+		g.functions[f.Service] = f
+		g.methods = append(g.methods, r.Method)
+		w.WriteHeader(http.StatusAccepted)
+	}
+	mux.HandleFunc("POST /system/functions", deploy)
+	mux.HandleFunc("PUT /system/functions", deploy)
+	mux.HandleFunc("GET /system/function/{name}", func(w http.ResponseWriter, r *http.Request) {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		if _, exists := g.functions[r.PathValue("name")]; !exists {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(OpenFaaS.FunctionStatus{Name: r.PathValue("name"), Replicas: 1, AvailableReplicas: 1})
+	})
+	mux.HandleFunc("DELETE /system/functions", func(w http.ResponseWriter, r *http.Request) {
+		var request struct{ FunctionName string }
+		json.NewDecoder(r.Body).Decode(&request)
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		delete(g.functions, request.FunctionName)
+		w.WriteHeader(http.StatusAccepted)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return g, server
+}
+
+func (g *fakeGateway) deployed(name string) OpenFaaS.Function {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.functions[name]
+}
+
+func TestOpenFaaSAdapter(t *testing.T) {
+	g, server := newFakeGateway(t)
+	tool, _ := fakeTool(t)
+	o := NewOpenFaaSAdapter(OpenFaaS.NewOpenFaaS(server.URL, "", "", ""), &ImageBuilder{Registry: "registry.local", Tool: tool}, "http://gateway.openfaas:8080")
+	ctx := context.Background()
+
+	if exists, err := o.FunctionExists(ctx, "sieve"); err != nil || exists {
+		t.Errorf("got exists %v (%v) before the upload", exists, err)
+	}
+	uri, err := o.Upload(ctx, "sieve", nodeSource(t, "base"), "nodejs", "", false, []string{"F1ENDPOINT=http://f1", "invalid"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uri != "http://gateway.openfaas:8080/function/sieve" {
+		t.Errorf("got URL %s, want it behind the proxy's gateway", uri)
+	}
+	uploaded := g.deployed("sieve")
+	if len(uploaded.EnvironmentVariables) != 1 || uploaded.EnvironmentVariables["F1ENDPOINT"] != "http://f1" || uploaded.Labels["app.kubernetes.io/managed-by"] != "umbilical-choir" {
+		t.Errorf("uploaded %+v", uploaded)
+	}
+
+	// an update replaces the image of an existing function, and deploys a missing one
+	if _, err := o.Update(ctx, "sieve", nodeSource(t, "new"), "nodejs", "", false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if g.deployed("sieve").Image == uploaded.Image {
+		t.Errorf("updated the image %s, want a new one", uploaded.Image)
+	}
+	if _, err := o.Update(ctx, "sieve-proxy", nodeSource(t, "proxy"), "nodejs", "", false, nil); err != nil {
+		t.Fatal(err)
+	}
+	g.mu.Lock()
+	if want := []string{http.MethodPost, http.MethodPut, http.MethodPost}; !reflect.DeepEqual(g.methods, want) {
+		t.Errorf("deployed with %v, want %v", g.methods, want)
+	}
+	g.mu.Unlock()
+
+	if err := o.Delete(ctx, "sieve"); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := o.FunctionExists(ctx, "sieve"); err != nil || exists {
+		t.Errorf("got exists %v (%v) after the delete", exists, err)
+	}
+}
+
+func TestArgsToEnv(t *testing.T) {
+	env := argsToEnv([]string{"F1ENDPOINT=http://f1?a=b", "EMPTY=", "invalid"})
+	if len(env) != 2 || env["F1ENDPOINT"] != "http://f1?a=b" || env["EMPTY"] != "" {
+		t.Errorf("got %v", env)
+	}
+}
@@ -1,6 +1,7 @@
 package faas
 
 import (
+	"context"
 	"fmt"
 	TinyFaaS "github.com/ChaosRez/go-tinyfaas"
 	"strings"
@@ -24,15 +25,15 @@ func NewTinyFaaSAdapter(tf *TinyFaaS.TinyFaaS, dockerHostAddress string) *TinyFa
 	}
 }
 
-func (t *TinyFaaSAdapter) WipeFunctions() error {
+func (t *TinyFaaSAdapter) WipeFunctions(ctx context.Context) error {
 	return t.TF.WipeFunctions()
 }
 
-func (t *TinyFaaSAdapter) Functions() (string, error) {
+func (t *TinyFaaSAdapter) Functions(ctx context.Context) (string, error) {
 	return t.TF.Functions()
 }
 
-func (t *TinyFaaSAdapter) FunctionExists(funcName string) (bool, error) {
+func (t *TinyFaaSAdapter) FunctionExists(ctx context.Context, funcName string) (bool, error) {
 	functionsList, err := t.TF.Functions()
 	if err != nil {
 		return false, fmt.Errorf("error retrieving functions list: %v", err)
@@ -47,7 +48,7 @@ func (t *TinyFaaSAdapter) FunctionExists(funcName string) (bool, error) {
 	return false, nil
 }
 
-func (t *TinyFaaSAdapter) FunctionUri(funcName string) (string, error) {
+func (t *TinyFaaSAdapter) FunctionUri(ctx context.Context, funcName string) (string, error) {
 	return fmt.Sprintf("http://%s:%s/%s", "172.17.0.1", "8000", funcName), nil // FIXME: host and port is different from the config (mangement from localhost/remote). the host should be accessible localhost from docker env and port is 8000 and not the management 8080 port
 }
 
@@ -55,18 +56,21 @@ func (t *TinyFaaSAdapter) Close() error {
 	return nil // no need to close anything
 }
 
-func (t *TinyFaaSAdapter) Log() (string, error) {
+func (t *TinyFaaSAdapter) Log(ctx context.Context) (string, error) {
 	return t.TF.ResultsLog()
 }
 
-func (t *TinyFaaSAdapter) Upload(funcName, path, runtime string, entryPoint string, isFullPath bool, args []string) (string, error) {
+func (t *TinyFaaSAdapter) Upload(ctx context.Context, funcName, path, runtime string, entryPoint string, isFullPath bool, args []string) (string, error) {
+	if err := ctx.Err(); err != nil { // go-tinyfaas takes no context, so it is only checked before the calls
+		return "", err
+	}
 	tfRuntime, exists := tfRuntimes[runtime]
 	if !exists {
 		return "", fmt.Errorf("runtime '%s' not supported", runtime)
 	}
 
 	// Adapt the code for tinyFaaS
-	adaptedCode, errf := adaptFunction(path, "tinyfaas", runtime)
+	adaptedCode, errf := adaptFunction(ctx, path, "tinyfaas", runtime)
 	if errf != nil {
 		return "", fmt.Errorf("error adapting function: %v", errf)
 	}
@@ -75,10 +79,13 @@ func (t *TinyFaaSAdapter) Upload(funcName, path, runtime string, entryPoint stri
 	return fmt.Sprintf("%s/%s", t.tfProxyEndpoint, funcName), err
 }
 
-func (t *TinyFaaSAdapter) Update(funcName, path, runtime string, entryPoint string, isFullPath bool, args []string) (string, error) {
-	return t.Upload(funcName, path, runtime, entryPoint, isFullPath, args) // same as upload
+func (t *TinyFaaSAdapter) Update(ctx context.Context, funcName, path, runtime string, entryPoint string, isFullPath bool, args []string) (string, error) {
+	return t.Upload(ctx, funcName, path, runtime, entryPoint, isFullPath, args) // same as upload
 }
 
-func (t *TinyFaaSAdapter) Delete(funcName string) error {
+func (t *TinyFaaSAdapter) Delete(ctx context.Context, funcName string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	return t.TF.Delete(funcName)
 }
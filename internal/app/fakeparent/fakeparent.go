@@ -0,0 +1,254 @@
+// Package fakeparent is an embeddable fake of the parent Release Manager, for integration testing the agent's protocol with its parent
+// (/poll, /release, /release/functions/{id}, /end_stage and /result) without the release-manager repo
+package fakeparent
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	MetricAgg "umbilical-choir-core/internal/app/metric_aggregator"
+)
+
+// Release is a scripted release, handed out once to each polling agent
+type Release struct {
+	ID        string // the release ID on /poll. it should match the strategy's id, which the agent downloads the functions by
+	Strategy  []byte // the release strategy yaml
+	Functions []byte // the functions zip, see ZipDir
+}
+
+// Poll is a received poll request
+type Poll struct {
+	ID               string          `json:"id"`
+	NumberOfChildren int             `json:"number_of_children"`
+	GeographicArea   json.RawMessage `json:"geographic_area"`
+}
+
+// EndStagePoll is a received poll for the end signal of a stage
+type EndStagePoll struct {
+	ID         string `json:"id"`
+	StrategyID string `json:"strategy_id"`
+	StageName  string `json:"stage_name"`
+}
+
+// Server is a running fake parent. Set the agent's parent host and port to Host and Port
+type Server struct {
+	*httptest.Server
+	Host string
+	Port string
+
+	mutex     sync.Mutex
+	releases  []Release
+	delivered map[string]map[string]bool // agent ID -> release IDs handed out
+	endStages map[string]time.Duration   // stage name -> signal the end this long after its first end_stage poll
+	firstPoll map[string]time.Time       // stage name -> its first end_stage poll
+	polls     []Poll
+	endPolls  []EndStagePoll
+	results   []MetricAgg.ResultRequest
+	children  int
+}
+
+// New starts a fake parent on a random local port. Close it after the test
+func New() *Server {
+	s := &Server{
+		delivered: make(map[string]map[string]bool),
+		endStages: make(map[string]time.Duration),
+		firstPoll: make(map[string]time.Time),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /poll", s.handlePoll)
+	mux.HandleFunc("GET /release", s.handleRelease)
+	mux.HandleFunc("GET /release/functions/{id}", s.handleFunctions)
+	mux.HandleFunc("POST /end_stage", s.handleEndStage)
+	mux.HandleFunc("POST /result", s.handleResult)
+	s.Server = httptest.NewServer(mux)
+	s.Host, s.Port, _ = net.SplitHostPort(s.Listener.Addr().String())
+	log.Infof("Fake parent listening at %s", s.URL)
+	return s
+}
+
+// AddRelease queues a release, which the next poll of each agent gets
+func (s *Server) AddRelease(release Release) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.releases = append(s.releases, release)
+}
+
+// EndStageAfter signals the end of a stage (a WaitForSignal stage) this long after the agent's first poll for it. 0 ends it on the first poll
+func (s *Server) EndStageAfter(stageName string, after time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.endStages[stageName] = after
+}
+
+// Polls returns the received poll requests
+func (s *Server) Polls() []Poll {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]Poll(nil), s.polls...)
+}
+
+// EndStagePolls returns the received polls for the end signal of a stage
+func (s *Server) EndStagePolls() []EndStagePoll {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]EndStagePoll(nil), s.endPolls...)
+}
+
+// Results returns the received result requests, in order
+func (s *Server) Results() []MetricAgg.ResultRequest {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]MetricAgg.ResultRequest(nil), s.results...)
+}
+
+// WaitForResults waits until at least n result requests are received, and returns them
+func (s *Server) WaitForResults(n int, timeout time.Duration) ([]MetricAgg.ResultRequest, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		results := s.Results()
+		if len(results) >= n {
+			return results, nil
+		}
+		if time.Now().After(deadline) {
+			return results, fmt.Errorf("received %d of %d results after %v", len(results), n, timeout)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// handlePoll registers a new agent (empty ID), and hands out the next release it did not get yet
+func (s *Server) handlePoll(w http.ResponseWriter, r *http.Request) {
+	var poll Poll
+	if err := json.NewDecoder(r.Body).Decode(&poll); err != nil {
+		http.Error(w, "Error parsing JSON payload", http.StatusBadRequest)
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.polls = append(s.polls, poll)
+	if poll.ID == "" {
+		s.children++
+		poll.ID = fmt.Sprintf("child-%d", s.children)
+	}
+	if s.delivered[poll.ID] == nil {
+		s.delivered[poll.ID] = make(map[string]bool)
+	}
+	response := map[string]string{"id": poll.ID, "new_release": ""}
+	for _, release := range s.releases {
+		if !s.delivered[poll.ID][release.ID] {
+			s.delivered[poll.ID][release.ID] = true
+			response["new_release"] = release.ID
+			break
+		}
+	}
+	writeJSON(w, response)
+}
+
+func (s *Server) handleRelease(w http.ResponseWriter, r *http.Request) {
+	release, exists := s.release(r.URL.Query().Get("releaseID"))
+	if !exists {
+		http.Error(w, "release not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-yaml")
+	w.Write(release.Strategy)
+}
+
+func (s *Server) handleFunctions(w http.ResponseWriter, r *http.Request) {
+	release, exists := s.release(r.PathValue("id"))
+	if !exists || release.Functions == nil {
+		http.Error(w, "release functions not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Write(release.Functions)
+}
+
+func (s *Server) handleEndStage(w http.ResponseWriter, r *http.Request) {
+	var poll EndStagePoll
+	if err := json.NewDecoder(r.Body).Decode(&poll); err != nil {
+		http.Error(w, "Error parsing JSON payload", http.StatusBadRequest)
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.endPolls = append(s.endPolls, poll)
+	if _, exists := s.firstPoll[poll.StageName]; !exists {
+		s.firstPoll[poll.StageName] = time.Now()
+	}
+	after, scheduled := s.endStages[poll.StageName]
+	endStage := scheduled && time.Since(s.firstPoll[poll.StageName]) >= after
+	writeJSON(w, map[string]bool{"end_stage": endStage})
+}
+
+func (s *Server) handleResult(w http.ResponseWriter, r *http.Request) {
+	var result MetricAgg.ResultRequest
+	if err := json.NewDecoder(r.Body).Decode(&result); err != nil {
+		http.Error(w, "Error parsing JSON payload", http.StatusBadRequest)
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.results = append(s.results, result)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) release(id string) (Release, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, release := range s.releases {
+		if release.ID == id {
+			return release, true
+		}
+	}
+	return Release{}, false
+}
+
+func writeJSON(w http.ResponseWriter, response any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// ZipDir zips a directory as a release's functions. The agent unzips them to its working directory,
+// so the entries keep the given path, e.g. "fns/sieve/index.js" for "fns/sieve"
+func ZipDir(dir string) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := zip.NewWriter(&buf)
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() { // the agent creates the directories by their entries, as in the zips of 'zip -r'
+			_, err = writer.Create(filepath.ToSlash(path) + "/")
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		file, err := writer.Create(filepath.ToSlash(path))
+		if err != nil {
+			return err
+		}
+		_, err = file.Write(data)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error zipping '%s': %v", dir, err)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
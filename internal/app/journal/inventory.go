@@ -0,0 +1,64 @@
+package journal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const inventoryFileName = "inventory.json"
+
+// Inventory is the intended version of each function the agent released, and the names of its test functions.
+// It outlives the releases (unlike the journal), so the functions can be reconciled with the FaaS later, e.g. after a crash
+type Inventory struct {
+	Functions map[string]Rollback `json:"functions"` // function name -> the version to restore it to, and its test functions
+	path      string
+}
+
+// LoadInventory loads the inventory of the data directory, or returns an empty one.
+// Without a data directory (""), the inventory is only kept in memory
+func LoadInventory(dataDir string) (*Inventory, error) {
+	inventory := &Inventory{Functions: make(map[string]Rollback)}
+	if dataDir == "" {
+		return inventory, nil
+	}
+	inventory.path = filepath.Join(dataDir, inventoryFileName)
+	data, err := os.ReadFile(inventory.path)
+	if os.IsNotExist(err) {
+		return inventory, nil
+	}
+	if err != nil {
+		return inventory, fmt.Errorf("failed to read the inventory: %v", err)
+	}
+	if err := json.Unmarshal(data, inventory); err != nil {
+		return inventory, fmt.Errorf("failed to parse the inventory '%s': %v", inventory.path, err)
+	}
+	if inventory.Functions == nil {
+		inventory.Functions = make(map[string]Rollback)
+	}
+	return inventory, nil
+}
+
+// Set records the intended version of a function, and saves the inventory
+func (i *Inventory) Set(function Rollback) error {
+	i.Functions[function.FuncName] = function
+	if i.path == "" {
+		return nil
+	}
+	if err := writeFile(i.path, i); err != nil {
+		return fmt.Errorf("failed to save the inventory: %v", err)
+	}
+	return nil
+}
+
+// Names returns the names of the functions in the inventory, sorted
+func (i *Inventory) Names() []string {
+	names := make([]string, 0, len(i.Functions))
+	for name := range i.Functions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
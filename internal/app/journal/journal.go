@@ -0,0 +1,101 @@
+// Package journal persists the progress of the running release, so the agent can resume it (or roll it back) after a restart
+package journal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const fileName = "journal.json"
+
+// Journal is the progress of the running release. It is saved before each stage (and each step of a Gradual stage), and removed when the release ends
+type Journal struct {
+	AgentID      string                       `json:"agent_id"` // the ID given by the parent
+	ReleaseID    string                       `json:"release_id"`
+	StrategyPath string                       `json:"strategy_path"`
+	Stage        string                       `json:"stage"`          // the running stage
+	Step         int                          `json:"step,omitempty"` // the running step of a Gradual stage
+	Deployments  map[string]map[string]string `json:"deployments"`    // test functions kept deployed between stages: function name -> version name -> URI
+	Rollback     Rollback                     `json:"rollback"`       // of the running stage's function
+	UpdatedAt    time.Time                    `json:"updated_at"`
+	path         string
+}
+
+// Rollback is what is needed to roll the running stage back without the strategy: the function's rollback version and its test functions
+type Rollback struct {
+	FuncName      string   `json:"func_name"`
+	Path          string   `json:"path"`
+	Env           string   `json:"env"`
+	TestFunctions []string `json:"test_functions"` // deployment names
+}
+
+// New creates an empty journal in the data directory
+func New(dataDir string) *Journal {
+	return &Journal{path: filepath.Join(dataDir, fileName)}
+}
+
+// Load loads the journal of the data directory, or returns nil if there is no release in progress
+func Load(dataDir string) (*Journal, error) {
+	path := filepath.Join(dataDir, fileName)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the journal: %v", err)
+	}
+	var j Journal
+	if err := json.Unmarshal(data, &j); err != nil {
+		return nil, fmt.Errorf("failed to parse the journal '%s': %v", path, err)
+	}
+	j.path = path
+	return &j, nil
+}
+
+// Save writes the journal atomically (to a temporary file, then renamed), so a crash never leaves a partial journal
+func (j *Journal) Save() error {
+	j.UpdatedAt = time.Now()
+	if err := writeFile(j.path, j); err != nil {
+		return fmt.Errorf("failed to save the journal: %v", err)
+	}
+	return nil
+}
+
+// Remove deletes the journal, e.g. when the release ends
+func (j *Journal) Remove() error {
+	if err := os.Remove(j.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// writeFile writes v as JSON to the path atomically (to a temporary file, then renamed)
+func writeFile(path string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create the directory: %v", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op after the rename
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
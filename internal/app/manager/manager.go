@@ -1,13 +1,23 @@
 package manager
 
 import (
+	"context"
 	"fmt"
 	"github.com/paulmach/orb"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"strings"
+	"sync"
+	"time"
 	"umbilical-choir-core/internal/app/config"
 	FaaS "umbilical-choir-core/internal/app/faas"
+	Journal "umbilical-choir-core/internal/app/journal"
+	MetricAgg "umbilical-choir-core/internal/app/metric_aggregator"
 	Strategy "umbilical-choir-core/internal/app/strategy"
 	Tests "umbilical-choir-core/internal/app/tests"
+	Tracing "umbilical-choir-core/internal/app/tracing"
 )
 
 type Manager struct {
@@ -17,129 +27,436 @@ type Manager struct {
 	ServiceAreaPolygon orb.Polygon
 	ParentHost         string
 	ParentPort         string
+	DataDir            string                  // if set, the metrics of the running stage and the journal of the running release are persisted here
+	MaxStageDuration   time.Duration           // a stage still running after this is rolled back
+	Metrics            *MetricAgg.MetricServer // receives the metrics of the proxies of all the running stages
+
+	mutex     sync.Mutex         // guards inventory and running, and serializes Reconcile with the start of the stages
+	inventory *Journal.Inventory // the intended version of each released function, see Reconcile
+	running   map[string]bool    // the functions of the running release, skipped by Reconcile
 }
 
+// DefaultMaxStageDuration is the hard maximum duration of a stage, if not set in the config
+const DefaultMaxStageDuration = 24 * time.Hour
+
+// rollbackTimeout bounds the rollback of a cancelled stage, which can't use the release's (cancelled) context
+const rollbackTimeout = 5 * time.Minute
+
+// rollbacks counts the functions rolled back, by why: error, cancelled, guardrail, end_condition, rollback_required or end_action
+var rollbacks = promauto.NewCounterVec(prometheus.CounterOpts{Name: "uc_agent_rollbacks_total", Help: "Functions rolled back, by reason."}, []string{"function", "reason"})
+
 // New creates a new Manager instance
-func New(faas FaaS.FaaS, cfg *config.Config) *Manager {
+func New(faas FaaS.FaaS, cfg *config.Config) (*Manager, error) {
 	servArea, err := cfg.StrAreaToPolygon()
 	if err != nil {
-		log.Fatalf("Failed to parse service area: %v", err)
+		return nil, fmt.Errorf("failed to parse service area: %v", err)
+	}
+	maxStageDuration := DefaultMaxStageDuration
+	if cfg.Agent.MaxStageDuration != "" {
+		maxStageDuration, err = time.ParseDuration(cfg.Agent.MaxStageDuration)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse maxStageDuration: %v", err)
+		}
 	}
-	return &Manager{
+	metrics := MetricAgg.NewMetricServer(cfg.Agent.MetricAddr)
+	metrics.RequireSignature = cfg.Agent.MetricAuth
+	metrics.CertFile, metrics.KeyFile = cfg.Agent.MetricTLSCert, cfg.Agent.MetricTLSKey
+	metrics.PrometheusAddr = cfg.Agent.PrometheusAddr
+	if err := metrics.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start the metric server: %v", err)
+	}
+	m := &Manager{
+		Metrics:            metrics,
 		FaaS:               faas,
 		Host:               cfg.Agent.Host,
 		ServiceAreaPolygon: servArea,
 		ParentHost:         cfg.Parent.Host,
 		ParentPort:         cfg.Parent.Port,
+		DataDir:            cfg.Agent.DataDir,
+		MaxStageDuration:   maxStageDuration,
+	}
+	m.inventory, err = Journal.LoadInventory(cfg.Agent.DataDir)
+	if err != nil {
+		log.Errorf("%v. Starting with an empty inventory", err)
 	}
+	return m, nil
 }
 
-// RunReleaseStrategy executes the given release strategy
-func (m *Manager) RunReleaseStrategy(strategy *Strategy.ReleaseStrategy) {
+// Close stops the metric server
+func (m *Manager) Close() error {
+	return m.Metrics.Close()
+}
+
+// RunReleaseStrategy executes the given release strategy as a state machine.
+// It starts with the first stage, and follows the end actions: a stage name jumps to that stage, and a rollout/rollback ends the release.
+// If the context is cancelled (or a stage runs longer than MaxStageDuration, or stops with an error), the running stage is rolled back and the release stops
+func (m *Manager) RunReleaseStrategy(ctx context.Context, strategy *Strategy.ReleaseStrategy) {
+	if len(strategy.Stages) == 0 {
+		log.Warnf("Release strategy '%s' has no stages", strategy.Name)
+		return
+	}
+	ctx = Tracing.WithAttributes(ctx, Tracing.ReleaseID.String(strategy.ID))
+	ctx, span := Tracing.Start(ctx, "RunReleaseStrategy", attribute.String("uc.release.name", strategy.Name))
+	defer span.End()
+	m.runStages(ctx, strategy, &strategy.Stages[0], 0, make(map[string]map[string]string))
+}
+
+// ResumeRelease resumes the release of a journal left by a previous run of the agent (e.g. crashed mid-stage), from its running stage
+// (and step, of a Gradual stage).
+// If the release can't be resumed (e.g. its strategy is gone), the running stage is rolled back and reported to the parent as an Error
+func (m *Manager) ResumeRelease(ctx context.Context, j *Journal.Journal) {
+	if m.ID == "" {
+		m.ID = j.AgentID
+	}
+	ctx = Tracing.WithAttributes(ctx, Tracing.ReleaseID.String(j.ReleaseID))
+	ctx, span := Tracing.Start(ctx, "ResumeRelease", Tracing.Stage.String(j.Stage))
+	defer span.End()
+	strategy, err := Strategy.LoadStrategy(j.StrategyPath)
+	var stage *Strategy.Stage
+	if err == nil {
+		stage, err = strategy.GetStageByName(j.Stage)
+	}
+	if err != nil {
+		log.Errorf("Can't resume release '%s' from stage '%s': %v. Rolling it back", j.ReleaseID, j.Stage, err)
+		m.rollbackJournal(ctx, j)
+		return
+	}
+	fromStep := j.Step
+	if stage.Type != "Gradual" || fromStep < 0 || fromStep >= len(stage.Steps) {
+		fromStep = 0
+	}
+	log.Infof("Resuming release '%s' (%s) from stage '%s' (step %d)", strategy.Name, j.ReleaseID, j.Stage, fromStep+1)
+	deployments := j.Deployments
+	if deployments == nil {
+		deployments = make(map[string]map[string]string)
+	}
+	m.runStages(ctx, strategy, stage, fromStep, deployments)
+}
+
+// runStages runs the stages of a strategy as a state machine, starting with the given stage (from the given step, if it is Gradual)
+func (m *Manager) runStages(ctx context.Context, strategy *Strategy.ReleaseStrategy, stage *Strategy.Stage, fromStep int, deployments map[string]map[string]string) {
 	agentHost := m.Host
-	usePrevFuncDeployments := false
-	prevF1Uri := ""
-	prevF2Uri := ""
-	for _, stage := range strategy.Stages {
+	// deployments are the URIs of the test functions kept deployed between stages: function name -> version name -> URI
+	journal := m.newJournal(strategy)
+	defer removeJournal(journal) // the release ended, or stopped with an error. NOTE: not on a crash
+	var functions []string       // of this release
+	defer func() { m.markRunning(false, functions...) }()
+	for stage != nil {
 		log.Infof("'%s': starting a '%s' stage for '%s' function", stage.Name, stage.Type, stage.FuncName)
-		var nextStage *Strategy.Stage = nil
-		var nextStageName = ""
+		ctx := Tracing.WithAttributes(ctx, Tracing.Stage.String(stage.Name), Tracing.Function.String(stage.FuncName)) // the spans of the stage
 		fMeta, err := strategy.GetFunctionByName(stage.FuncName)
 		if err != nil {
-			log.Fatalf("Error getting function: %v", err)
+			m.failStage(ctx, strategy, stage.Name, nil, MetricAgg.Error, err, Journal.Rollback{}) // nothing of it is deployed
+			return
 		}
 		rollbackFuncVer, err := fMeta.GetVersionByName(strategy.Rollback.Action.Function)
 		if err != nil {
-			log.Fatalf("Error getting rollback function: %v", err)
+			m.failStage(ctx, strategy, stage.Name, nil, MetricAgg.Error, err, Journal.Rollback{})
+			return
+		}
+		prevDeployments := deployments[stage.FuncName]
+		if len(prevDeployments) > 0 {
+			log.Infof("re-using the function deployments of the previous stages: %v", prevDeployments)
 		}
+		functions = append(functions, fMeta.Name)
+		m.markRunning(true, fMeta.Name)
+		saveJournal(journal, stage, fromStep, fMeta, rollbackFuncVer, deployments)
+		m.remember(stageRollback(fMeta, rollbackFuncVer)) // restored to its rollback version, if the agent crashes mid-stage
 
+		store := m.openMetricStore(strategy.ID, stage.Name)
+
+		stageCtx, cancelStage := context.WithTimeout(ctx, m.MaxStageDuration)
+		stageCtx, testSpan := Tracing.Start(stageCtx, "Test", Tracing.StageType.String(stage.Type))
+		var testMeta *Tests.TestMeta
+		var agg *MetricAgg.MetricAggregator
 		switch stage.Type {
 		case "A/B":
-			testMeta, agg, err := Tests.ReleaseTest(stage, fMeta, usePrevFuncDeployments,
-				prevF1Uri, prevF2Uri, agentHost, m.FaaS)
-			if err != nil {
-				log.Errorf("Error in ReleaseTest for '%s' function: %v", stage.FuncName, err)
-				return
-			}
-
-			// Summarize metrics
-			fmt.Printf(agg.SummarizeString())
-			summary := agg.SummarizeResult()
-
-			// Process the results of the release test, and set the summary.Status
-			success, rollbackRequired := Tests.ProcessStageResult(stage, summary) // TODO if rollbackRequired, then break? what to report to parent?
-
-			log.Infof("Running after test instructions. Checking if rollback is required...")
-			nextStage, err = m.handleAfterTestInstructions(stage, testMeta, fMeta, strategy, agg, rollbackRequired, success, rollbackFuncVer)
-			if err != nil {
-				log.Errorf("Failed to handle after test instructions: %v", err)
-				return
+			testMeta, agg, err = Tests.ReleaseTest(stageCtx, *stage, fMeta, prevDeployments, store, m.Metrics,
+				strategy.ID, agentHost, m.FaaS)
+		case "WaitForSignal":
+			// TODO: combine with normal releasetest. The only difference is the polling for signal + extera parameters needed
+			testMeta, agg, err = Tests.ReleaseTestWithSignal(stageCtx, *stage, fMeta, prevDeployments, store, m.Metrics,
+				agentHost, m.FaaS, strategy.ID, m.ParentHost, m.ParentPort, m.ID)
+		case "Canary":
+			testMeta, agg, err = Tests.CanaryTest(stageCtx, *stage, fMeta, prevDeployments, store, m.Metrics,
+				strategy.ID, agentHost, m.FaaS)
+		case "Gradual":
+			testMeta, agg, err = Tests.GradualTest(stageCtx, *stage, fMeta, prevDeployments, store, m.Metrics,
+				strategy.ID, agentHost, m.FaaS, fromStep, func(step int) { saveJournalStep(journal, step) })
+		default: // NOTE: stage types are validated when loading the strategy
+			testSpan.End()
+			cancelStage()
+			log.Errorf("Unknown stage type: %s. Stopping the release", stage.Type)
+			return
+		}
+		stageErr := stageCtx.Err()
+		Tracing.End(testSpan, err)
+		cancelStage()
+		if err != nil { // cancelled, ran out of time, or failed (e.g. Tests.ErrDeployFailed)
+			status := MetricAgg.Error
+			switch {
+			case stageErr != nil && ctx.Err() != nil:
+				status = MetricAgg.Cancelled
+				log.Warnf("Release '%s' was cancelled during '%s'. Rolling it back", strategy.Name, stage.Name)
+			case stageErr != nil:
+				err = fmt.Errorf("still running after the maximum stage duration (%v)", m.MaxStageDuration)
+				log.Errorf("'%s' is %v. Rolling it back", stage.Name, err)
+			default:
+				log.Errorf("Error in '%s' stage test for '%s' function: %v. Rolling it back", stage.Type, stage.FuncName, err)
 			}
+			m.failStage(ctx, strategy, stage.Name, agg, status, err, stageRollback(fMeta, rollbackFuncVer))
+			closeMetricStore(store, true)
+			return
+		}
 
-			log.Infof("f1 response time: Min %vms, Max %vms", summary.F1TimesSummary.Minimum, summary.F1TimesSummary.Maximum)
-			log.Infof("f2 response time: Min %vms, Max %vms", summary.F2TimesSummary.Minimum, summary.F2TimesSummary.Maximum)
+		// the test is over: its end action runs to the end, even if the release is cancelled meanwhile
+		concludeCtx, cancelConclude := context.WithTimeout(context.WithoutCancel(ctx), rollbackTimeout)
+		nextStage, err := m.concludeStage(concludeCtx, *stage, testMeta, agg, fMeta, strategy, rollbackFuncVer)
+		cancelConclude()
+		if err != nil {
+			log.Errorf("Failed to handle after test instructions: %v. Rolling it back", err)
+			m.failStage(ctx, strategy, stage.Name, agg, MetricAgg.Error, err, stageRollback(fMeta, rollbackFuncVer))
+			closeMetricStore(store, true)
+			return
+		}
+		// the stage result is sent, its metrics are no longer needed
+		closeMetricStore(store, true)
 
-			// Send result summary to parent
-			if nextStage != nil {
-				nextStageName = nextStage.Name
+		if nextStage == nil { // rolled out or back, the test functions are cleaned up
+			delete(deployments, stage.FuncName)
+			if released := testMeta.Released; released != nil {
+				m.remember(Journal.Rollback{FuncName: fMeta.Name, Path: released.Path, Env: released.Env, TestFunctions: Tests.DeployNames(fMeta)})
 			}
-			err = summary.SendResultSummary(strategy.ID, nextStageName, m.ID, m.ParentHost, m.ParentPort)
-			if err != nil {
-				log.Errorf("Failed to send result summary: %v", err)
+		} else { // the test functions stay deployed for the next stage
+			if deployments[stage.FuncName] == nil {
+				deployments[stage.FuncName] = make(map[string]string)
 			}
-			if success { // memorize the current version for the next stage
-				prevF1Uri = testMeta.AVersionURI
-				prevF2Uri = testMeta.BVersionURI
+			for version, uri := range testMeta.DeployedURIs() {
+				deployments[stage.FuncName][version] = uri
 			}
+			log.Infof("'%s' ended. Jumping to the next stage '%s'", stage.Name, nextStage.Name)
+		}
+		stage, fromStep = nextStage, 0
+	}
+	log.Info("Release strategy completed")
+}
 
-		case "WaitForSignal":
-			// TODO: combine with normal releasetest. The only difference is the polling for signal + extera parameters needed
-			testMeta, agg, err := Tests.ReleaseTestWithSignal(stage, fMeta, usePrevFuncDeployments,
-				prevF1Uri, prevF2Uri, agentHost, m.FaaS, strategy.ID, m.ParentHost, m.ParentPort, m.ID)
-			if err != nil {
-				log.Errorf("Error in ReleaseTestWithSignal for '%s' function: %v", stage.FuncName, err)
-				return
-			}
+// concludeStage summarizes the metrics of a finished stage test, runs the after test instructions and reports the result to the parent
+func (m *Manager) concludeStage(ctx context.Context, stage Strategy.Stage, testMeta *Tests.TestMeta, agg *MetricAgg.MetricAggregator, fMeta *Strategy.Function, strategy *Strategy.ReleaseStrategy, rollbackFuncVer *Strategy.Version) (*Strategy.Stage, error) {
+	// Summarize metrics
+	log.Info(agg.SummarizeString())
+	summary := agg.SummarizeResult()
 
-			// Summarize metrics
-			fmt.Printf(agg.SummarizeString())
-			summary := agg.SummarizeResult()
+	// a violated guardrail rolls back immediately, regardless of the end action
+	if testMeta.GuardrailViolation != "" {
+		log.Warnf("'%s' violated a guardrail (%s). Rolling back...", stage.Name, testMeta.GuardrailViolation)
+		if err := testMeta.ReplaceChosenFunction(ctx, *rollbackFuncVer); err != nil {
+			return nil, err
+		}
+		rollbacks.WithLabelValues(fMeta.Name, "guardrail").Inc()
+		summary.Status = MetricAgg.GuardrailViolated
+		err := summary.SendResultSummary(ctx, strategy.ID, "", m.ID, m.ParentHost, m.ParentPort)
+		if err != nil {
+			log.Errorf("Failed to send result summary: %v", err)
+		}
+		return nil, nil
+	}
 
-			// Process the results of the release test, and set the summary.Status
-			success, rollbackRequired := Tests.ProcessStageResult(stage, summary)
+	// a test which reached a limit (maxDuration or maxIdle) is concluded by the limit's outcome
+	summary.EndReason = testMeta.EndReason
+	switch testMeta.EndOutcome {
+	case Strategy.OutcomeRollback:
+		log.Warnf("'%s' ended early (%s). Rolling back...", stage.Name, testMeta.EndReason)
+		if err := testMeta.ReplaceChosenFunction(ctx, *rollbackFuncVer); err != nil {
+			return nil, err
+		}
+		rollbacks.WithLabelValues(fMeta.Name, "end_condition").Inc()
+		summary.Status = MetricAgg.Failure
+		err := summary.SendResultSummary(ctx, strategy.ID, "", m.ID, m.ParentHost, m.ParentPort)
+		if err != nil {
+			log.Errorf("Failed to send result summary: %v", err)
+		}
+		return nil, nil
+	case Strategy.OutcomeFail:
+		testMeta.Aborted = true // fails by the end action below
+	}
 
-			log.Infof("Running after test instructions. Checking if rollback is required...")
-			nextStage, err = m.handleAfterTestInstructions(stage, testMeta, fMeta, strategy, agg, rollbackRequired, success, rollbackFuncVer)
-			if err != nil {
-				log.Errorf("Failed to handle after test instructions: %v", err)
-				return
-			}
+	// Process the results of the release test, and set the summary.Status
+	verdictStage := stage
+	if stage.Type == "Gradual" { // judged by the metric gate of the last run step
+		verdictStage = stage.AtStep(testMeta.Step)
+	}
+	success, rollbackRequired := Tests.ProcessStageResult(verdictStage, summary) // TODO if rollbackRequired, then break? what to report to parent?
+	// an aborted test fails, even if e.g. the last few calls brought the canary back within the thresholds
+	if testMeta.Aborted && success {
+		log.Warnf("'%s' was aborted during the test. Considering it as failed", stage.Name)
+		success = false
+		summary.Status = MetricAgg.Failure
+	}
+	testMeta.Winner = summary.Winner
 
-			log.Infof("f1 response time: Min %vms, Max %vms", summary.F1TimesSummary.Minimum, summary.F1TimesSummary.Maximum)
-			log.Infof("f2 response time: Min %vms, Max %vms", summary.F2TimesSummary.Minimum, summary.F2TimesSummary.Maximum)
+	log.Infof("Running after test instructions. Checking if rollback is required...")
+	nextStage, err := m.handleAfterTestInstructions(ctx, stage, testMeta, fMeta, strategy, agg, rollbackRequired, success, rollbackFuncVer)
+	if err != nil {
+		return nil, err
+	}
 
-			// Send result summary to parent
-			if nextStage != nil {
-				nextStageName = nextStage.Name
-			}
-			err = summary.SendResultSummary(strategy.ID, nextStageName, m.ID, m.ParentHost, m.ParentPort)
-			if err != nil {
-				log.Errorf("Failed to send result summary: %v", err)
-			}
-			if success { // memorize the current version for the next stage
-				prevF1Uri = testMeta.AVersionURI
-				prevF2Uri = testMeta.BVersionURI
-			}
+	for i, variant := range summary.Variants {
+		log.Infof("f%d (%s) response time: Min %vms, Max %vms, P95 %vms, P99 %vms", i+1, variant.Name,
+			variant.TimesSummary.Minimum, variant.TimesSummary.Maximum, variant.TimesSummary.P95, variant.TimesSummary.P99)
+	}
+
+	// Send result summary to parent
+	nextStageName := ""
+	if nextStage != nil {
+		nextStageName = nextStage.Name
+	}
+	err = summary.SendResultSummary(ctx, strategy.ID, nextStageName, m.ID, m.ParentHost, m.ParentPort)
+	if err != nil {
+		log.Errorf("Failed to send result summary: %v", err)
+	}
+	return nextStage, nil
+}
 
-		default:
-			log.Warnf("Unknown stage type: %s. Ignoring it", stage.Type)
+// openMetricStore opens the store of the stage's metrics, or returns nil if the metrics are not persisted (no DataDir)
+func (m *Manager) openMetricStore(releaseID, stageName string) *MetricAgg.Store {
+	if m.DataDir == "" {
+		return nil
+	}
+	store, err := MetricAgg.OpenStore(m.DataDir, releaseID, stageName)
+	if err != nil {
+		log.Errorf("%v. The metrics of '%s' won't be persisted", err, stageName)
+		return nil
+	}
+	return store
+}
+
+// closeMetricStore closes the store of a stage's metrics, and deletes it if the stage is done
+func closeMetricStore(store *MetricAgg.Store, done bool) {
+	if store == nil {
+		return
+	}
+	var err error
+	if done {
+		err = store.Remove()
+	} else {
+		err = store.Close()
+	}
+	if err != nil {
+		log.Warnf("Failed to close the metric store '%s': %v", store.Path, err)
+	}
+}
+
+// newJournal creates the journal of a release, or returns nil if it is not persisted (no DataDir)
+func (m *Manager) newJournal(strategy *Strategy.ReleaseStrategy) *Journal.Journal {
+	if m.DataDir == "" {
+		return nil
+	}
+	j := Journal.New(m.DataDir)
+	j.AgentID = m.ID
+	j.ReleaseID = strategy.ID
+	j.StrategyPath = strategy.Path
+	return j
+}
+
+// saveJournal records the stage (and step) which is about to run, and what is needed to resume it or roll it back
+func saveJournal(j *Journal.Journal, stage *Strategy.Stage, step int, fMeta *Strategy.Function, rollbackFuncVer *Strategy.Version, deployments map[string]map[string]string) {
+	if j == nil {
+		return
+	}
+	j.Stage = stage.Name
+	j.Step = step
+	j.Deployments = deployments
+	j.Rollback = stageRollback(fMeta, rollbackFuncVer)
+	if err := j.Save(); err != nil {
+		log.Errorf("%v. '%s' can't be resumed after a restart", err, stage.Name)
+	}
+}
+
+// saveJournalStep records the step of the running Gradual stage which is about to run
+func saveJournalStep(j *Journal.Journal, step int) {
+	if j == nil {
+		return
+	}
+	j.Step = step
+	if err := j.Save(); err != nil {
+		log.Errorf("%v. Step %d of '%s' can't be resumed after a restart", err, step+1, j.Stage)
+	}
+}
+
+func removeJournal(j *Journal.Journal) {
+	if j == nil {
+		return
+	}
+	if err := j.Remove(); err != nil {
+		log.Warnf("Failed to remove the journal: %v", err)
+	}
+}
+
+// stageRollback describes how to roll back a stage of the function: its rollback version, and its test functions to clean up
+func stageRollback(fMeta *Strategy.Function, rollbackFuncVer *Strategy.Version) Journal.Rollback {
+	return Journal.Rollback{
+		FuncName:      fMeta.Name,
+		Path:          rollbackFuncVer.Path,
+		Env:           rollbackFuncVer.Env,
+		TestFunctions: Tests.DeployNames(fMeta),
+	}
+}
+
+// failStage rolls back a stage which stopped before its end action (see rollback), and reports it to the parent with the given status.
+// The reported summary has the metrics of the stage so far (if any), and the error that stopped it as its EndReason
+func (m *Manager) failStage(ctx context.Context, strategy *Strategy.ReleaseStrategy, stageName string, agg *MetricAgg.MetricAggregator, status MetricAgg.StageStatus, err error, rollback Journal.Rollback) {
+	summary := &MetricAgg.ResultSummary{StageName: stageName}
+	if agg != nil {
+		summary = agg.SummarizeResult()
+	}
+	summary.Status = status
+	if err != nil && status == MetricAgg.Error {
+		summary.EndReason = err.Error()
+	}
+	m.rollback(ctx, strategy.ID, summary, rollback)
+}
+
+// FailRelease reports a release which could not be started (e.g. its strategy failed to download or validate) to the parent as an Error,
+// with no stage name and the error as its EndReason. Nothing of it was deployed, so nothing is rolled back
+func (m *Manager) FailRelease(ctx context.Context, releaseID string, err error) {
+	summary := &MetricAgg.ResultSummary{Status: MetricAgg.Error, EndReason: err.Error()}
+	if errS := summary.SendResultSummary(ctx, releaseID, "", m.ID, m.ParentHost, m.ParentPort); errS != nil {
+		log.Errorf("Failed to send result summary: %v", errS)
+	}
+}
+
+// rollbackJournal rolls back the running stage of a journal, cleans up its test functions, and reports it to the parent as an Error
+func (m *Manager) rollbackJournal(ctx context.Context, j *Journal.Journal) {
+	defer removeJournal(j)
+	summary := &MetricAgg.ResultSummary{StageName: j.Stage, Status: MetricAgg.Error}
+	m.rollback(ctx, j.ReleaseID, summary, j.Rollback)
+}
+
+// rollback replaces the function with its rollback version, cleans up its test functions, and reports the summary to the parent.
+// It runs even if the context is cancelled (e.g. the release was), bounded by rollbackTimeout
+func (m *Manager) rollback(ctx context.Context, releaseID string, summary *MetricAgg.ResultSummary, rollback Journal.Rollback) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), rollbackTimeout)
+	defer cancel()
+	ctx, span := Tracing.Start(ctx, "Rollback", attribute.String("uc.status", summary.Status.String()))
+	defer span.End()
+	if rollback.FuncName != "" {
+		m.remember(rollback)
+		log.Infof("(rollback) Replacing '%s' with its rollback version...", rollback.FuncName)
+		rollbacks.WithLabelValues(rollback.FuncName, strings.ToLower(summary.Status.String())).Inc() // error or cancelled
+		_, err := m.FaaS.Update(ctx, rollback.FuncName, rollback.Path, rollback.Env, "http", true, []string{})
+		if err != nil {
+			log.Errorf("error replacing proxy function with %s's rollback version: %v", rollback.FuncName, err)
 		}
-		if nextStage != nil {
-			log.Warnf("nextStage should be: %v", nextStage) // TODO: support specifying a specific stage to jump to
+		for _, name := range rollback.TestFunctions {
+			if exists, err := m.FaaS.FunctionExists(ctx, name); err == nil && exists {
+				if err := m.FaaS.Delete(ctx, name); err != nil {
+					log.Errorf("Error cleaning up function %v: %v", name, err)
+				}
+			}
 		}
-		log.Warn("running the next stage in the list if any (and not nextStage)")
-		usePrevFuncDeployments = true // TODO: for more than 2 versions we need different versions to be deployed even in case of a success
-		log.Warnf("keeping the prev function deployments for next stage (if was success): f1: '%s', f2: '%s'", prevF1Uri, prevF2Uri)
 	}
-	log.Info("Release strategy completed")
+	if err := summary.SendResultSummary(ctx, releaseID, "", m.ID, m.ParentHost, m.ParentPort); err != nil {
+		log.Errorf("Failed to send result summary: %v", err)
+	}
 }
@@ -0,0 +1,581 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	FaaS "umbilical-choir-core/internal/app/faas"
+	"umbilical-choir-core/internal/app/fakeparent"
+	Journal "umbilical-choir-core/internal/app/journal"
+	MetricAgg "umbilical-choir-core/internal/app/metric_aggregator"
+	Strategy "umbilical-choir-core/internal/app/strategy"
+	Tracing "umbilical-choir-core/internal/app/tracing"
+)
+
+func TestMain(m *testing.M) {
+	log.SetLevel(log.WarnLevel)
+	os.Exit(m.Run())
+}
+
+// testRelease runs a release strategy of the 'sieve' function on a mock FaaS, reporting to a fake parent
+type testRelease struct {
+	manager *Manager
+	mock    *FaaS.MockAdapter
+	parent  *fakeparent.Server
+}
+
+func newTestRelease(t *testing.T) *testRelease {
+	t.Helper()
+	mock, err := FaaS.NewMockAdapter("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mock.Close() })
+	parent := fakeparent.New()
+	t.Cleanup(parent.Close)
+	metrics := MetricAgg.NewMetricServer("127.0.0.1:0")
+	if err := metrics.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { metrics.Close() })
+
+	// the released function, before the release
+	if _, err := mock.Upload(context.Background(), "sieve", "fns/base", "nodejs", "http", true, nil); err != nil {
+		t.Fatal(err)
+	}
+	return &testRelease{
+		manager: &Manager{
+			ID:               "agent-1",
+			FaaS:             FaaS.Instrument(mock),
+			Host:             "127.0.0.1",
+			ParentHost:       parent.Host,
+			ParentPort:       parent.Port,
+			MaxStageDuration: time.Minute,
+			Metrics:          metrics,
+		},
+		mock:   mock,
+		parent: parent,
+	}
+}
+
+// run runs the stages (yaml) of a strategy while calling the function, and returns the results the parent received
+// and the deployments of the release
+func (r *testRelease) run(t *testing.T, stages string) ([]MetricAgg.ResultRequest, []FaaS.MockDeployment) {
+	t.Helper()
+	strategy, err := Strategy.LoadStrategy(writeStrategy(t, stages))
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := len(r.mock.Deployments())
+	r.withLoad(func() { r.manager.RunReleaseStrategy(context.Background(), strategy) })
+	return r.parent.Results(), r.mock.Deployments()[before:]
+}
+
+// withLoad calls the function (the proxy, during a stage) while running f
+func (r *testRelease) withLoad(f func()) {
+	ctx, stopLoad := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for ctx.Err() == nil {
+			r.mock.Call("sieve", "10")
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+	f()
+	stopLoad()
+	<-done
+}
+
+// writeStrategy writes a strategy of the given stages (yaml), and returns its path
+func writeStrategy(t *testing.T, stages string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "strategy.yml")
+	if err := os.WriteFile(path, []byte(strategyHeader+stages+strategyFooter), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+const strategyHeader = `
+id: "1"
+name: test-release
+type: minor
+functions:
+  - name: sieve
+    base_version:
+      path: fns/base
+      env: nodejs
+    new_version:
+      path: fns/new
+      env: nodejs
+stages:
+`
+
+const strategyFooter = `
+rollback:
+  action:
+    function: base_version
+`
+
+// checkResults checks the stage, status and next stage of each result the parent received
+func checkResults(t *testing.T, results []MetricAgg.ResultRequest, want ...MetricAgg.ResultRequest) {
+	t.Helper()
+	if len(results) != len(want) {
+		t.Fatalf("the parent received %d results, want %d: %+v", len(results), len(want), results)
+	}
+	for i, result := range results {
+		if result.ID != "agent-1" || result.ReleaseID != "1" || len(result.StageSummaries) != 1 {
+			t.Fatalf("result %d: unexpected agent '%s', release '%s' or %d summaries", i, result.ID, result.ReleaseID, len(result.StageSummaries))
+		}
+		summary, wanted := result.StageSummaries[0], want[i].StageSummaries[0]
+		if summary.StageName != wanted.StageName || summary.Status != wanted.Status || result.NextStage != want[i].NextStage {
+			t.Errorf("result %d: got stage '%s' %v (next '%s'), want '%s' %v (next '%s')", i,
+				summary.StageName, summary.Status, result.NextStage, wanted.StageName, wanted.Status, want[i].NextStage)
+		}
+	}
+}
+
+func result(stageName string, status MetricAgg.StageStatus, nextStage string) MetricAgg.ResultRequest {
+	return MetricAgg.ResultRequest{StageSummaries: []MetricAgg.ResultSummary{{StageName: stageName, Status: status}}, NextStage: nextStage}
+}
+
+func checkDeployments(t *testing.T, deployments []FaaS.MockDeployment, want []FaaS.MockDeployment) {
+	t.Helper()
+	if !reflect.DeepEqual(deployments, want) {
+		t.Errorf("got deployments\n%+v\nwant\n%+v", deployments, want)
+	}
+}
+
+// checkReleased checks the version the function was left with, and that its test functions are cleaned up
+func (r *testRelease) checkReleased(t *testing.T, path string) {
+	t.Helper()
+	if got := r.mock.Path("sieve"); got != path {
+		t.Errorf("'sieve' is deployed from '%s', want '%s'", got, path)
+	}
+	for _, name := range []string{"sieve01", "sieve02"} {
+		if got := r.mock.Path(name); got != "" {
+			t.Errorf("test function '%s' is still deployed from '%s'", name, got)
+		}
+	}
+}
+
+func TestRunReleaseStrategyRollsOut(t *testing.T) {
+	r := newTestRelease(t)
+	results, deployments := r.run(t, `
+  - name: ab
+    type: A/B
+    func_name: sieve
+    variants:
+      - name: base_version
+        trafficPercentage: 50
+      - name: new_version
+        trafficPercentage: 50
+    metrics_conditions:
+      - name: errorRate
+        threshold: "<0.1"
+    end_conditions:
+      - name: minDuration
+        threshold: 1s
+      - name: minCalls
+        threshold: "20"
+    end_action:
+      onSuccess: canary
+      onFailure: rollback
+  - name: canary
+    type: Canary
+    func_name: sieve
+    trafficPercentage: 20
+    metrics_conditions:
+      - name: errorRate
+        threshold: "<0.1"
+    end_conditions:
+      - name: minDuration
+        threshold: 1s
+      - name: minCalls
+        threshold: "20"
+    end_action:
+      onSuccess: rollout
+      onFailure: rollback
+`)
+
+	checkResults(t, results,
+		result("ab", MetricAgg.Completed, "canary"),
+		result("canary", MetricAgg.Completed, ""))
+	for _, result := range results {
+		if calls := result.StageSummaries[0].Variants[1].Calls; calls == 0 {
+			t.Errorf("'%s': no calls of new_version were reported", result.StageSummaries[0].StageName)
+		}
+	}
+	checkDeployments(t, deployments, []FaaS.MockDeployment{
+		{Operation: "upload", FuncName: "sieve01", Path: "fns/base"},
+		{Operation: "upload", FuncName: "sieve02", Path: "fns/new"},
+		{Operation: "update", FuncName: "sieve", Path: FaaS.MockProxy},
+		{Operation: "update", FuncName: "sieve", Path: FaaS.MockProxy}, // the canary split. the test functions are re-used
+		{Operation: "update", FuncName: "sieve", Path: "fns/new"},
+		{Operation: "delete", FuncName: "sieve01"},
+		{Operation: "delete", FuncName: "sieve02"},
+	})
+	r.checkReleased(t, "fns/new")
+}
+
+func TestRunReleaseStrategyRollsBackFailingCandidate(t *testing.T) {
+	r := newTestRelease(t)
+	r.mock.SetBehavior("fns/new", FaaS.MockBehavior{ErrorRate: 1})
+	results, deployments := r.run(t, `
+  - name: ab
+    type: A/B
+    func_name: sieve
+    variants:
+      - name: base_version
+        trafficPercentage: 50
+      - name: new_version
+        trafficPercentage: 50
+    metrics_conditions:
+      - name: errorRate
+        threshold: "<0.1"
+    end_conditions:
+      - name: minDuration
+        threshold: 1s
+      - name: minCalls
+        threshold: "20"
+    end_action:
+      onSuccess: rollout
+      onFailure: rollback
+`)
+
+	checkResults(t, results, result("ab", MetricAgg.Failure, ""))
+	if errRate := results[0].StageSummaries[0].Variants[1].ErrRate; errRate != 1 {
+		t.Errorf("new_version's error rate is %v, want 1", errRate)
+	}
+	checkDeployments(t, deployments, []FaaS.MockDeployment{
+		{Operation: "upload", FuncName: "sieve01", Path: "fns/base"},
+		{Operation: "upload", FuncName: "sieve02", Path: "fns/new"},
+		{Operation: "update", FuncName: "sieve", Path: FaaS.MockProxy},
+		{Operation: "update", FuncName: "sieve", Path: "fns/base"},
+		{Operation: "delete", FuncName: "sieve01"},
+		{Operation: "delete", FuncName: "sieve02"},
+	})
+	r.checkReleased(t, "fns/base")
+}
+
+func TestRunReleaseStrategyFailedRolloutRollsBack(t *testing.T) {
+	r := newTestRelease(t)
+	r.mock.SetBehavior("fns/new", FaaS.MockBehavior{UpdateErr: errors.New("registry unavailable")})
+	results, deployments := r.run(t, `
+  - name: ab
+    type: A/B
+    func_name: sieve
+    variants:
+      - name: base_version
+        trafficPercentage: 50
+      - name: new_version
+        trafficPercentage: 50
+    metrics_conditions:
+      - name: errorRate
+        threshold: "<0.1"
+    end_conditions:
+      - name: minDuration
+        threshold: 1s
+      - name: minCalls
+        threshold: "20"
+    end_action:
+      onSuccess: rollout
+      onFailure: rollback
+`)
+
+	checkResults(t, results, result("ab", MetricAgg.Error, ""))
+	if endReason := results[0].StageSummaries[0].EndReason; !strings.Contains(endReason, "registry unavailable") {
+		t.Errorf("got end reason %q, want the failed rollout", endReason)
+	}
+	checkDeployments(t, deployments, []FaaS.MockDeployment{ // the failed rollout is not deployed, and the test functions are kept for the rollback
+		{Operation: "upload", FuncName: "sieve01", Path: "fns/base"},
+		{Operation: "upload", FuncName: "sieve02", Path: "fns/new"},
+		{Operation: "update", FuncName: "sieve", Path: FaaS.MockProxy},
+		{Operation: "update", FuncName: "sieve", Path: "fns/base"},
+		{Operation: "delete", FuncName: "sieve01"},
+		{Operation: "delete", FuncName: "sieve02"},
+	})
+	r.checkReleased(t, "fns/base")
+}
+
+func TestRunReleaseStrategyGuardrailAborts(t *testing.T) {
+	r := newTestRelease(t)
+	r.mock.SetBehavior("fns/new", FaaS.MockBehavior{ErrorRate: 1})
+	beginning := time.Now()
+	results, deployments := r.run(t, `
+  - name: ab
+    type: A/B
+    func_name: sieve
+    variants:
+      - name: base_version
+        trafficPercentage: 50
+      - name: new_version
+        trafficPercentage: 50
+    guardrails:
+      - name: errorRate
+        threshold: ">0.5"
+        window: 10s
+    metrics_conditions:
+      - name: errorRate
+        threshold: "<0.1"
+    end_conditions:
+      - name: minDuration
+        threshold: 30s
+      - name: minCalls
+        threshold: "20"
+    end_action:
+      onSuccess: rollout
+      onFailure: rollout
+`)
+
+	if elapse := time.Since(beginning); elapse > 20*time.Second {
+		t.Errorf("the guardrail aborted the stage after %v, want before its minDuration", elapse)
+	}
+	checkResults(t, results, result("ab", MetricAgg.GuardrailViolated, ""))
+	checkDeployments(t, deployments, []FaaS.MockDeployment{ // rolled back, regardless of the end action
+		{Operation: "upload", FuncName: "sieve01", Path: "fns/base"},
+		{Operation: "upload", FuncName: "sieve02", Path: "fns/new"},
+		{Operation: "update", FuncName: "sieve", Path: FaaS.MockProxy},
+		{Operation: "update", FuncName: "sieve", Path: "fns/base"},
+		{Operation: "delete", FuncName: "sieve01"},
+		{Operation: "delete", FuncName: "sieve02"},
+	})
+	r.checkReleased(t, "fns/base")
+}
+
+func TestRunReleaseStrategyStatisticalCanary(t *testing.T) {
+	r := newTestRelease(t)
+	for _, path := range []string{"fns/base", "fns/new"} { // a healthy canary, as fast as the base version
+		r.mock.SetBehavior(path, FaaS.MockBehavior{Latency: 10 * time.Millisecond})
+	}
+	results, _ := r.run(t, `
+  - name: canary
+    type: Canary
+    func_name: sieve
+    trafficPercentage: 20
+    statistical_test:
+      confidence: 0.99
+      minSamples: 10
+    metrics_conditions:
+      - name: errorRate
+        threshold: "<0.1"
+    end_conditions:
+      - name: minDuration
+        threshold: 3s
+      - name: minCalls
+        threshold: "50"
+    end_action:
+      onSuccess: rollout
+      onFailure: rollback
+`)
+
+	// an InsufficientData verdict on the first polls doesn't abort the canary
+	checkResults(t, results, result("canary", MetricAgg.Completed, ""))
+	if sig := results[0].StageSummaries[0].Variants[1].Significance; sig == nil || sig.Verdict != MetricAgg.NoRegression {
+		t.Errorf("the canary's significance is %+v, want a %s verdict", sig, MetricAgg.NoRegression)
+	}
+	r.checkReleased(t, "fns/new")
+}
+
+func TestFailReleaseReportsError(t *testing.T) {
+	r := newTestRelease(t)
+	_, err := Strategy.LoadStrategy(writeStrategy(t, `
+  - name: ab
+    type: A/B
+    func_name: sieve
+    variants:
+      - name: base_version
+        trafficPercentage: 50
+      - name: new_version
+        trafficPercentage: 50
+    metrics_conditions:
+      - name: errorRate
+        threshold: "<0.1"
+    end_conditions:
+      - name: minDuration
+        threshold: 1s
+    end_action:
+      onSuccess: rollout
+      onFailure: ab
+`))
+	if err == nil || !strings.Contains(err.Error(), "loop") {
+		t.Fatalf("got error %v, want a loop", err)
+	}
+	r.manager.FailRelease(context.Background(), "1", err)
+
+	checkResults(t, r.parent.Results(), result("", MetricAgg.Error, ""))
+	if endReason := r.parent.Results()[0].StageSummaries[0].EndReason; endReason != err.Error() {
+		t.Errorf("got end reason %q, want %q", endReason, err.Error())
+	}
+	if deployments := r.mock.Deployments(); len(deployments) != 1 { // the released function only
+		t.Errorf("got deployments %+v, want none of the release", deployments)
+	}
+}
+
+func TestResumeReleaseFromGradualStep(t *testing.T) {
+	r := newTestRelease(t)
+	r.manager.DataDir = t.TempDir()
+	path := writeStrategy(t, `
+  - name: gradual
+    type: Gradual
+    func_name: sieve
+    steps:
+      - trafficPercentage: 20
+      - trafficPercentage: 50
+    metrics_conditions:
+      - name: errorRate
+        threshold: "<0.1"
+    end_conditions:
+      - name: minDuration
+        threshold: 1s
+      - name: minCalls
+        threshold: "20"
+    end_action:
+      onSuccess: rollout
+      onFailure: rollback
+`)
+	// the agent crashed right after journaling the second step, before the reset of the metrics of the first one
+	j := Journal.New(r.manager.DataDir)
+	j.AgentID, j.ReleaseID, j.StrategyPath, j.Stage, j.Step = "agent-1", "1", path, "gradual", 1
+	if err := j.Save(); err != nil {
+		t.Fatal(err)
+	}
+	store, err := MetricAgg.OpenStore(r.manager.DataDir, "1", "gradual")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Append(MetricAgg.MetricUpdatePayload{Metrics: []MetricAgg.Metric{{MetricName: "call_count", Value: 1000}, {MetricName: "f2_count", Value: 1000}}}, time.Now())
+	store.Close()
+
+	r.withLoad(func() { r.manager.ResumeRelease(context.Background(), j) })
+
+	results := r.parent.Results()
+	checkResults(t, results, result("gradual", MetricAgg.Completed, ""))
+	if calls := results[0].StageSummaries[0].Variants[1].Calls; calls == 0 || calls >= 1000 {
+		t.Errorf("new_version has %v calls, want the calls of the second step only", calls)
+	}
+	checkDeployments(t, r.mock.Deployments()[1:], []FaaS.MockDeployment{
+		{Operation: "upload", FuncName: "sieve01", Path: "fns/base"},
+		{Operation: "upload", FuncName: "sieve02", Path: "fns/new"},
+		{Operation: "update", FuncName: "sieve", Path: FaaS.MockProxy}, // only the split of the second step
+		{Operation: "update", FuncName: "sieve", Path: "fns/new"},
+		{Operation: "delete", FuncName: "sieve01"},
+		{Operation: "delete", FuncName: "sieve02"},
+	})
+	r.checkReleased(t, "fns/new")
+	if pending, err := Journal.Load(r.manager.DataDir); pending != nil || err != nil {
+		t.Errorf("the journal %+v (%v) was left after the release", pending, err)
+	}
+}
+
+func TestRunReleaseStrategySignedPushes(t *testing.T) {
+	r := newTestRelease(t)
+	if !r.manager.Metrics.RequireSignature { // the proxy signs its pushes with the stage's secret
+		t.Fatal("the metric server does not require signatures by default")
+	}
+	results, _ := r.run(t, `
+  - name: ab
+    type: A/B
+    func_name: sieve
+    variants:
+      - name: base_version
+        trafficPercentage: 50
+      - name: new_version
+        trafficPercentage: 50
+    metrics_conditions:
+      - name: errorRate
+        threshold: "<0.1"
+    end_conditions:
+      - name: minDuration
+        threshold: 1s
+      - name: minCalls
+        threshold: "20"
+    end_action:
+      onSuccess: rollout
+      onFailure: rollback
+`)
+
+	checkResults(t, results, result("ab", MetricAgg.Completed, ""))
+	if calls := results[0].StageSummaries[0].Variants[1].Calls; calls == 0 {
+		t.Error("no calls of new_version were accepted")
+	}
+	r.checkReleased(t, "fns/new")
+}
+
+func TestReleaseSpansNestUnderRelease(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+	r := newTestRelease(t)
+	strategy, err := Strategy.LoadStrategy(writeStrategy(t, `
+  - name: canary
+    type: Canary
+    func_name: sieve
+    trafficPercentage: 20
+    metrics_conditions:
+      - name: errorRate
+        threshold: "<0.1"
+    end_conditions:
+      - name: minCalls
+        threshold: "10"
+    end_action:
+      onSuccess: rollout
+      onFailure: rollback
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// as the agent runs a polled release
+	ctx := Tracing.WithAttributes(context.Background(), Tracing.ReleaseID.String("1"))
+	ctx, release := Tracing.Start(ctx, "Release")
+	r.withLoad(func() { r.manager.RunReleaseStrategy(ctx, strategy) })
+	Tracing.End(release, nil)
+
+	spans := map[trace.SpanID]sdktrace.ReadOnlySpan{}
+	names := map[string]int{}
+	for _, span := range recorder.Ended() {
+		spans[span.SpanContext().SpanID()] = span
+		names[span.Name()]++
+	}
+	if names["Release"] != 1 || names["RunReleaseStrategy"] != 1 || names["Test"] != 1 || names["FaaS.Upload"] == 0 || names["FaaS.Update"] == 0 {
+		t.Fatalf("recorded spans %v", names)
+	}
+	for _, span := range spans {
+		if span.Name() == "Release" {
+			continue
+		}
+		// every span descends from the release span, through the spans of the stage
+		var path []string
+		for parent, ok := spans[span.Parent().SpanID()]; ok; parent, ok = spans[parent.Parent().SpanID()] {
+			path = append(path, parent.Name())
+		}
+		if len(path) == 0 || path[len(path)-1] != "Release" || span.SpanContext().TraceID() != release.SpanContext().TraceID() {
+			t.Errorf("'%s' descends from %v, want the release span", span.Name(), path)
+		}
+		attributes := map[attribute.Key]string{}
+		for _, kv := range span.Attributes() {
+			attributes[kv.Key] = kv.Value.Emit()
+		}
+		if attributes[Tracing.ReleaseID] != "1" {
+			t.Errorf("'%s' has attributes %v, want the release ID", span.Name(), attributes)
+		}
+		if (span.Name() == "Test" || strings.HasPrefix(span.Name(), "FaaS.")) && attributes[Tracing.Stage] != "canary" {
+			t.Errorf("'%s' has attributes %v, want the stage", span.Name(), attributes)
+		}
+	}
+}
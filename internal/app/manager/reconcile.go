@@ -0,0 +1,117 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	Journal "umbilical-choir-core/internal/app/journal"
+)
+
+// Reconcile cleans up what the releases left behind on the FaaS, e.g. after a crash or a stage which failed halfway.
+// A function of the inventory whose test functions are still deployed was left mid-test (its proxy may still be deployed):
+// it is restored to its intended version, and its test functions are deleted.
+// The functions of the running release, and of a journal left to resume, are skipped. It returns the number of restored functions
+func (m *Manager) Reconcile(ctx context.Context) (int, error) {
+	m.mutex.Lock() // a stage can't start meanwhile
+	defer m.mutex.Unlock()
+	if m.inventory == nil || len(m.inventory.Functions) == 0 {
+		return 0, nil
+	}
+
+	skipped := make(map[string]bool)
+	for name := range m.running {
+		skipped[name] = true
+	}
+	if m.DataDir != "" {
+		if j, err := Journal.Load(m.DataDir); err == nil && j != nil {
+			skipped[j.Rollback.FuncName] = true // resumed (or rolled back) by ResumeRelease
+		}
+	}
+	deployed, listed := m.deployedFunctions(ctx)
+
+	restored := 0
+	var errs []error
+	for _, name := range m.inventory.Names() {
+		function := m.inventory.Functions[name]
+		if skipped[name] {
+			log.Debugf("(reconcile) '%s' is being released, skipping it", name)
+			continue
+		}
+		var leftovers []string
+		for _, testFunction := range function.TestFunctions {
+			exists := deployed[testFunction]
+			if !listed {
+				var err error
+				if exists, err = m.FaaS.FunctionExists(ctx, testFunction); err != nil {
+					errs = append(errs, err)
+					continue
+				}
+			}
+			if exists {
+				leftovers = append(leftovers, testFunction)
+			}
+		}
+		if len(leftovers) == 0 {
+			continue
+		}
+
+		log.Warnf("(reconcile) '%s' has test functions left behind: %v. Restoring it to '%s'", name, leftovers, function.Path)
+		if _, err := m.FaaS.Update(ctx, name, function.Path, function.Env, "http", true, []string{}); err != nil {
+			errs = append(errs, fmt.Errorf("failed to restore '%s': %v", name, err))
+			continue // its test functions may still be called by its proxy
+		}
+		for _, testFunction := range leftovers {
+			if err := m.FaaS.Delete(ctx, testFunction); err != nil {
+				errs = append(errs, fmt.Errorf("failed to delete '%s': %v", testFunction, err))
+			}
+		}
+		restored++
+	}
+	return restored, errors.Join(errs...)
+}
+
+// deployedFunctions returns the functions deployed on the FaaS as a set, and false if they can't be listed (e.g. GCP)
+func (m *Manager) deployedFunctions(ctx context.Context) (map[string]bool, bool) {
+	list, err := m.FaaS.Functions(ctx)
+	if err != nil {
+		log.Debugf("(reconcile) can't list the functions: %v. Checking them one by one", err)
+		return nil, false
+	}
+	deployed := make(map[string]bool)
+	for _, name := range strings.Split(list, "\n") {
+		if name = strings.TrimSpace(name); name != "" {
+			deployed[name] = true
+		}
+	}
+	return deployed, true
+}
+
+// remember records the intended version of a function in the inventory
+func (m *Manager) remember(function Journal.Rollback) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.inventory == nil {
+		m.inventory, _ = Journal.LoadInventory("") // e.g. a Manager not created by New
+	}
+	if err := m.inventory.Set(function); err != nil {
+		log.Warnf("%v. '%s' may not be reconciled after a restart", err, function.FuncName)
+	}
+}
+
+// markRunning marks the functions of the running release, which Reconcile skips
+func (m *Manager) markRunning(running bool, functions ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.running == nil {
+		m.running = make(map[string]bool)
+	}
+	for _, name := range functions {
+		if running {
+			m.running[name] = true
+		} else {
+			delete(m.running, name)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package manager
 
 import (
+	"context"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	MetricAgg "umbilical-choir-core/internal/app/metric_aggregator"
@@ -9,27 +10,30 @@ import (
 )
 
 // handleAfterTestInstructions determines the next stage, handles rollback (if needed), and rollout/rollback actions
-func (m *Manager) handleAfterTestInstructions(stage Strategy.Stage, testMeta *Tests.TestMeta, fMeta *Strategy.Function, strategy *Strategy.ReleaseStrategy, agg *MetricAgg.MetricAggregator, rollbackRequired bool, success bool, rollbackFuncVer *Strategy.Version) (*Strategy.Stage, error) {
+func (m *Manager) handleAfterTestInstructions(ctx context.Context, stage Strategy.Stage, testMeta *Tests.TestMeta, fMeta *Strategy.Function, strategy *Strategy.ReleaseStrategy, agg *MetricAgg.MetricAggregator, rollbackRequired bool, success bool, rollbackFuncVer *Strategy.Version) (*Strategy.Stage, error) {
 	if rollbackRequired {
 		log.Warn("Rollback is required. Replacing the rollback func... dump:", rollbackFuncVer)
-		testMeta.ReplaceChosenFunction(*rollbackFuncVer)
+		if err := testMeta.ReplaceChosenFunction(ctx, *rollbackFuncVer); err != nil {
+			return nil, err
+		}
+		rollbacks.WithLabelValues(fMeta.Name, "rollback_required").Inc()
 		return nil, nil
 	} else {
 		if success {
 			log.Infof("All '%s' requirements met. Proceeding with OnSuccess action", stage.Name)
-			nextStage, err := handleEndActionOrGetNextStage(stage.EndAction.OnSuccess, testMeta, fMeta, strategy)
+			nextStage, err := handleEndActionOrGetNextStage(ctx, stage.EndAction.OnSuccess, testMeta, fMeta, strategy)
 			if err != nil {
-				return nil, fmt.Errorf("failed to handle end action: %v", err)
+				return nil, fmt.Errorf("failed to handle end action: %w", err)
 			}
 			return nextStage, nil
 		} else {
 			log.Warnf("'%s' requirements Not met. Proceeding with OnFailure action", stage.Name)
-			nextStage, err := handleEndActionOrGetNextStage(stage.EndAction.OnFailure, testMeta, fMeta, strategy)
+			nextStage, err := handleEndActionOrGetNextStage(ctx, stage.EndAction.OnFailure, testMeta, fMeta, strategy)
 			if err != nil {
-				return nil, fmt.Errorf("failed to handle end action: %v", err)
+				return nil, fmt.Errorf("failed to handle end action: %w", err)
 			}
-			if (int(agg.F1ErrCounts)) != 0 {
-				log.Warnf("however, f1 had errors during test: %v/%v.", agg.F1ErrCounts, agg.F1Counts)
+			if baseErrors := agg.VariantErrors(0); int(baseErrors) != 0 {
+				log.Warnf("however, f1 (%s) had errors during test: %v/%v.", agg.Variants[0].Name, baseErrors, agg.VariantCalls(0))
 			}
 			return nextStage, nil
 		}
@@ -37,15 +41,28 @@ func (m *Manager) handleAfterTestInstructions(stage Strategy.Stage, testMeta *Te
 }
 
 // handleEndActionOrGetNextStage either runs rollout/rollback or returns the next stage
-func handleEndActionOrGetNextStage(endAction string, testMeta *Tests.TestMeta, fMeta *Strategy.Function, strategy *Strategy.ReleaseStrategy) (*Strategy.Stage, error) {
+func handleEndActionOrGetNextStage(ctx context.Context, endAction string, testMeta *Tests.TestMeta, fMeta *Strategy.Function, strategy *Strategy.ReleaseStrategy) (*Strategy.Stage, error) {
 	log.Infof("Processing end action '%s'", endAction)
 	switch endAction {
 	case "rollout":
-		log.Info("(rollout) Replacing new func version (f2)...")
-		testMeta.ReplaceChosenFunction(fMeta.NewVersion)
+		winner := testMeta.Winner
+		if winner == "" {
+			winner = "new_version"
+		}
+		version, err := fMeta.GetVersionByName(winner)
+		if err != nil {
+			return nil, fmt.Errorf("failed to roll out: %v", err)
+		}
+		log.Infof("(rollout) Replacing the chosen func version (%s)...", winner)
+		if err := testMeta.ReplaceChosenFunction(ctx, *version); err != nil {
+			return nil, fmt.Errorf("failed to roll out: %w", err)
+		}
 	case "rollback":
 		log.Info("(rollback) Replacing the base func version (f1)...")
-		testMeta.ReplaceChosenFunction(fMeta.BaseVersion)
+		if err := testMeta.ReplaceChosenFunction(ctx, fMeta.BaseVersion); err != nil {
+			return nil, fmt.Errorf("failed to roll back: %w", err)
+		}
+		rollbacks.WithLabelValues(fMeta.Name, "end_action").Inc()
 
 	default:
 		nextStage, err := strategy.GetStageByName(endAction)
@@ -6,11 +6,16 @@ import (
 	"encoding/json"
 	"fmt"
 	log "github.com/sirupsen/logrus"
-	"io"
+	"go.opentelemetry.io/otel/attribute"
 	"net/http"
-	"sort"
+	"regexp"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
+	Tracing "umbilical-choir-core/internal/app/tracing"
+	"umbilical-choir-core/internal/pkg/sketch"
+	"umbilical-choir-core/internal/pkg/stats"
 )
 
 // the expected format of the incoming JSON payload
@@ -20,48 +25,138 @@ type Metric struct {
 }
 type MetricUpdatePayload struct {
 	Program string   `json:"program"`
+	Stage   string   `json:"stage,omitempty"` // set by the newer proxies ('STAGE'), to reject the metrics of a stale proxy
 	Metrics []Metric `json:"metrics"`
 }
 
 type MetricAggregator struct {
-	Program      string // program name
-	StageName    string // stage name
-	Mutex        sync.Mutex
-	CallCounts   float64   // "Total number of calls"
-	F1Counts     float64   // "Total number of f1 function calls"
-	F2Counts     float64   // "Total number of f2 function calls"
-	F1ErrCounts  float64   // error count for f1 instead of f1_time
-	F2ErrCounts  float64   //
-	ProxyTimes   []float64 // "Total call (proxy) processing time"
-	F1Times      []float64 // "Total processing time of f1 function"
-	F2Times      []float64 // "Total processing time of f2 function"
-	OtherMetrics map[string]float64
+	Program       string            // program name
+	StageName     string            // stage name
+	ReleaseID     string            // optional. labels the metrics of the stage on '/metrics'
+	Mutex         sync.Mutex        // guards the metrics, which are updated by the metric server. read them by the accessors, e.g. Calls
+	CallCounts    float64           // "Total number of calls"
+	ProxyTimes    *sketch.Sketch    // "Total call (proxy) processing time"
+	LastProxyTime float64           // -1 if no calls yet
+	LastCallAt    time.Time         // when the last call was received. zero if no calls yet
+	Variants      []*VariantMetrics // in the proxy's order: Variants[0] is f1 (base version), Variants[1] is f2, ...
+	OtherMetrics  map[string]float64
+	Confidence    float64       // if set, the tested versions are compared with the base version by statistical tests at this confidence level
+	MinSamples    int           // minimum calls of each version for the statistical tests
+	Retention     time.Duration // how long the per-second metrics are kept for the windowed summaries. set it before the metric server starts
+	Store         *Store        // optional. if set, the received metrics are persisted to it
+	Step          int           // the step of a gradual stage the metrics are of, see ResetStep
+	Secret        string        // the proxy signs its pushes with it, if the metric server requires signatures (see MetricServer.Register)
+}
+
+// VariantMetrics holds the metrics of a tested version, reported by the proxy as 'f<n>_count', 'f<n>_time' and 'f<n>_error_count'.
+// The whole stage is kept in the totals and a sketch of the response times, and the last 'Retention' in per-second buckets
+type VariantMetrics struct {
+	Name      string         // version name
+	Counts    float64        // "Total number of f<n> function calls"
+	ErrCounts float64        // error count for f<n> instead of f<n>_time
+	Times     *sketch.Sketch // "Total processing time of f<n> function"
+	window    *window        // created with the first metric, as the 'Retention' may be set after creating the aggregator
+}
+
+var variantMetricRegex = regexp.MustCompile(`^f(\d+)_(count|time|error_count)$`)
+
+// NewMetricAggregator creates a MetricAggregator for the given versions, in the proxy's order
+func NewMetricAggregator(program, stageName string, variantNames []string) *MetricAggregator {
+	variants := make([]*VariantMetrics, len(variantNames))
+	for i, name := range variantNames {
+		variants[i] = &VariantMetrics{Name: name, Times: sketch.New()}
+	}
+	return &MetricAggregator{
+		Program:       program,
+		StageName:     stageName,
+		ProxyTimes:    sketch.New(),
+		LastProxyTime: -1,
+		Variants:      variants,
+		OtherMetrics:  make(map[string]float64),
+		Retention:     DefaultRetention,
+	}
 }
 
 type TimeSummary struct {
 	Median  float64 `json:"median"`
 	Minimum float64 `json:"minimum"`
 	Maximum float64 `json:"maximum"`
+	Mean    float64 `json:"mean"`
+	P90     float64 `json:"p90"`
+	P95     float64 `json:"p95"`
+	P99     float64 `json:"p99"`
+}
+
+// Value returns the summarized value by its name (a metric condition's compareWith), e.g. "Median" or "P99"
+func (ts TimeSummary) Value(name string) (float64, bool) {
+	switch name {
+	case "Median":
+		return ts.Median, true
+	case "Minimum":
+		return ts.Minimum, true
+	case "Maximum":
+		return ts.Maximum, true
+	case "Mean":
+		return ts.Mean, true
+	case "P90":
+		return ts.P90, true
+	case "P95":
+		return ts.P95, true
+	case "P99":
+		return ts.P99, true
+	default:
+		return 0, false
+	}
+}
+
+type VariantSummary struct {
+	Name         string         `json:"name"`
+	Calls        float64        `json:"calls"`
+	TimesSummary TimeSummary    `json:"times_summary"`
+	ErrRate      float64        `json:"err_rate"`
+	Significance *Significance  `json:"significance,omitempty"` // only the versions tested against the base version, in the statistical decision mode
+	Sketch       *sketch.Sketch `json:"sketch,omitempty"`       // the response times, to be merged with the ones of other agents
+}
+
+// Significance is the result of comparing a tested version with the base version by statistical tests.
+// A p-value is -1 if there were not enough samples for its test
+type Significance struct {
+	Confidence      float64 `json:"confidence"`
+	LatencyPValue   float64 `json:"latency_p_value"`    // Mann-Whitney U test. H1: slower than the base version
+	ErrorRatePValue float64 `json:"error_rate_p_value"` // two-proportion z-test. H1: higher error rate than the base version
+	Verdict         string  `json:"verdict"`
 }
+
+const ( // Significance verdicts
+	Regression       = "Regression"       // significantly worse than the base version
+	NoRegression     = "NoRegression"     // not significantly worse than the base version
+	InsufficientData = "InsufficientData" // not enough calls of the tested or the base version
+)
+
 type StageStatus int
 type ResultSummary struct { // TODO: add call counts. no calls can seen as a success + add runtime (of test)
-	StageName      string      `json:"stage_name"`
-	ProxyTimes     TimeSummary `json:"proxy_times"`
-	F1TimesSummary TimeSummary `json:"f1_times_summary"`
-	F2TimesSummary TimeSummary `json:"f2_times_summary"`
-	F1ErrRate      float64     `json:"f1_err_rate"`
-	F2ErrRate      float64     `json:"f2_err_rate"`
-	Status         StageStatus `json:"status"` // success, failure, or error
+	StageName      string           `json:"stage_name"`
+	ProxyTimes     TimeSummary      `json:"proxy_times"`
+	F1TimesSummary TimeSummary      `json:"f1_times_summary"` // same as Variants[0]
+	F2TimesSummary TimeSummary      `json:"f2_times_summary"` // same as Variants[1]
+	F1ErrRate      float64          `json:"f1_err_rate"`
+	F2ErrRate      float64          `json:"f2_err_rate"`
+	Variants       []VariantSummary `json:"variants"`             // all tested versions, in the proxy's order
+	Winner         string           `json:"winner,omitempty"`     // the chosen version among the versions tested against the base version
+	Status         StageStatus      `json:"status"`               // success, failure, or error
+	EndReason      string           `json:"end_reason,omitempty"` // why the stage ended before its end conditions were met (maxDuration or maxIdle), or the error that stopped it
 }
 
 const ( // NOTE, for any change, update RM source code and the readme (+ stageStatusLabels)
-	Pending        StageStatus = iota // The first stage status will be initialized as InProgress and never will be Pending
-	InProgress                        // the child is notified
-	SuccessWaiting                    // only WaitForSignal stage type. Child received enough calls and was successful
-	ShouldEnd                         // only WaitForSignal stage type. The child poll for it on /end_stage to finish a stage (set by the parent)
-	Completed                         // received the stage result
-	Failure                           // received the stage result as Failure
-	Error                             // received the stage result as Error
+	Pending           StageStatus = iota // The first stage status will be initialized as InProgress and never will be Pending
+	InProgress                           // the child is notified
+	SuccessWaiting                       // only WaitForSignal stage type. Child received enough calls and was successful
+	ShouldEnd                            // only WaitForSignal stage type. The child poll for it on /end_stage to finish a stage (set by the parent)
+	Completed                            // received the stage result
+	Failure                              // received the stage result as Failure
+	Error                                // received the stage result as Error
+	GuardrailViolated                    // the stage was aborted by a guardrail, and rolled back
+	Cancelled                            // the release was cancelled by the operator (e.g. SIGTERM) during the stage, and rolled back
 )
 
 var stageStatusLabels = []string{
@@ -72,6 +167,8 @@ var stageStatusLabels = []string{
 	"Completed",
 	"Failure",
 	"Error",
+	"GuardrailViolated",
+	"Cancelled",
 }
 
 // String returns the string representation of the StageStatus (you can print as %s)
@@ -82,142 +179,292 @@ func (s StageStatus) String() string {
 	return stageStatusLabels[s]
 }
 
-// StartMetricServer starts the metric server and listens for shutdown signals
-func StartMetricServer(aggregator *MetricAggregator, shutdownChan <-chan struct{}) {
-	mux := http.NewServeMux() // Create a new ServeMux for each call
-	mux.HandleFunc("/push", aggregator.HandleIncomingMetrics)
-
-	server := &http.Server{
-		Addr:    ":9999",
-		Handler: mux,
-	}
-
-	go func() {
-		log.Info("Starting metric server on port 9999")
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Could not listen on :9999: %v\n", err)
-		}
-	}()
-
-	go func() {
-		<-shutdownChan // Wait for shutdown signal
-
-		log.Info("Shutting down the Metric server...")
-
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-
-		if err := server.Shutdown(ctx); err != nil {
-			log.Fatalf("Metric server forced to shutdown: %v", err)
-		}
-
-		log.Info("Metric server exiting")
-	}()
+// Receive persists (if there is a Store) and aggregates the metrics of a payload
+func (ma *MetricAggregator) Receive(payload MetricUpdatePayload) {
+	ma.ReceiveBatch(&MetricBatch{Program: payload.Program, Stage: payload.Stage, Samples: []MetricSample{{Metrics: payload.Metrics}}})
 }
 
-func (ma *MetricAggregator) HandleIncomingMetrics(w http.ResponseWriter, r *http.Request) {
+// ReceiveBatch persists (if there is a Store) and aggregates the samples of a batch, in one go
+func (ma *MetricAggregator) ReceiveBatch(batch *MetricBatch) {
 	ma.Mutex.Lock()
 	defer ma.Mutex.Unlock()
 
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, "Error reading request body", http.StatusInternalServerError)
-		return
+	// Debug log to dump received metrics
+	log.Debugf("New metric set - Program: %s, Samples: %+v", batch.Program, batch.Samples)
+
+	now := time.Now()
+	// persisted as one record, with the times the samples are aggregated at
+	persisted := MetricBatch{Program: batch.Program, Stage: batch.Stage, Samples: make([]MetricSample, len(batch.Samples))}
+	for i, sample := range batch.Samples {
+		at := ma.sampleTime(sample, now)
+		persisted.Samples[i] = MetricSample{Timestamp: at.UnixMilli(), Metrics: sample.Metrics}
+		ma.apply(MetricUpdatePayload{Program: batch.Program, Stage: batch.Stage, Metrics: sample.Metrics}, at)
 	}
-	// Parse the JSON payload
-	var payload MetricUpdatePayload
-	err = json.Unmarshal(body, &payload)
-	if err != nil {
-		http.Error(w, "Error parsing JSON payload", http.StatusBadRequest)
-		return
+	if ma.Store != nil {
+		if err := ma.Store.AppendBatch(&persisted, now); err != nil {
+			log.Errorf("Failed to persist the received metrics: %v", err)
+		}
+		if ma.Store.needsCompaction() {
+			if err := ma.Store.compact(storeRecord{At: now.UnixNano(), Snapshot: ma.snapshot()}); err != nil {
+				log.Errorf("%v. It keeps growing", err)
+			}
+		}
 	}
+}
 
-	// Debug log to dump received metrics
-	log.Debugf("New metric set - Program: %s, Metrics: %+v", payload.Program, payload.Metrics)
-
-	// update metrics
+// apply updates the metrics with a payload received at the given time
+func (ma *MetricAggregator) apply(payload MetricUpdatePayload, at time.Time) {
 	for _, metric := range payload.Metrics {
 		// Update local metric maps instead of Prometheus metrics
 		switch metric.MetricName {
 		case "call_count":
 			ma.CallCounts += metric.Value
-		case "f1_count":
-			ma.F1Counts += metric.Value
-		case "f2_count":
-			ma.F2Counts += metric.Value
+			if at.After(ma.LastCallAt) { // the samples of a batch may be out of order
+				ma.LastCallAt = at
+			}
 		case "proxy_time":
-			ma.ProxyTimes = append(ma.ProxyTimes, metric.Value)
-		case "f1_time":
-			ma.F1Times = append(ma.F1Times, metric.Value)
-		case "f2_time":
-			ma.F2Times = append(ma.F2Times, metric.Value)
-		case "f1_error_count":
-			ma.F1ErrCounts += metric.Value
-			log.Error("Proxy reported Error calling f1")
-		case "f2_error_count":
-			ma.F2ErrCounts += metric.Value
-			log.Error("Proxy reported Error calling f2")
+			ma.ProxyTimes.Add(metric.Value)
+			ma.LastProxyTime = metric.Value
 		default:
-			ma.OtherMetrics[metric.MetricName] = metric.Value
-			log.Warnf("Unknown metric name: %s. added it to 'OtherMetrics'", metric.MetricName)
+			variant, kind := ma.variantOf(metric.MetricName)
+			if variant == nil {
+				ma.OtherMetrics[metric.MetricName] = metric.Value
+				log.Warnf("Unknown metric name: %s. added it to 'OtherMetrics'", metric.MetricName)
+				continue
+			}
+			if variant.window == nil {
+				variant.window = newWindow(ma.Retention)
+			}
+			current := variant.window.at(at)
+			switch kind {
+			case "count":
+				variant.Counts += metric.Value
+				current.counts += metric.Value
+			case "time":
+				variant.Times.Add(metric.Value)
+				current.times.Add(metric.Value)
+			case "error_count":
+				variant.ErrCounts += metric.Value
+				current.errCounts += metric.Value
+				log.Errorf("Proxy reported Error calling %s (%s)", metric.MetricName[:strings.Index(metric.MetricName, "_")], variant.Name)
+			}
 		}
 	}
-	fmt.Fprintf(w, "Metrics updated successfully")
 }
 
-func (ma *MetricAggregator) SummarizeResult() *ResultSummary {
+// Restore replays the metrics persisted in a store, e.g. of a stage that was interrupted by a crash of the agent
+func (ma *MetricAggregator) Restore(store *Store) error {
 	ma.Mutex.Lock()
 	defer ma.Mutex.Unlock()
 
-	// Helper function to summarize times
-	summarizeTimes := func(times []float64) TimeSummary {
-		if len(times) == 0 {
-			return TimeSummary{Median: -1, Minimum: -1, Maximum: -1}
-		}
-		var minT, maxT float64
-		minT = times[0]
-		for _, t := range times {
-			if t < minT {
-				minT = t
-			}
-			if t > maxT {
-				maxT = t
+	replayed, err := store.replay(func(record storeRecord) {
+		switch {
+		case record.Reset:
+			ma.reset()
+			ma.Step = record.Step
+		case record.Snapshot != nil:
+			ma.restoreSnapshot(record.Snapshot)
+		case record.Batch != nil:
+			for _, sample := range record.Batch.Samples {
+				ma.apply(MetricUpdatePayload{Program: record.Batch.Program, Stage: record.Batch.Stage, Metrics: sample.Metrics}, time.UnixMilli(sample.Timestamp))
 			}
+		default:
+			ma.apply(*record.Payload, time.Unix(0, record.At))
 		}
-		sortedTimes := make([]float64, len(times))
-		copy(sortedTimes, times)
-		sort.Float64s(sortedTimes)
-		var median float64
-		n := len(sortedTimes)
-		if n%2 == 0 {
-			median = (sortedTimes[n/2-1] + sortedTimes[n/2]) / 2
-		} else {
-			median = sortedTimes[n/2]
+	})
+	if err != nil {
+		return fmt.Errorf("failed to restore the metrics from '%s': %v", store.Path, err)
+	}
+	if replayed > 0 {
+		log.Infof("Restored %d metric records of '%s' (%v calls of step %d) from '%s'", replayed, ma.StageName, ma.CallCounts, ma.Step+1, store.Path)
+	}
+	return nil
+}
+
+// snapshot returns the aggregated metrics, which the store is compacted to
+func (ma *MetricAggregator) snapshot() *storeSnapshot {
+	snapshot := &storeSnapshot{
+		Step:          ma.Step,
+		CallCounts:    ma.CallCounts,
+		ProxyTimes:    ma.ProxyTimes,
+		LastProxyTime: ma.LastProxyTime,
+		LastCallAt:    ma.LastCallAt,
+		OtherMetrics:  ma.OtherMetrics,
+	}
+	for _, variant := range ma.Variants {
+		snapshot.Variants = append(snapshot.Variants, variantSnapshot{
+			Counts:    variant.Counts,
+			ErrCounts: variant.ErrCounts,
+			Times:     variant.Times,
+			Buckets:   variant.window.snapshot(),
+		})
+	}
+	return snapshot
+}
+
+// restoreSnapshot replaces the metrics with a snapshot of them
+func (ma *MetricAggregator) restoreSnapshot(snapshot *storeSnapshot) {
+	ma.reset()
+	ma.Step = snapshot.Step
+	ma.CallCounts = snapshot.CallCounts
+	_ = ma.ProxyTimes.Merge(snapshot.ProxyTimes) // same accuracy
+	ma.LastProxyTime = snapshot.LastProxyTime
+	ma.LastCallAt = snapshot.LastCallAt
+	for name, value := range snapshot.OtherMetrics {
+		ma.OtherMetrics[name] = value
+	}
+	for i, variant := range snapshot.Variants {
+		if i >= len(ma.Variants) {
+			break
+		}
+		ma.Variants[i].Counts = variant.Counts
+		ma.Variants[i].ErrCounts = variant.ErrCounts
+		_ = ma.Variants[i].Times.Merge(variant.Times)
+		if len(variant.Buckets) > 0 {
+			ma.Variants[i].window = newWindow(ma.Retention)
+			ma.Variants[i].window.restore(variant.Buckets)
 		}
-		return TimeSummary{Median: median, Minimum: minT, Maximum: maxT}
 	}
+}
 
-	// Calculate error rates
-	var f1ErrorRate, f2ErrorRate float64
-	if ma.F1Counts > 0 {
-		f1ErrorRate = ma.F1ErrCounts / ma.F1Counts
+// variantOf returns the variant of a 'f<n>_<kind>' metric and its kind, or nil if it is not a metric of a tested version
+func (ma *MetricAggregator) variantOf(metricName string) (*VariantMetrics, string) {
+	matches := variantMetricRegex.FindStringSubmatch(metricName)
+	if matches == nil {
+		return nil, ""
+	}
+	n, err := strconv.Atoi(matches[1])
+	if err != nil || n < 1 || n > len(ma.Variants) {
+		return nil, ""
 	}
-	if ma.F2Counts > 0 {
-		f2ErrorRate = ma.F2ErrCounts / ma.F2Counts
+	return ma.Variants[n-1], matches[2]
+}
+
+// Reset drops the collected metrics
+func (ma *MetricAggregator) Reset() {
+	ma.ResetStep(0)
+}
+
+// ResetStep drops the collected metrics to start a step of a gradual stage from scratch. The step is persisted with the reset,
+// so the restored metrics tell which step they are of
+func (ma *MetricAggregator) ResetStep(step int) {
+	ma.Mutex.Lock()
+	defer ma.Mutex.Unlock()
+
+	if ma.Store != nil {
+		if err := ma.Store.AppendReset(time.Now(), step); err != nil {
+			log.Errorf("Failed to persist the reset of the metrics: %v", err)
+		}
 	}
-	if (ma.F1Counts + ma.F2Counts) < 1 { // if there are no calls
-		log.Warnf("No calls were made to f1 or f2, but we will continue to process the status regardless")
+	ma.reset()
+	ma.Step = step
+}
+
+func (ma *MetricAggregator) reset() {
+	ma.CallCounts = 0
+	ma.ProxyTimes.Reset()
+	ma.LastProxyTime = -1
+	ma.LastCallAt = time.Time{}
+	for _, variant := range ma.Variants {
+		variant.Counts, variant.ErrCounts, variant.window = 0, 0, nil
+		variant.Times.Reset()
 	}
+}
+
+// LastCall returns when the last call was received, or the zero time if no calls yet
+func (ma *MetricAggregator) LastCall() time.Time {
+	ma.Mutex.Lock()
+	defer ma.Mutex.Unlock()
+	return ma.LastCallAt
+}
+
+// Calls returns the number of calls of the proxy so far
+func (ma *MetricAggregator) Calls() float64 {
+	ma.Mutex.Lock()
+	defer ma.Mutex.Unlock()
+	return ma.CallCounts
+}
+
+// LastResponseTime returns the processing time of the proxy's last call, or -1 if no calls yet
+func (ma *MetricAggregator) LastResponseTime() float64 {
+	ma.Mutex.Lock()
+	defer ma.Mutex.Unlock()
+	return ma.LastProxyTime
+}
+
+// VariantCalls returns the number of calls of the i-th tested version (in the proxy's order) so far
+func (ma *MetricAggregator) VariantCalls(i int) float64 {
+	ma.Mutex.Lock()
+	defer ma.Mutex.Unlock()
+	return ma.Variants[i].Counts
+}
+
+// VariantErrors returns the number of failed calls of the i-th tested version (in the proxy's order) so far
+func (ma *MetricAggregator) VariantErrors(i int) float64 {
+	ma.Mutex.Lock()
+	defer ma.Mutex.Unlock()
+	return ma.Variants[i].ErrCounts
+}
 
-	return &ResultSummary{
-		StageName:      ma.StageName,
-		ProxyTimes:     summarizeTimes(ma.ProxyTimes),
-		F1TimesSummary: summarizeTimes(ma.F1Times),
-		F2TimesSummary: summarizeTimes(ma.F2Times),
-		F1ErrRate:      f1ErrorRate,
-		F2ErrRate:      f2ErrorRate,
+func (ma *MetricAggregator) SummarizeResult() *ResultSummary {
+	ma.Mutex.Lock()
+	defer ma.Mutex.Unlock()
+
+	summary := &ResultSummary{
+		StageName:  ma.StageName,
+		ProxyTimes: summarizeTimes(ma.ProxyTimes),
 		// Status will be post-processed by the manager
 	}
+	var totalCalls float64
+	for _, variant := range ma.Variants {
+		totalCalls += variant.Counts
+		summary.Variants = append(summary.Variants, summarizeVariant(variant.Name, variant.Counts, variant.ErrCounts, variant.Times))
+	}
+	if totalCalls < 1 { // if there are no calls
+		log.Warnf("No calls were made to the tested versions, but we will continue to process the status regardless")
+	}
+
+	if ma.Confidence > 0 && len(ma.Variants) > 1 {
+		for i, variant := range ma.Variants[1:] {
+			summary.Variants[i+1].Significance = ma.compareWithBase(variant)
+		}
+	}
+
+	// f1 and f2 are kept for the parents that only support two versions
+	if len(summary.Variants) > 0 {
+		summary.F1TimesSummary = summary.Variants[0].TimesSummary
+		summary.F1ErrRate = summary.Variants[0].ErrRate
+	}
+	if len(summary.Variants) > 1 {
+		summary.F2TimesSummary = summary.Variants[1].TimesSummary
+		summary.F2ErrRate = summary.Variants[1].ErrRate
+	}
+	return summary
+}
+
+// SummarizeWindow summarizes the metrics of the tested versions received in the last 'window' (by the second), which should not be longer than the 'Retention'.
+// The sketches of the seconds are merged, so the percentiles are as accurate as the ones of the whole stage
+func (ma *MetricAggregator) SummarizeWindow(window time.Duration) *ResultSummary {
+	ma.Mutex.Lock()
+	defer ma.Mutex.Unlock()
+
+	if window > ma.Retention {
+		log.Warnf("Summarizing the last %v, but the metrics are only kept for %v", window, ma.Retention)
+	}
+	since := time.Now().Add(-window)
+	summary := &ResultSummary{
+		StageName:  ma.StageName,
+		ProxyTimes: summarizeTimes(sketch.New()),
+	}
+	for _, variant := range ma.Variants {
+		if variant.window == nil { // no metrics yet
+			summary.Variants = append(summary.Variants, summarizeVariant(variant.Name, 0, 0, sketch.New()))
+			continue
+		}
+		counts, errCounts, times := variant.window.since(since)
+		summary.Variants = append(summary.Variants, summarizeVariant(variant.Name, counts, errCounts, times))
+	}
+	return summary
 }
 
 func (ma *MetricAggregator) SummarizeString() string { // TODO: add error rates
@@ -226,43 +473,105 @@ func (ma *MetricAggregator) SummarizeString() string { // TODO: add error rates
 
 	// Summarize metrics
 	msg := fmt.Sprintf("stage: %s", ma.StageName)
-	msg += fmt.Sprintf("\nf1 errors: %v/%v", ma.F1ErrCounts, ma.F1Counts)
-	msg += fmt.Sprintf("\nf2 errors: %v/%v", ma.F2ErrCounts, ma.F2Counts)
-	msg += fmt.Sprintf("\nTotal calls (f1:f2): %v (%v:%v)\n", ma.CallCounts, ma.F1Counts, ma.F2Counts)
+	variantCalls := make([]string, len(ma.Variants))
+	for i, variant := range ma.Variants {
+		msg += fmt.Sprintf("\nf%d (%s) errors: %v/%v", i+1, variant.Name, variant.ErrCounts, variant.Counts)
+		variantCalls[i] = fmt.Sprint(variant.Counts)
+	}
+	msg += fmt.Sprintf("\nTotal calls (%s): %v (%s)\n", variantLabels(len(ma.Variants)), ma.CallCounts, strings.Join(variantCalls, ":"))
 
 	// Aggregate ProxyTimes
-	if len(ma.ProxyTimes) > 0 {
-		var minP, maxP float64
-		minP = ma.ProxyTimes[0]
-		for _, t := range ma.ProxyTimes {
-			if t < minP {
-				minP = t
-			}
-			if t > maxP {
-				maxP = t
-			}
-		}
-		// Sort ProxyTimes to find the median
-		sortedTimes := make([]float64, len(ma.ProxyTimes))
-		copy(sortedTimes, ma.ProxyTimes)
-		sort.Float64s(sortedTimes)
-
-		var median float64
-		n := len(sortedTimes)
-		if n%2 == 0 {
-			median = (sortedTimes[n/2-1] + sortedTimes[n/2]) / 2
-		} else {
-			median = sortedTimes[n/2]
-		}
-		msg += fmt.Sprintf("ProxyTimes - Med: %v, Min: %v, Max: %v\n", median, minP, maxP)
+	if ma.ProxyTimes.Count > 0 {
+		proxyTimes := summarizeTimes(ma.ProxyTimes)
+		msg += fmt.Sprintf("ProxyTimes - Med: %v, Min: %v, Max: %v, P99: %v\n", proxyTimes.Median, proxyTimes.Minimum, proxyTimes.Maximum, proxyTimes.P99)
 	} else {
 		msg += "\nProxyTimes - No data available\n"
 	}
 	return msg
 }
 
-func (summary *ResultSummary) SendResultSummary(releaseID, nextStage, agentID, parentHost, parentPort string) error {
+// compareWithBase tests if a version is significantly slower or has a significantly higher error rate than the base version
+func (ma *MetricAggregator) compareWithBase(variant *VariantMetrics) *Significance {
+	base := ma.Variants[0]
+	alpha := 1 - ma.Confidence
+	significance := &Significance{Confidence: ma.Confidence, LatencyPValue: -1, ErrorRatePValue: -1, Verdict: InsufficientData}
+	if base.Counts < float64(ma.MinSamples) || variant.Counts < float64(ma.MinSamples) {
+		return significance
+	}
+
+	if base.Times.Count >= float64(ma.MinSamples) && variant.Times.Count >= float64(ma.MinSamples) {
+		_, p, err := stats.MannWhitneyUBins(base.Times.Histogram(), variant.Times.Histogram()) // the times within the sketch's accuracy are ties
+		if err == nil {
+			significance.LatencyPValue = p
+		}
+	}
+	_, p, err := stats.TwoProportionZTest(base.ErrCounts, base.Counts, variant.ErrCounts, variant.Counts)
+	if err == nil {
+		significance.ErrorRatePValue = p
+	}
+
+	significance.Verdict = NoRegression
+	if (significance.LatencyPValue >= 0 && significance.LatencyPValue < alpha) || (significance.ErrorRatePValue >= 0 && significance.ErrorRatePValue < alpha) {
+		significance.Verdict = Regression
+	}
+	return significance
+}
+
+func summarizeVariant(name string, counts, errCounts float64, times *sketch.Sketch) VariantSummary {
+	var errorRate float64
+	if counts > 0 {
+		errorRate = errCounts / counts
+	}
+	return VariantSummary{
+		Name:         name,
+		Calls:        counts,
+		TimesSummary: summarizeTimes(times),
+		ErrRate:      errorRate,
+		Sketch:       times.Clone(),
+	}
+}
+
+// summarizeTimes summarizes the response times of a sketch. All values are -1 if there are no times
+func summarizeTimes(times *sketch.Sketch) TimeSummary {
+	if times.Count == 0 {
+		return TimeSummary{Median: -1, Minimum: -1, Maximum: -1, Mean: -1, P90: -1, P95: -1, P99: -1}
+	}
+	return TimeSummary{
+		Median:  times.Quantile(0.5),
+		Minimum: times.Min,
+		Maximum: times.Max,
+		Mean:    times.Mean(),
+		P90:     times.Quantile(0.9),
+		P95:     times.Quantile(0.95),
+		P99:     times.Quantile(0.99),
+	}
+}
+
+// Variant returns the summary of the given version, or nil if it was not tested
+func (summary *ResultSummary) Variant(name string) *VariantSummary {
+	for i := range summary.Variants {
+		if summary.Variants[i].Name == name {
+			return &summary.Variants[i]
+		}
+	}
+	return nil
+}
+
+// variantLabels returns "f1:f2:...:f<n>"
+func variantLabels(n int) string {
+	labels := make([]string, n)
+	for i := range labels {
+		labels[i] = fmt.Sprintf("f%d", i+1)
+	}
+	return strings.Join(labels, ":")
+}
+
+func (summary *ResultSummary) SendResultSummary(ctx context.Context, releaseID, nextStage, agentID, parentHost, parentPort string) (err error) {
+	ctx, span := Tracing.Start(ctx, "SendResultSummary", Tracing.ReleaseID.String(releaseID), Tracing.Stage.String(summary.StageName),
+		attribute.String("uc.status", summary.Status.String()), attribute.String("uc.next_stage", nextStage))
+	defer func() { Tracing.End(span, err) }()
 	log.Infof("Sending '%s' result summary to parent for release '%s', status '%v(%d)'", summary.StageName, releaseID, summary.Status, summary.Status)
+	stageResults.WithLabelValues(releaseID, summary.StageName, summary.Status.String()).Inc()
 
 	resultRequest := ResultRequest{
 		ID:             agentID,
@@ -277,7 +586,12 @@ func (summary *ResultSummary) SendResultSummary(releaseID, nextStage, agentID, p
 	}
 
 	url := fmt.Sprintf("http://%s:%s/result", parentHost, parentPort)
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(data))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(data))
+	if err != nil {
+		return fmt.Errorf("failed to create result request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		if resp != nil {
 			return fmt.Errorf("failed to send result request: %v (%s)", err, resp.Status)
@@ -0,0 +1,285 @@
+package metric_aggregator
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultMetricAddr is the address the metric server listens on, if not set in the config
+const DefaultMetricAddr = ":9999"
+
+// maxPushSize bounds the body of a push, as the metric server may be reachable from the internet (e.g. the proxies on GCP)
+const maxPushSize = 1 << 20
+
+// the headers of a signed push. The signature is "sha256=" and the hex HMAC-SHA256 of the timestamp, "." and the body, keyed by the stage's secret
+// (see Sign). The program routes the push to its stage's secret, so the signature is checked before the body is decoded
+const (
+	SignatureHeader = "X-UC-Signature"
+	TimestampHeader = "X-UC-Timestamp" // unix seconds
+	ProgramHeader   = "X-UC-Program"
+)
+
+// maxPushSkew bounds how old (or ahead) the timestamp of a signed push may be, so a captured push can't be replayed later
+const maxPushSkew = 2 * time.Minute
+
+// MetricServer receives the metrics pushed by the proxies of all the running stages on one listener,
+// and routes them to the aggregator registered for their Program, so the stages of different functions can run at the same time.
+// It also serves the agent's metrics and the running stages' in the Prometheus format on '/metrics', on the same listener or on PrometheusAddr
+type MetricServer struct {
+	Addr string
+	// each registered aggregator gets a random Secret (passed to the proxy as 'PUSHSECRET'), and the pushes not signed by it are rejected.
+	// Set by default. Unset it only for the older proxy builds, which don't sign
+	RequireSignature bool
+	CertFile         string // if set with KeyFile, the server serves TLS
+	KeyFile          string
+	// if set, '/metrics' is served (over http) on this address instead of Addr, e.g. on an interface the proxies (and the internet) can't reach
+	PrometheusAddr string
+
+	mutex              sync.Mutex
+	aggregators        map[string]*MetricAggregator // by program
+	server             *http.Server
+	listener           net.Listener
+	prometheusServer   *http.Server
+	prometheusListener net.Listener
+}
+
+// NewMetricServer creates a metric server for the given address (DefaultMetricAddr if not set), which requires signatures.
+// Start it before registering the aggregators
+func NewMetricServer(addr string) *MetricServer {
+	if addr == "" {
+		addr = DefaultMetricAddr
+	}
+	return &MetricServer{Addr: addr, RequireSignature: true, aggregators: make(map[string]*MetricAggregator)}
+}
+
+// Start listens on the server's address, and serves the pushes in the background until Close
+func (s *MetricServer) Start() error {
+	var tlsConfig *tls.Config
+	if s.Scheme() == "https" {
+		cert, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load the metric server's TLS certificate: %v", err)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	}
+	listener, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return fmt.Errorf("could not listen on %s: %v", s.Addr, err)
+	}
+	s.listener = listener
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	stages := prometheus.NewRegistry()
+	stages.MustRegister(s)
+	metrics := promhttp.HandlerFor(prometheus.Gatherers{prometheus.DefaultGatherer, stages}, promhttp.HandlerOpts{}) // the agent's metrics, and the running stages'
+	mux := http.NewServeMux()
+	mux.HandleFunc("/push", s.handlePush)
+	if s.PrometheusAddr == "" {
+		mux.Handle("/metrics", metrics)
+	} else {
+		prometheusListener, err := net.Listen("tcp", s.PrometheusAddr)
+		if err != nil {
+			s.listener.Close()
+			return fmt.Errorf("could not listen on %s: %v", s.PrometheusAddr, err)
+		}
+		s.prometheusListener = prometheusListener
+		prometheusMux := http.NewServeMux()
+		prometheusMux.Handle("/metrics", metrics)
+		s.prometheusServer = &http.Server{Handler: prometheusMux}
+		go func() {
+			log.Infof("Serving the Prometheus metrics on %s", prometheusListener.Addr())
+			if err := s.prometheusServer.Serve(prometheusListener); err != nil && err != http.ErrServerClosed {
+				log.Errorf("Prometheus metrics server stopped: %v", err)
+			}
+		}()
+	}
+	s.server = &http.Server{Handler: mux}
+
+	go func() {
+		log.Infof("Starting metric server on %s (%s)", s.listener.Addr(), s.Scheme())
+		if err := s.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Errorf("Metric server stopped: %v", err)
+		}
+	}()
+	return nil
+}
+
+// Scheme returns the scheme the proxies push with, e.g. to pass it to the proxy
+func (s *MetricServer) Scheme() string {
+	if s.CertFile != "" && s.KeyFile != "" {
+		return "https"
+	}
+	return "http"
+}
+
+// Port returns the port the server listens on, e.g. to pass it to the proxy (useful with a random port, ":0")
+func (s *MetricServer) Port() string {
+	return listenPort(s.Addr, s.listener)
+}
+
+// PrometheusPort returns the port '/metrics' is served on, Port if PrometheusAddr is not set
+func (s *MetricServer) PrometheusPort() string {
+	if s.PrometheusAddr == "" {
+		return s.Port()
+	}
+	return listenPort(s.PrometheusAddr, s.prometheusListener)
+}
+
+func listenPort(addr string, listener net.Listener) string {
+	if listener != nil {
+		addr = listener.Addr().String()
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return port
+}
+
+// Register routes the metrics of the aggregator's Program to it, until it is unregistered
+func (s *MetricServer) Register(aggregator *MetricAggregator) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if running, exists := s.aggregators[aggregator.Program]; exists {
+		return fmt.Errorf("program '%s' is already running in stage '%s'", aggregator.Program, running.StageName)
+	}
+	if s.RequireSignature {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return fmt.Errorf("failed to generate the push secret: %v", err)
+		}
+		aggregator.Secret = hex.EncodeToString(secret)
+	}
+	s.aggregators[aggregator.Program] = aggregator
+	log.Debugf("Metric server: routing '%s' to the aggregator of '%s'", aggregator.Program, aggregator.StageName)
+	return nil
+}
+
+// Unregister stops routing the metrics of the aggregator's Program to it. Its later pushes are rejected
+func (s *MetricServer) Unregister(aggregator *MetricAggregator) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.aggregators[aggregator.Program] == aggregator {
+		delete(s.aggregators, aggregator.Program)
+	}
+}
+
+// Close shuts the server down, waiting up to 5s for the pushes in progress
+func (s *MetricServer) Close() error {
+	if s.server == nil {
+		return nil
+	}
+	log.Info("Shutting down the Metric server...")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if s.prometheusServer != nil {
+		if err := s.prometheusServer.Shutdown(ctx); err != nil {
+			log.Warnf("Failed to shut down the Prometheus metrics server: %v", err)
+		}
+	}
+	return s.server.Shutdown(ctx)
+}
+
+// handlePush passes the pushed metrics (a payload or a batch, see decodePush) to the aggregator of their program.
+// If the server requires signatures, the push is routed by its ProgramHeader, and its signature is checked over the body as sent (e.g. gzipped)
+// before the body is decoded. A payload with a stage name (of the newer proxies) is rejected if that stage is not the running one,
+// e.g. a stale proxy of the previous stage
+func (s *MetricServer) handlePush(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxPushSize))
+	if err != nil {
+		http.Error(w, "Error reading request body", http.StatusBadRequest)
+		return
+	}
+	program := r.Header.Get(ProgramHeader)
+	var aggregator *MetricAggregator
+	if s.RequireSignature {
+		if program == "" {
+			log.Warnf("Metric server: dropped the metrics from %s, with no program header", r.RemoteAddr)
+			http.Error(w, "missing or bad signature", http.StatusUnauthorized)
+			return
+		}
+		if aggregator = s.aggregator(w, program); aggregator == nil {
+			return
+		}
+		if err := verifySignature(aggregator.Secret, r.Header.Get(TimestampHeader), body, r.Header.Get(SignatureHeader), time.Now()); err != nil {
+			log.Warnf("Metric server: dropped the metrics of '%s' from %s: %v", program, r.RemoteAddr, err)
+			http.Error(w, "missing or bad signature", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	batch, err := decodePush(body, r.Header.Get("Content-Type"), r.Header.Get("Content-Encoding"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if program != "" && batch.Program != program {
+		http.Error(w, fmt.Sprintf("the metrics of program '%s' were pushed as '%s'", batch.Program, program), http.StatusBadRequest)
+		return
+	}
+	if aggregator == nil {
+		if aggregator = s.aggregator(w, batch.Program); aggregator == nil {
+			return
+		}
+	}
+	if batch.Stage != "" && batch.Stage != aggregator.StageName {
+		log.Warnf("Metric server: dropped the metrics of '%s' for stage '%s', while '%s' is running", batch.Program, batch.Stage, aggregator.StageName)
+		http.Error(w, fmt.Sprintf("stage '%s' of program '%s' is not running", batch.Stage, batch.Program), http.StatusConflict)
+		return
+	}
+	aggregator.ReceiveBatch(batch)
+	fmt.Fprintf(w, "Metrics updated successfully")
+}
+
+// aggregator returns the aggregator of a program, or writes a 404 if it is not running
+func (s *MetricServer) aggregator(w http.ResponseWriter, program string) *MetricAggregator {
+	s.mutex.Lock()
+	aggregator, exists := s.aggregators[program]
+	s.mutex.Unlock()
+	if !exists {
+		log.Debugf("Metric server: dropped the metrics of '%s', which is not running", program)
+		http.Error(w, fmt.Sprintf("no running test for program '%s'", program), http.StatusNotFound)
+	}
+	return aggregator
+}
+
+// Sign returns the SignatureHeader value of a push body, sent with the given TimestampHeader value
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifySignature checks the signature of a push, and that its timestamp is within maxPushSkew of now
+func verifySignature(secret, timestamp string, body []byte, signature string, now time.Time) error {
+	if secret == "" || signature == "" {
+		return fmt.Errorf("no signature")
+	}
+	if !hmac.Equal([]byte(signature), []byte(Sign(secret, timestamp, body))) {
+		return fmt.Errorf("bad signature")
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad timestamp '%s'", timestamp)
+	}
+	if skew := now.Sub(time.Unix(seconds, 0)); skew > maxPushSkew || skew < -maxPushSkew {
+		return fmt.Errorf("timestamp %s is %v off, more than %v", timestamp, skew.Round(time.Second), maxPushSkew)
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package metric_aggregator
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newSignedServer starts a metric server (which requires signatures by default), with a running stage 'ab' of the program 'test-sieve'
+func newSignedServer(t *testing.T) (*MetricServer, *MetricAggregator) {
+	t.Helper()
+	server := NewMetricServer("127.0.0.1:0")
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	agg := NewMetricAggregator("test-sieve", "ab", variantNames)
+	if err := server.Register(agg); err != nil {
+		t.Fatal(err)
+	}
+	return server, agg
+}
+
+// push pushes a body with the given headers, and returns the status code
+func push(t *testing.T, server *MetricServer, body []byte, headers map[string]string) int {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, "http://127.0.0.1:"+server.Port()+"/push", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// signed returns the headers of a push signed by the secret at the given time
+func signed(secret, program string, body []byte, at time.Time) map[string]string {
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	return map[string]string{ProgramHeader: program, TimestampHeader: timestamp, SignatureHeader: Sign(secret, timestamp, body)}
+}
+
+func TestHandlePushSigned(t *testing.T) {
+	server, agg := newSignedServer(t)
+	body := []byte(`{"program": "test-sieve", "stage": "ab", "metrics": [{"metric_name": "call_count", "value": 1}]}`)
+	now := time.Now()
+
+	for _, c := range []struct {
+		name    string
+		headers map[string]string
+		status  int
+	}{
+		{"signed", signed(agg.Secret, "test-sieve", body, now), http.StatusOK},
+		{"slightly ahead", signed(agg.Secret, "test-sieve", body, now.Add(time.Minute)), http.StatusOK},
+		{"unsigned", map[string]string{ProgramHeader: "test-sieve"}, http.StatusUnauthorized},
+		{"no program", map[string]string{SignatureHeader: Sign(agg.Secret, "", body)}, http.StatusUnauthorized},
+		{"another secret", signed("secret", "test-sieve", body, now), http.StatusUnauthorized},
+		{"replayed", signed(agg.Secret, "test-sieve", body, now.Add(-maxPushSkew-time.Minute)), http.StatusUnauthorized},
+		{"not running", signed(agg.Secret, "test-other", body, now), http.StatusNotFound},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if status := push(t, server, body, c.headers); status != c.status {
+				t.Errorf("got %d, want %d", status, c.status)
+			}
+		})
+	}
+	if agg.Calls() != 2 {
+		t.Errorf("%v calls were received, want the 2 accepted", agg.Calls())
+	}
+
+	// the timestamp is signed too
+	headers := signed(agg.Secret, "test-sieve", body, now.Add(-maxPushSkew-time.Minute))
+	headers[TimestampHeader] = strconv.FormatInt(now.Unix(), 10)
+	if status := push(t, server, body, headers); status != http.StatusUnauthorized {
+		t.Errorf("got %d for a push with a changed timestamp, want %d", status, http.StatusUnauthorized)
+	}
+}
+
+func TestHandlePushVerifiesBeforeDecoding(t *testing.T) {
+	server, agg := newSignedServer(t)
+	var gzipped bytes.Buffer
+	writer := gzip.NewWriter(&gzipped)
+	writer.Write([]byte(`{"program": "test-sieve", "samples": [{"metrics": [{"metric_name": "call_count", "value": 3}]}]}`))
+	writer.Close()
+
+	// signed as sent
+	headers := signed(agg.Secret, "test-sieve", gzipped.Bytes(), time.Now())
+	headers["Content-Encoding"] = "gzip"
+	if status := push(t, server, gzipped.Bytes(), headers); status != http.StatusOK {
+		t.Errorf("got %d for a signed gzipped batch, want %d", status, http.StatusOK)
+	}
+	// an unsigned body is not decoded, e.g. a gzip bomb
+	headers = map[string]string{ProgramHeader: "test-sieve", "Content-Encoding": "gzip"}
+	if status := push(t, server, []byte("not gzip"), headers); status != http.StatusUnauthorized {
+		t.Errorf("got %d for an unsigned body, want %d", status, http.StatusUnauthorized)
+	}
+	// the body is of another program than the signed header
+	body := []byte(`{"program": "test-other", "metrics": [{"metric_name": "call_count", "value": 1}]}`)
+	if status := push(t, server, body, signed(agg.Secret, "test-sieve", body, time.Now())); status != http.StatusBadRequest {
+		t.Errorf("got %d for a body of another program, want %d", status, http.StatusBadRequest)
+	}
+	if agg.Calls() != 3 {
+		t.Errorf("%v calls were received, want the 3 of the signed batch", agg.Calls())
+	}
+}
+
+func TestHandlePushUnsigned(t *testing.T) {
+	server := NewMetricServer("127.0.0.1:0")
+	server.RequireSignature = false
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	agg := NewMetricAggregator("test-sieve", "ab", variantNames)
+	server.Register(agg)
+
+	// the older proxy builds push no headers, and are routed by the program of the body
+	body := []byte(`{"program": "test-sieve", "metrics": [{"metric_name": "call_count", "value": 1}]}`)
+	if status := push(t, server, body, nil); status != http.StatusOK {
+		t.Errorf("got %d, want %d", status, http.StatusOK)
+	}
+	if status := push(t, server, []byte(`{"program": "test-sieve", "stage": "canary", "metrics": []}`), nil); status != http.StatusConflict {
+		t.Errorf("got %d for the push of another stage, want %d", status, http.StatusConflict)
+	}
+	if agg.Calls() != 1 {
+		t.Errorf("%v calls were received, want 1", agg.Calls())
+	}
+}
+
+func TestPrometheusAddr(t *testing.T) {
+	get := func(port string) int {
+		t.Helper()
+		resp, err := http.Get("http://127.0.0.1:" + port + "/metrics")
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	server := NewMetricServer("127.0.0.1:0")
+	server.PrometheusAddr = "127.0.0.1:0"
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	if server.PrometheusPort() == server.Port() {
+		t.Fatalf("'/metrics' is served on the push port %s", server.Port())
+	}
+	if status := get(server.PrometheusPort()); status != http.StatusOK {
+		t.Errorf("got %d on the Prometheus address, want %d", status, http.StatusOK)
+	}
+	if status := get(server.Port()); status != http.StatusNotFound {
+		t.Errorf("got %d on the push address, want %d", status, http.StatusNotFound)
+	}
+
+	shared := NewMetricServer("127.0.0.1:0")
+	if err := shared.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer shared.Close()
+	if status := get(shared.PrometheusPort()); shared.PrometheusPort() != shared.Port() || status != http.StatusOK {
+		t.Errorf("got %d on port %s without a Prometheus address, want %d on the push port %s", status, shared.PrometheusPort(), http.StatusOK, shared.Port())
+	}
+}
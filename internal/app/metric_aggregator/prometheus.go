@@ -0,0 +1,80 @@
+package metric_aggregator
+
+import (
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"umbilical-choir-core/internal/pkg/sketch"
+)
+
+// ResponseTimeBuckets are the bucket bounds (ms) of the response time histograms on '/metrics'
+var ResponseTimeBuckets = []float64{1, 2.5, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+// stageResults counts the stage results reported to the parent, see SendResultSummary
+var stageResults = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "uc_stage_results_total",
+	Help: "Stage results reported to the parent, by status.",
+}, []string{"release", "stage", "status"})
+
+// the metrics of the running stages, see Collect
+var (
+	stageLabelNames   = []string{"release", "stage", "program"}
+	variantLabelNames = append(stageLabelNames[:len(stageLabelNames):len(stageLabelNames)], "variant")
+	runningStagesDesc = prometheus.NewDesc("uc_running_stages", "Stages whose metrics are being received.", nil, nil)
+	stageCallsDesc    = prometheus.NewDesc("uc_stage_calls_total", "Calls of the proxy of the running stage.", stageLabelNames, nil)
+	proxyTimesDesc    = prometheus.NewDesc("uc_stage_proxy_time_milliseconds", "Processing time of the proxy of the running stage.", stageLabelNames, nil)
+	variantCallsDesc  = prometheus.NewDesc("uc_variant_calls_total", "Calls of a tested version in the running stage.", variantLabelNames, nil)
+	variantErrorsDesc = prometheus.NewDesc("uc_variant_errors_total", "Failed calls of a tested version in the running stage.", variantLabelNames, nil)
+	variantTimesDesc  = prometheus.NewDesc("uc_variant_response_time_milliseconds", "Response time of a tested version in the running stage.", variantLabelNames, nil)
+)
+
+// Describe makes the metric server a prometheus.Collector of the running stages' metrics, see Collect
+func (s *MetricServer) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{runningStagesDesc, stageCallsDesc, proxyTimesDesc, variantCallsDesc, variantErrorsDesc, variantTimesDesc} {
+		ch <- desc
+	}
+}
+
+// Collect sends the metrics of the running stages, for '/metrics'.
+// They are the metrics aggregated so far (reset if the stage is, e.g. by each step of a Gradual stage), and are dropped once the stage ends
+func (s *MetricServer) Collect(ch chan<- prometheus.Metric) {
+	s.mutex.Lock()
+	aggregators := make([]*MetricAggregator, 0, len(s.aggregators))
+	for _, aggregator := range s.aggregators {
+		aggregators = append(aggregators, aggregator)
+	}
+	s.mutex.Unlock()
+	sort.Slice(aggregators, func(i, j int) bool { return aggregators[i].Program < aggregators[j].Program })
+
+	ch <- prometheus.MustNewConstMetric(runningStagesDesc, prometheus.GaugeValue, float64(len(aggregators)))
+	for _, ma := range aggregators {
+		ma.Mutex.Lock()
+		labels := []string{ma.ReleaseID, ma.StageName, ma.Program}
+		ch <- prometheus.MustNewConstMetric(stageCallsDesc, prometheus.CounterValue, ma.CallCounts, labels...)
+		ch <- sketchHistogram(proxyTimesDesc, ma.ProxyTimes, labels)
+		for _, variant := range ma.Variants {
+			labels := append(labels[:len(labels):len(labels)], variant.Name)
+			ch <- prometheus.MustNewConstMetric(variantCallsDesc, prometheus.CounterValue, variant.Counts, labels...)
+			ch <- prometheus.MustNewConstMetric(variantErrorsDesc, prometheus.CounterValue, variant.ErrCounts, labels...)
+			ch <- sketchHistogram(variantTimesDesc, variant.Times, labels)
+		}
+		ma.Mutex.Unlock()
+	}
+}
+
+// sketchHistogram returns the histogram of a sketch's values, counted by the representative value of their bins (within its accuracy)
+func sketchHistogram(desc *prometheus.Desc, s *sketch.Sketch, labels []string) prometheus.Metric {
+	counts := make([]float64, len(ResponseTimeBuckets)+1) // the last one is of +Inf
+	for _, bin := range s.Histogram() {
+		counts[sort.SearchFloat64s(ResponseTimeBuckets, bin.Value)] += bin.Count // the first bound >= value
+	}
+	buckets := make(map[float64]uint64, len(ResponseTimeBuckets))
+	cumulative := 0.0
+	for i, bound := range ResponseTimeBuckets {
+		cumulative += counts[i]
+		buckets[bound] = uint64(cumulative)
+	}
+	cumulative += counts[len(ResponseTimeBuckets)]
+	return prometheus.MustNewConstHistogram(desc, uint64(cumulative), s.Sum, buckets, labels...) // the sum is exact
+}
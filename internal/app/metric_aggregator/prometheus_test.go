@@ -0,0 +1,105 @@
+package metric_aggregator
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// runningStage registers a stage of release '1' on a new (not started) metric server, with some metrics received
+func runningStage(t *testing.T) *MetricServer {
+	t.Helper()
+	server := NewMetricServer("127.0.0.1:0")
+	agg := NewMetricAggregator("test-sieve", "ab", variantNames)
+	agg.ReleaseID = "1"
+	if err := server.Register(agg); err != nil {
+		t.Fatal(err)
+	}
+	agg.Receive(MetricUpdatePayload{Program: "test-sieve", Metrics: []Metric{
+		{MetricName: "call_count", Value: 3},
+		{MetricName: "proxy_time", Value: 3},
+		{MetricName: "proxy_time", Value: 40},
+		{MetricName: "proxy_time", Value: 20000}, // over the last bound, so only in +Inf
+		{MetricName: "f1_count", Value: 2},
+		{MetricName: "f2_count", Value: 1},
+		{MetricName: "f2_error_count", Value: 1},
+	}})
+	return server
+}
+
+func TestCollect(t *testing.T) {
+	server := runningStage(t)
+	want := `# HELP uc_running_stages Stages whose metrics are being received.
+# TYPE uc_running_stages gauge
+uc_running_stages 1
+# HELP uc_stage_calls_total Calls of the proxy of the running stage.
+# TYPE uc_stage_calls_total counter
+uc_stage_calls_total{program="test-sieve",release="1",stage="ab"} 3
+# HELP uc_stage_proxy_time_milliseconds Processing time of the proxy of the running stage.
+# TYPE uc_stage_proxy_time_milliseconds histogram
+uc_stage_proxy_time_milliseconds_bucket{program="test-sieve",release="1",stage="ab",le="1"} 0
+uc_stage_proxy_time_milliseconds_bucket{program="test-sieve",release="1",stage="ab",le="2.5"} 0
+uc_stage_proxy_time_milliseconds_bucket{program="test-sieve",release="1",stage="ab",le="5"} 1
+uc_stage_proxy_time_milliseconds_bucket{program="test-sieve",release="1",stage="ab",le="10"} 1
+uc_stage_proxy_time_milliseconds_bucket{program="test-sieve",release="1",stage="ab",le="25"} 1
+uc_stage_proxy_time_milliseconds_bucket{program="test-sieve",release="1",stage="ab",le="50"} 2
+uc_stage_proxy_time_milliseconds_bucket{program="test-sieve",release="1",stage="ab",le="100"} 2
+uc_stage_proxy_time_milliseconds_bucket{program="test-sieve",release="1",stage="ab",le="250"} 2
+uc_stage_proxy_time_milliseconds_bucket{program="test-sieve",release="1",stage="ab",le="500"} 2
+uc_stage_proxy_time_milliseconds_bucket{program="test-sieve",release="1",stage="ab",le="1000"} 2
+uc_stage_proxy_time_milliseconds_bucket{program="test-sieve",release="1",stage="ab",le="2500"} 2
+uc_stage_proxy_time_milliseconds_bucket{program="test-sieve",release="1",stage="ab",le="5000"} 2
+uc_stage_proxy_time_milliseconds_bucket{program="test-sieve",release="1",stage="ab",le="10000"} 2
+uc_stage_proxy_time_milliseconds_bucket{program="test-sieve",release="1",stage="ab",le="+Inf"} 3
+uc_stage_proxy_time_milliseconds_sum{program="test-sieve",release="1",stage="ab"} 20043
+uc_stage_proxy_time_milliseconds_count{program="test-sieve",release="1",stage="ab"} 3
+# HELP uc_variant_calls_total Calls of a tested version in the running stage.
+# TYPE uc_variant_calls_total counter
+uc_variant_calls_total{program="test-sieve",release="1",stage="ab",variant="base_version"} 2
+uc_variant_calls_total{program="test-sieve",release="1",stage="ab",variant="new_version"} 1
+# HELP uc_variant_errors_total Failed calls of a tested version in the running stage.
+# TYPE uc_variant_errors_total counter
+uc_variant_errors_total{program="test-sieve",release="1",stage="ab",variant="base_version"} 0
+uc_variant_errors_total{program="test-sieve",release="1",stage="ab",variant="new_version"} 1
+`
+	names := []string{"uc_running_stages", "uc_stage_calls_total", "uc_stage_proxy_time_milliseconds", "uc_variant_calls_total", "uc_variant_errors_total"}
+	if err := testutil.CollectAndCompare(server, strings.NewReader(want), names...); err != nil {
+		t.Error(err)
+	}
+	if count := testutil.CollectAndCount(server, "uc_variant_response_time_milliseconds"); count != len(variantNames) {
+		t.Errorf("got %d response time histograms, want one of each variant", count)
+	}
+
+	server.Unregister(server.aggregators["test-sieve"]) // the stage ended
+	if err := testutil.CollectAndCompare(server, strings.NewReader("# HELP uc_running_stages Stages whose metrics are being received.\n# TYPE uc_running_stages gauge\nuc_running_stages 0\n")); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestMetricsHandler checks that '/metrics' serves the agent's metrics (of the default registry) with the running stages'
+func TestMetricsHandler(t *testing.T) {
+	server := runningStage(t)
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	stageResults.WithLabelValues("1", "ab", Completed.String()).Inc()
+
+	resp, err := http.Get("http://127.0.0.1:" + server.Port() + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`uc_running_stages 1`, `uc_stage_results_total{release="1",stage="ab",status="Completed"} 1`} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("'/metrics' does not have '%s':\n%s", want, body)
+		}
+	}
+}
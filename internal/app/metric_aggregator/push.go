@@ -0,0 +1,172 @@
+package metric_aggregator
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// the push formats, by Content-Type: JSON (a MetricUpdatePayload, or a MetricBatch) or protobuf (a MetricBatch, see push.proto).
+// Either can be gzipped (Content-Encoding: gzip)
+const (
+	ContentTypeJSON     = "application/json"
+	ContentTypeProtobuf = "application/x-protobuf"
+)
+
+// maxDecodedPushSize bounds a decompressed push
+const maxDecodedPushSize = 16 << 20
+
+// MetricBatch is a batched push: the metrics of many calls, each with the time it was taken, so a proxy can push them e.g. once a second.
+// The metrics of a batch are aggregated at once (see ReceiveBatch)
+type MetricBatch struct {
+	Program string         `json:"program"`
+	Stage   string         `json:"stage,omitempty"`
+	Samples []MetricSample `json:"samples"`
+}
+
+// MetricSample is the metrics of a call in a MetricBatch
+type MetricSample struct {
+	Timestamp int64    `json:"timestamp"` // unix milliseconds. the time it is received at, if not set
+	Metrics   []Metric `json:"metrics"`
+}
+
+// decodePush decodes a push of any format as a batch. A MetricUpdatePayload (of the older proxies) is a batch of one sample
+func decodePush(body []byte, contentType, contentEncoding string) (*MetricBatch, error) {
+	if strings.EqualFold(contentEncoding, "gzip") {
+		reader, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip body: %v", err)
+		}
+		body, err = io.ReadAll(io.LimitReader(reader, maxDecodedPushSize+1))
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip body: %v", err)
+		}
+		if len(body) > maxDecodedPushSize {
+			return nil, fmt.Errorf("decompressed body is over %d bytes", maxDecodedPushSize)
+		}
+	}
+
+	mediaType := strings.TrimSpace(strings.Split(contentType, ";")[0])
+	if mediaType == ContentTypeProtobuf || mediaType == "application/protobuf" {
+		return decodeProtoBatch(body)
+	}
+	var push struct { // either format
+		MetricBatch
+		Metrics []Metric `json:"metrics"`
+	}
+	if err := json.Unmarshal(body, &push); err != nil {
+		return nil, fmt.Errorf("invalid JSON payload: %v", err)
+	}
+	batch := push.MetricBatch
+	if push.Metrics != nil {
+		batch.Samples = append(batch.Samples, MetricSample{Metrics: push.Metrics})
+	}
+	return &batch, nil
+}
+
+// decodeProtoBatch decodes the protobuf encoding of a MetricBatch (see push.proto). Unknown fields are skipped
+func decodeProtoBatch(data []byte) (*MetricBatch, error) {
+	batch := &MetricBatch{}
+	err := decodeProtoFields(data, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			batch.Program = string(value)
+		case num == 2 && typ == protowire.BytesType:
+			batch.Stage = string(value)
+		case num == 3 && typ == protowire.BytesType:
+			sample, err := decodeProtoSample(value)
+			if err != nil {
+				return err
+			}
+			batch.Samples = append(batch.Samples, sample)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid protobuf payload: %v", err)
+	}
+	return batch, nil
+}
+
+func decodeProtoSample(data []byte) (MetricSample, error) {
+	var sample MetricSample
+	err := decodeProtoFields(data, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			v, _ := protowire.ConsumeVarint(value)
+			sample.Timestamp = int64(v)
+		case num == 2 && typ == protowire.BytesType:
+			var metric Metric
+			err := decodeProtoFields(value, func(num protowire.Number, typ protowire.Type, value []byte) error {
+				switch {
+				case num == 1 && typ == protowire.BytesType:
+					metric.MetricName = string(value)
+				case num == 2 && typ == protowire.Fixed64Type:
+					v, _ := protowire.ConsumeFixed64(value)
+					metric.Value = math.Float64frombits(v)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			sample.Metrics = append(sample.Metrics, metric)
+		}
+		return nil
+	})
+	return sample, err
+}
+
+// decodeProtoFields calls 'field' with each field of a protobuf message: its number, wire type, and its value
+// (the content of a length-delimited field, or the encoded varint or fixed value)
+func decodeProtoFields(data []byte, field func(num protowire.Number, typ protowire.Type, value []byte) error) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		var value []byte
+		if typ == protowire.BytesType {
+			v, m := protowire.ConsumeBytes(data)
+			if m < 0 {
+				return protowire.ParseError(m)
+			}
+			value, n = v, m
+		} else {
+			n = protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			value = data[:n]
+		}
+		if err := field(num, typ, value); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// sampleTime returns the time of a sample received at 'now'. It is never in the future, nor older than the retention of the
+// per-second metrics (it would recycle a current bucket): the late ones are counted in the oldest second
+func (ma *MetricAggregator) sampleTime(sample MetricSample, now time.Time) time.Time {
+	if sample.Timestamp <= 0 {
+		return now
+	}
+	at := time.UnixMilli(sample.Timestamp)
+	if at.After(now) {
+		return now
+	}
+	if oldest := now.Add(-ma.Retention); at.Before(oldest) {
+		return oldest
+	}
+	return at
+}
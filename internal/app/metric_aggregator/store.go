@@ -0,0 +1,241 @@
+package metric_aggregator
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"umbilical-choir-core/internal/pkg/sketch"
+)
+
+// Store is an append-only log (WAL) of the metrics received in a stage, kept at '<dataDir>/metrics/<release ID>/<stage name>.wal'.
+// The aggregator appends every received batch as one record, so the metrics of a stage can be restored after the agent crashes.
+// The records are buffered, and flushed every storeFlushInterval and on Close: a crash of the agent loses the metrics of the last interval at most.
+// The store is compacted on each reset (to the reset), and every storeCompactAfter records (to a snapshot of the aggregated metrics)
+type Store struct {
+	Path    string
+	mutex   sync.Mutex
+	file    *os.File
+	writer  *bufio.Writer
+	records int           // since the last compaction
+	stop    chan struct{} // stops the periodic flush
+	stopped chan struct{}
+	closing sync.Once
+}
+
+const (
+	storeFlushInterval = time.Second
+	storeCompactAfter  = 10000
+)
+
+// storeRecord is a line of the store. It is either a received payload or batch, a reset of the metrics (e.g. a new step of a gradual stage),
+// or a snapshot of the aggregated metrics. The metrics before a reset or a snapshot are dropped when replaying
+type storeRecord struct {
+	At       int64                `json:"at"` // unix nano
+	Reset    bool                 `json:"reset,omitempty"`
+	Step     int                  `json:"step,omitempty"` // of a reset: the step of a gradual stage the metrics after it are of
+	Payload  *MetricUpdatePayload `json:"payload,omitempty"`
+	Batch    *MetricBatch         `json:"batch,omitempty"` // the timestamps of its samples are the times they were aggregated at
+	Snapshot *storeSnapshot       `json:"snapshot,omitempty"`
+}
+
+// storeSnapshot is the aggregated metrics of a stage, which its store is compacted to
+type storeSnapshot struct {
+	Step          int                `json:"step,omitempty"`
+	CallCounts    float64            `json:"call_counts"`
+	ProxyTimes    *sketch.Sketch     `json:"proxy_times"`
+	LastProxyTime float64            `json:"last_proxy_time"`
+	LastCallAt    time.Time          `json:"last_call_at"`
+	Variants      []variantSnapshot  `json:"variants"`
+	OtherMetrics  map[string]float64 `json:"other_metrics,omitempty"`
+}
+
+type variantSnapshot struct {
+	Counts    float64          `json:"counts"`
+	ErrCounts float64          `json:"err_counts"`
+	Times     *sketch.Sketch   `json:"times"`
+	Buckets   []bucketSnapshot `json:"buckets,omitempty"` // of its window
+}
+
+type bucketSnapshot struct {
+	Second    int64          `json:"second"`
+	Counts    float64        `json:"counts"`
+	ErrCounts float64        `json:"err_counts"`
+	Times     *sketch.Sketch `json:"times"`
+}
+
+// OpenStore opens (or creates) the store of a stage of a release
+func OpenStore(dataDir, releaseID, stageName string) (*Store, error) {
+	path := filepath.Join(dataDir, "metrics", url.PathEscape(releaseID), url.PathEscape(stageName)+".wal")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create the metric store directory: %v", err)
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the metric store: %v", err)
+	}
+	s := &Store{Path: path, file: file, writer: bufio.NewWriterSize(file, 64*1024), stop: make(chan struct{}), stopped: make(chan struct{})}
+	go s.flushPeriodically()
+	return s, nil
+}
+
+// Append writes a received payload to the store
+func (s *Store) Append(payload MetricUpdatePayload, at time.Time) error {
+	return s.write(storeRecord{At: at.UnixNano(), Payload: &payload})
+}
+
+// AppendBatch writes the samples of a received batch to the store as one record. Their timestamps must be the times they are aggregated at
+func (s *Store) AppendBatch(batch *MetricBatch, at time.Time) error {
+	return s.write(storeRecord{At: at.UnixNano(), Batch: batch})
+}
+
+// AppendReset writes a reset of the metrics to the store. As the metrics before it are dropped when replaying, the store is compacted to the reset.
+// The step is the one of a gradual stage the metrics after the reset are of
+func (s *Store) AppendReset(at time.Time, step int) error {
+	return s.compact(storeRecord{At: at.UnixNano(), Reset: true, Step: step})
+}
+
+func (s *Store) write(record storeRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, err = s.writer.Write(append(line, '\n'))
+	s.records++
+	return err
+}
+
+// needsCompaction tells if the store has storeCompactAfter records since its last compaction
+func (s *Store) needsCompaction() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.records >= storeCompactAfter
+}
+
+// compact replaces the records of the store (including the buffered ones) with a reset or a snapshot, which drops them anyway when replaying.
+// The compacted store is written to a temporary file and renamed, so a crash never leaves it partial
+func (s *Store) compact(record storeRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	tmp, err := os.CreateTemp(filepath.Dir(s.Path), filepath.Base(s.Path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to compact the metric store: %v", err)
+	}
+	if _, err = tmp.Write(append(line, '\n')); err == nil {
+		if err = tmp.Chmod(0644); err == nil {
+			err = tmp.Sync()
+		}
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.Path)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to compact the metric store: %v", err)
+	}
+	// the records are appended to the compacted file from now on
+	s.file.Close()
+	s.file = tmp
+	s.writer.Reset(tmp)
+	s.records = 1
+	return nil
+}
+
+// flushPeriodically flushes the buffered records every storeFlushInterval, until the store is closed
+func (s *Store) flushPeriodically() {
+	defer close(s.stopped)
+	ticker := time.NewTicker(storeFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.mutex.Lock()
+			err := s.writer.Flush()
+			s.mutex.Unlock()
+			if err != nil {
+				log.Warnf("Failed to flush the metric store '%s': %v", s.Path, err)
+			}
+		}
+	}
+}
+
+// stopFlushing stops the periodic flush, once
+func (s *Store) stopFlushing() {
+	s.closing.Do(func() {
+		close(s.stop)
+		<-s.stopped
+	})
+}
+
+// replay calls 'apply' on each record of the store in order, and returns the number of replayed records.
+// A record which can't be decoded (e.g. partially written before a crash) is skipped
+func (s *Store) replay(apply func(record storeRecord)) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.writer.Flush(); err != nil {
+		return 0, err
+	}
+
+	file, err := os.Open(s.Path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	replayed := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var record storeRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil || (!record.Reset && record.Payload == nil && record.Batch == nil && record.Snapshot == nil) {
+			log.Warnf("Skipping a corrupted record in the metric store '%s'", s.Path)
+			continue
+		}
+		apply(record)
+		replayed++
+	}
+	s.records = replayed
+	return replayed, scanner.Err()
+}
+
+// Close flushes, syncs and closes the store, keeping its file
+func (s *Store) Close() error {
+	s.stopFlushing()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.writer.Flush(); err != nil {
+		log.Warnf("Failed to flush the metric store '%s': %v", s.Path, err)
+	}
+	if err := s.file.Sync(); err != nil {
+		log.Warnf("Failed to sync the metric store '%s': %v", s.Path, err)
+	}
+	return s.file.Close()
+}
+
+// Remove closes the store and deletes its file, e.g. after the stage result is sent to the parent
+func (s *Store) Remove() error {
+	s.stopFlushing()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.file.Close()
+	if err := os.Remove(s.Path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	// remove the release's directory if it was the last stage
+	_ = os.Remove(filepath.Dir(s.Path))
+	return nil
+}
@@ -0,0 +1,199 @@
+package metric_aggregator
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestMain(m *testing.M) {
+	log.SetLevel(log.WarnLevel)
+	os.Exit(m.Run())
+}
+
+var variantNames = []string{"base_version", "new_version"}
+
+// call returns the metrics the proxy pushes for a call of f<n>
+func call(f string, responseTime float64) []Metric {
+	return []Metric{{MetricName: "call_count", Value: 1}, {MetricName: "proxy_time", Value: 1},
+		{MetricName: f + "_count", Value: 1}, {MetricName: f + "_time", Value: responseTime}}
+}
+
+// lines returns the records written to the file of a store
+func lines(t *testing.T, store *Store) []string {
+	t.Helper()
+	data, err := os.ReadFile(store.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Fields(string(data))
+}
+
+func TestStoreRestoresBatches(t *testing.T) {
+	dataDir := t.TempDir()
+	store, err := OpenStore(dataDir, "r1", "ab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	agg := NewMetricAggregator("sieve", "ab", variantNames)
+	agg.Store = store
+	at := time.Now().Add(-time.Minute)
+	agg.ReceiveBatch(&MetricBatch{Program: "sieve", Samples: []MetricSample{
+		{Timestamp: at.UnixMilli(), Metrics: call("f1", 10)},
+		{Metrics: call("f2", 20)},
+		{Metrics: call("f2", 30)},
+	}})
+	agg.Receive(MetricUpdatePayload{Program: "sieve", Metrics: call("f1", 40)})
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if records := lines(t, store); len(records) != 2 {
+		t.Errorf("%d records, want one per push: %v", len(records), records)
+	}
+
+	store, err = OpenStore(dataDir, "r1", "ab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Remove()
+	restored := NewMetricAggregator("sieve", "ab", variantNames)
+	if err := restored.Restore(store); err != nil {
+		t.Fatal(err)
+	}
+	if restored.Calls() != 4 || restored.VariantCalls(0) != 2 || restored.VariantCalls(1) != 2 {
+		t.Errorf("restored %v calls (%v, %v), want 4 (2, 2)", restored.Calls(), restored.VariantCalls(0), restored.VariantCalls(1))
+	}
+	if got, want := restored.Variants[1].Times.Mean(), agg.Variants[1].Times.Mean(); got != want {
+		t.Errorf("restored a mean response time of %v, want %v", got, want)
+	}
+	// the sample of a minute ago is in its own second
+	if counts, _, _ := restored.Variants[0].window.since(at.Add(time.Second)); counts != 1 {
+		t.Errorf("%v calls of f1 since the old sample, want 1", counts)
+	}
+}
+
+func TestStoreFlushesPeriodically(t *testing.T) {
+	store, err := OpenStore(t.TempDir(), "r1", "ab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Remove()
+	if err := store.AppendBatch(&MetricBatch{Program: "sieve", Samples: []MetricSample{{Metrics: call("f1", 10)}}}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if records := lines(t, store); len(records) != 0 {
+		t.Errorf("%d records before the flush, want them buffered", len(records))
+	}
+	time.Sleep(storeFlushInterval + 500*time.Millisecond)
+	if records := lines(t, store); len(records) != 1 {
+		t.Errorf("%d records after the flush, want 1", len(records))
+	}
+}
+
+func TestStoreSkipsCorruptedRecords(t *testing.T) {
+	store, err := OpenStore(t.TempDir(), "r1", "ab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Remove()
+	store.Append(MetricUpdatePayload{Program: "sieve", Metrics: call("f1", 10)}, time.Now())
+	store.mutex.Lock()
+	store.writer.WriteString(`{"at": 1, "payl` + "\n") // partially written before a crash
+	store.mutex.Unlock()
+	store.Append(MetricUpdatePayload{Program: "sieve", Metrics: call("f2", 10)}, time.Now())
+
+	agg := NewMetricAggregator("sieve", "ab", variantNames)
+	if err := agg.Restore(store); err != nil {
+		t.Fatal(err)
+	}
+	if agg.Calls() != 2 {
+		t.Errorf("restored %v calls, want 2", agg.Calls())
+	}
+}
+
+func TestStoreCompactsOnReset(t *testing.T) {
+	dataDir := t.TempDir()
+	store, err := OpenStore(dataDir, "r1", "gradual")
+	if err != nil {
+		t.Fatal(err)
+	}
+	agg := NewMetricAggregator("sieve", "gradual", variantNames)
+	agg.Store = store
+	for i := 0; i < 10; i++ {
+		agg.Receive(MetricUpdatePayload{Program: "sieve", Metrics: call("f2", 10)})
+	}
+	agg.ResetStep(1)
+	if records := lines(t, store); len(records) != 1 {
+		t.Errorf("%d records after the reset, want only the reset", len(records))
+	}
+	agg.Receive(MetricUpdatePayload{Program: "sieve", Metrics: call("f2", 10)})
+	store.Close()
+
+	store, err = OpenStore(dataDir, "r1", "gradual")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Remove()
+	restored := NewMetricAggregator("sieve", "gradual", variantNames)
+	if err := restored.Restore(store); err != nil {
+		t.Fatal(err)
+	}
+	if restored.Step != 1 || restored.Calls() != 1 {
+		t.Errorf("restored %v calls of step %d, want 1 call of step 2", restored.Calls(), restored.Step+1)
+	}
+}
+
+func TestStoreCompactsToSnapshot(t *testing.T) {
+	dataDir := t.TempDir()
+	store, err := OpenStore(dataDir, "r1", "ab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	agg := NewMetricAggregator("sieve", "ab", variantNames)
+	agg.Store = store
+	now := time.Now()
+	for i := 0; i < storeCompactAfter+10; i++ {
+		f := "f1"
+		if i%3 == 0 {
+			f = "f2"
+		}
+		metrics := call(f, float64(1+i%500))
+		if i%7 == 0 {
+			metrics = append(metrics, Metric{MetricName: f + "_error_count", Value: 1})
+		}
+		at := now.Add(-time.Duration(i%120) * time.Second) // spread over the window
+		agg.ReceiveBatch(&MetricBatch{Program: "sieve", Samples: []MetricSample{{Timestamp: at.UnixMilli(), Metrics: metrics}}})
+	}
+	store.Close()
+	if records := lines(t, store); len(records) > 11 {
+		t.Errorf("%d records, want the store compacted to a snapshot and the records after it", len(records))
+	}
+
+	store, err = OpenStore(dataDir, "r1", "ab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Remove()
+	restored := NewMetricAggregator("sieve", "ab", variantNames)
+	if err := restored.Restore(store); err != nil {
+		t.Fatal(err)
+	}
+	if restored.Calls() != agg.Calls() || restored.VariantCalls(1) != agg.VariantCalls(1) || restored.VariantErrors(1) != agg.VariantErrors(1) {
+		t.Errorf("restored %v calls (%v of f2, %v errors), want %v (%v, %v)", restored.Calls(), restored.VariantCalls(1),
+			restored.VariantErrors(1), agg.Calls(), agg.VariantCalls(1), agg.VariantErrors(1))
+	}
+	for i := range variantNames {
+		if got, want := restored.Variants[i].Times.Quantile(0.95), agg.Variants[i].Times.Quantile(0.95); got != want {
+			t.Errorf("f%d: restored P95 %v, want %v", i+1, got, want)
+		}
+		since := now.Add(-time.Minute)
+		gotCounts, gotErrors, gotTimes := restored.Variants[i].window.since(since)
+		wantCounts, wantErrors, wantTimes := agg.Variants[i].window.since(since)
+		if gotCounts != wantCounts || gotErrors != wantErrors || gotTimes.Quantile(0.5) != wantTimes.Quantile(0.5) {
+			t.Errorf("f%d: restored %v calls and %v errors in the last minute, want %v and %v", i+1, gotCounts, gotErrors, wantCounts, wantErrors)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package metric_aggregator
+
+import (
+	"sort"
+	"time"
+	"umbilical-choir-core/internal/pkg/sketch"
+)
+
+// the bounds of the kept metrics, so the memory stays steady on long stages (e.g. WaitForSignal stages on a Raspberry Pi)
+const (
+	DefaultRetention = 5 * time.Minute // how long the per-second buckets are kept, if not set
+	bucketMaxBins    = 128             // sketch bins of each second. the lowest response times are collapsed first
+)
+
+// bucket holds the metrics of a tested version received in one second
+type bucket struct {
+	second    int64 // unix time
+	counts    float64
+	errCounts float64
+	times     *sketch.Sketch
+}
+
+// window is a ring buffer of per-second buckets. The bucket of an expired second is recycled, so its size never grows
+type window struct {
+	buckets []bucket
+}
+
+func newWindow(retention time.Duration) *window {
+	n := int((retention + time.Second - 1) / time.Second)
+	return &window{buckets: make([]bucket, n+1)} // +1 for the current (partial) second
+}
+
+// at returns the bucket of the given time
+func (w *window) at(t time.Time) *bucket {
+	second := t.Unix()
+	b := &w.buckets[second%int64(len(w.buckets))]
+	if b.times == nil {
+		b.times = sketch.NewWithAccuracy(sketch.DefaultRelativeAccuracy, bucketMaxBins)
+	}
+	if b.second != second {
+		b.second, b.counts, b.errCounts = second, 0, 0
+		b.times.Reset()
+	}
+	return b
+}
+
+// since merges the buckets from the second of 'since' on
+func (w *window) since(since time.Time) (float64, float64, *sketch.Sketch) {
+	var counts, errCounts float64
+	times := sketch.New()
+	for i := range w.buckets {
+		b := &w.buckets[i]
+		if b.times == nil || b.second < since.Unix() {
+			continue
+		}
+		counts += b.counts
+		errCounts += b.errCounts
+		_ = times.Merge(b.times) // same accuracy
+	}
+	return counts, errCounts, times
+}
+
+// snapshot returns the buckets of the window, e.g. to compact the store. A nil window has none
+func (w *window) snapshot() []bucketSnapshot {
+	if w == nil {
+		return nil
+	}
+	var buckets []bucketSnapshot
+	for i := range w.buckets {
+		b := &w.buckets[i]
+		if b.times == nil {
+			continue
+		}
+		buckets = append(buckets, bucketSnapshot{Second: b.second, Counts: b.counts, ErrCounts: b.errCounts, Times: b.times})
+	}
+	return buckets
+}
+
+// restore fills the window with the buckets of a snapshot, in their order, so the expired ones are recycled
+func (w *window) restore(buckets []bucketSnapshot) {
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].Second < buckets[j].Second })
+	for _, snapshot := range buckets {
+		b := w.at(time.Unix(snapshot.Second, 0))
+		b.counts += snapshot.Counts
+		b.errCounts += snapshot.ErrCounts
+		_ = b.times.Merge(snapshot.Times) // same accuracy
+	}
+}
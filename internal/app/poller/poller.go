@@ -3,10 +3,13 @@ package poller
 import (
 	"archive/zip"
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/paulmach/orb"
 	"github.com/paulmach/orb/geojson"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	log "github.com/sirupsen/logrus"
 	"io"
 	"net/http"
@@ -15,6 +18,7 @@ import (
 	"strings"
 	"time"
 	"umbilical-choir-core/internal/app/config"
+	Tracing "umbilical-choir-core/internal/app/tracing"
 )
 
 type PollRequest struct {
@@ -30,7 +34,12 @@ type PollResponse struct {
 
 const PollInterval = 5 * time.Second
 
-func PollParent(host, port, id string, serviceArea orb.Polygon) PollResponse {
+var pollFailures = promauto.NewCounter(prometheus.CounterOpts{Name: "uc_agent_poll_failures_total", Help: "Failed polls of the parent."})
+
+// PollParent polls the parent until it responds, or returns the context's error if it is cancelled first
+func PollParent(ctx context.Context, host, port, id string, serviceArea orb.Polygon) (_ PollResponse, err error) {
+	ctx, span := Tracing.Start(ctx, "PollParent", Tracing.AgentID.String(id))
+	defer func() { Tracing.End(span, err) }()
 	url := fmt.Sprintf("http://%s:%s/poll", host, port)
 	log.Infof("Polling parent at %s", url)
 
@@ -40,39 +49,59 @@ func PollParent(host, port, id string, serviceArea orb.Polygon) PollResponse {
 		"geographic_area":    geojson.NewGeometry(serviceArea),
 	}
 
+	jsonData, err := json.Marshal(request)
+	if err != nil {
+		return PollResponse{}, fmt.Errorf("failed to marshal request: %v", err)
+	}
 	for { //retry
-		jsonData, err := json.Marshal(request)
-		if err != nil {
-			log.Errorf("Failed to marshal request: %v", err)
-			continue
-		}
 		//log.Debugf("HTTP request payload: %s", string(jsonData))
-
-		resp, err := http.Post(url, "application/json", bytes.NewBuffer(jsonData))
-		if err != nil {
-			log.Errorf("Failed to poll parent: %v", err)
-			time.Sleep(PollInterval)
-			continue
+		response, err := pollParentOnce(ctx, url, jsonData)
+		if err == nil {
+			if response.NewReleaseID != "" {
+				span.SetAttributes(Tracing.ReleaseID.String(response.NewReleaseID))
+			}
+			return response, nil
 		}
-		defer resp.Body.Close()
-
-		var response PollResponse
-		if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
-			log.Errorf("Failed to decode response (%v): %v", resp.StatusCode, err)
-			log.Errorf("Response: %v", resp)
-			time.Sleep(PollInterval)
-			continue
+		if ctx.Err() != nil {
+			return PollResponse{}, ctx.Err()
+		}
+		log.Errorf("Failed to poll parent: %v", err)
+		pollFailures.Inc()
+		span.RecordError(err) // retried
+		select {
+		case <-ctx.Done():
+			return PollResponse{}, ctx.Err()
+		case <-time.After(PollInterval):
 		}
-
-		return response
 		//time.Sleep(PollInterval) // Poll periodically
 	}
 }
 
+func pollParentOnce(ctx context.Context, url string, jsonData []byte) (PollResponse, error) {
+	var response PollResponse
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return response, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return response, err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return response, fmt.Errorf("failed to decode response (%v): %v", resp.StatusCode, err)
+	}
+	return response, nil
+}
+
 // DownloadRelease downloads the release file from the parent, where enpoint is given by the parent
-func DownloadRelease(cfg *config.Config, id, releaseID string) (string, error) {
+func DownloadRelease(ctx context.Context, cfg *config.Config, id, releaseID string) (_ string, err error) {
+	ctx, span := Tracing.Start(ctx, "DownloadRelease", Tracing.ReleaseID.String(releaseID))
+	defer func() { Tracing.End(span, err) }()
 	url := fmt.Sprintf("http://%s:%s/release?childID=%s&releaseID=%s", cfg.Parent.Host, cfg.Parent.Port, id, releaseID)
-	resp, err := http.Get(url)
+	resp, err := get(ctx, url)
 	if err != nil {
 		return "", fmt.Errorf("failed to download release: %v", err)
 	}
@@ -112,9 +141,11 @@ func DownloadRelease(cfg *config.Config, id, releaseID string) (string, error) {
 
 // TODO check if function subdirectories defined in release.yml exist
 // DownloadReleaseFunctions downloads the functions zip file from the parent to "fns" (name of the zip file), where id is defined in release.yml
-func DownloadReleaseFunctions(cfg *config.Config, releaseID string) (string, error) {
+func DownloadReleaseFunctions(ctx context.Context, cfg *config.Config, releaseID string) (_ string, err error) {
+	ctx, span := Tracing.Start(ctx, "DownloadReleaseFunctions", Tracing.ReleaseID.String(releaseID))
+	defer func() { Tracing.End(span, err) }()
 	url := fmt.Sprintf("http://%s:%s/release/functions/%s", cfg.Parent.Host, cfg.Parent.Port, releaseID)
-	resp, err := http.Get(url)
+	resp, err := get(ctx, url)
 	if err != nil {
 		return "", fmt.Errorf("failed to download release's functions: %v", err)
 	}
@@ -191,7 +222,7 @@ func DownloadReleaseFunctions(cfg *config.Config, releaseID string) (string, err
 }
 
 // PollForSignal polls for a signal to end a stage test. NOTE it runs on a separate goroutine
-func PollForSignal(host, port, id, strategyID, stageName string) (bool, error) {
+func PollForSignal(ctx context.Context, host, port, id, strategyID, stageName string) (bool, error) {
 	url := fmt.Sprintf("http://%s:%s/end_stage", host, port)
 	request := map[string]interface{}{
 		"id":          id,
@@ -205,7 +236,12 @@ func PollForSignal(host, port, id, strategyID, stageName string) (bool, error) {
 		return false, err
 	}
 
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		log.Errorf("Failed to poll for signal: %v", err)
 		return false, err
@@ -229,3 +265,11 @@ func PollForSignal(host, port, id, strategyID, stageName string) (bool, error) {
 
 	return response.EndTest, nil
 }
+
+func get(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return http.DefaultClient.Do(req)
+}
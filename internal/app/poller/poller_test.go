@@ -0,0 +1,118 @@
+package poller
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"umbilical-choir-core/internal/app/config"
+	"umbilical-choir-core/internal/app/fakeparent"
+)
+
+func TestMain(m *testing.M) {
+	log.SetLevel(log.WarnLevel)
+	os.Exit(m.Run())
+}
+
+func TestPollParent(t *testing.T) {
+	parent := fakeparent.New()
+	defer parent.Close()
+	parent.AddRelease(fakeparent.Release{ID: "r1", Strategy: []byte("id: r1\n")})
+	ctx := context.Background()
+
+	response, err := PollParent(ctx, parent.Host, parent.Port, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.ID == "" || response.NewReleaseID != "r1" {
+		t.Fatalf("a new agent got ID '%s' and release '%s', want an ID and 'r1'", response.ID, response.NewReleaseID)
+	}
+	again, err := PollParent(ctx, parent.Host, parent.Port, response.ID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.ID != response.ID || again.NewReleaseID != "" {
+		t.Errorf("the next poll got ID '%s' and release '%s', want '%s' and no release", again.ID, again.NewReleaseID, response.ID)
+	}
+	if polls := parent.Polls(); len(polls) != 2 || polls[1].ID != response.ID || polls[1].NumberOfChildren != 0 {
+		t.Errorf("the parent received %+v", polls)
+	}
+}
+
+func TestPollParentCancelled(t *testing.T) {
+	parent := fakeparent.New()
+	parent.Close() // unreachable, retried until cancelled
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := PollParent(ctx, parent.Host, parent.Port, "agent-1", nil); err != context.DeadlineExceeded {
+		t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestDownloadRelease(t *testing.T) {
+	dir := t.TempDir()
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil { // the release and its functions are saved to the working directory
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err := os.MkdirAll(filepath.Join("fns", "sieve"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join("fns", "sieve", "index.js"), []byte("module.exports = {}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	functions, err := fakeparent.ZipDir("fns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.RemoveAll("fns") // unzipped again by DownloadReleaseFunctions
+
+	parent := fakeparent.New()
+	defer parent.Close()
+	strategy := []byte("id: r1\nname: test-release\n")
+	parent.AddRelease(fakeparent.Release{ID: "r1", Strategy: strategy, Functions: functions})
+	cfg := &config.Config{}
+	cfg.Parent.Host, cfg.Parent.Port = parent.Host, parent.Port
+	ctx := context.Background()
+
+	path, err := DownloadRelease(ctx, cfg, "agent-1", "r1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != string(strategy) {
+		t.Errorf("the downloaded release is '%s' (%v), want '%s'", data, err, strategy)
+	}
+	if _, err := DownloadReleaseFunctions(ctx, cfg, "r1"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join("fns", "sieve", "index.js")); err != nil || string(data) != "module.exports = {}" {
+		t.Errorf("the unzipped function is '%s' (%v)", data, err)
+	}
+	if _, err := DownloadRelease(ctx, cfg, "agent-1", "unknown"); err == nil {
+		t.Error("downloaded an unknown release")
+	}
+}
+
+func TestPollForSignal(t *testing.T) {
+	parent := fakeparent.New()
+	defer parent.Close()
+	ctx := context.Background()
+
+	end, err := PollForSignal(ctx, parent.Host, parent.Port, "agent-1", "r1", "wait")
+	if err != nil || end {
+		t.Fatalf("got %v (%v) before the end was signaled, want false", end, err)
+	}
+	parent.EndStageAfter("wait", 0)
+	end, err = PollForSignal(ctx, parent.Host, parent.Port, "agent-1", "r1", "wait")
+	if err != nil || !end {
+		t.Fatalf("got %v (%v) after the end was signaled, want true", end, err)
+	}
+	want := fakeparent.EndStagePoll{ID: "agent-1", StrategyID: "r1", StageName: "wait"}
+	if polls := parent.EndStagePolls(); len(polls) != 2 || polls[0] != want {
+		t.Errorf("the parent received %+v, want 2 of %+v", polls, want)
+	}
+}
@@ -1,15 +1,21 @@
 package strategy
 
 import (
+	"errors"
 	"fmt"
 	log "github.com/sirupsen/logrus"
+	"math"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
+// ErrInvalidThreshold is returned for a threshold which can't be parsed or checked, e.g. "<abc"
+var ErrInvalidThreshold = errors.New("invalid threshold")
+
 // ReleaseStrategy nested struct to hold the parsed YAML strategy
 type ReleaseStrategy struct {
 	ID        string     `yaml:"id"`
@@ -18,15 +24,18 @@ type ReleaseStrategy struct {
 	Functions []Function `yaml:"functions"`
 	Stages    []Stage    `yaml:"stages"`
 	Rollback  Rollback   `yaml:"rollback"`
+	Path      string     `yaml:"-"` // the file it was loaded from
 }
 
 type Function struct {
-	Name        string  `yaml:"name"`
-	BaseVersion Version `yaml:"base_version"`
-	NewVersion  Version `yaml:"new_version"`
+	Name        string    `yaml:"name"`
+	BaseVersion Version   `yaml:"base_version"`
+	NewVersion  Version   `yaml:"new_version"`
+	Versions    []Version `yaml:"versions,omitempty"` // additional named versions, e.g. competing candidates to test against base_version
 }
 
 type Version struct {
+	Name string `yaml:"name,omitempty"` // only for the additional versions
 	Path string `yaml:"path"`
 	Env  string `yaml:"env"` // TODO: add entrypoint and associated main file
 }
@@ -36,6 +45,10 @@ type Stage struct {
 	Type              string            `yaml:"type"`
 	FuncName          string            `yaml:"func_name"`
 	Variants          []Variant         `yaml:"variants"`
+	TrafficPercentage int               `yaml:"trafficPercentage,omitempty"` // only Canary. share of the traffic sent to new_version
+	Steps             []Step            `yaml:"steps,omitempty"`             // only Gradual. traffic ramp of new_version
+	StatisticalTest   *StatisticalTest  `yaml:"statistical_test,omitempty"`  // optional statistical decision mode
+	Guardrails        []Guardrail       `yaml:"guardrails,omitempty"`        // checked on every poll, a violation rolls back immediately
 	MetricsConditions []MetricCondition `yaml:"metrics_conditions"`
 	EndConditions     []EndCondition    `yaml:"end_conditions"`
 	EndAction         EndAction         `yaml:"end_action"`
@@ -46,17 +59,56 @@ type Variant struct {
 	TrafficPercentage int    `yaml:"trafficPercentage"`
 }
 
+// Step is a step of a Gradual stage. It falls back to the stage's metrics and end conditions if it doesn't define its own
+type Step struct {
+	TrafficPercentage int               `yaml:"trafficPercentage"`
+	MetricsConditions []MetricCondition `yaml:"metrics_conditions,omitempty"`
+	EndConditions     []EndCondition    `yaml:"end_conditions,omitempty"`
+}
+
+// StatisticalTest compares each tested version with the base version by a Mann-Whitney U test (response times) and
+// a two-proportion z-test (error rates). A version which is significantly worse than the base version fails the stage
+type StatisticalTest struct {
+	Confidence float64 `yaml:"confidence"`           // confidence level, e.g. 0.95
+	MinSamples int     `yaml:"minSamples,omitempty"` // minimum calls of each version to reach a verdict, otherwise the version fails
+}
+
+const (
+	defaultConfidence = 0.95
+	defaultMinSamples = 10
+)
+
+// Guardrail aborts a stage as soon as its threshold is met by a tested version over the last 'window',
+// e.g. "abort if the error rate of new_version is >0.5 over the last 30s"
+type Guardrail struct {
+	Name        string `yaml:"name"`                  // errorRate or responseTime
+	Threshold   string `yaml:"threshold"`             // the violation, e.g. ">0.5"
+	CompareWith string `yaml:"compareWith,omitempty"` // only responseTime, e.g. "P99"
+	Window      string `yaml:"window,omitempty"`      // e.g. "30s". the whole stage if not set
+	Variant     string `yaml:"variant,omitempty"`     // the watched version. all the versions tested against the base version if not set
+}
+
 type MetricCondition struct {
 	Name        string `yaml:"name"`
 	Threshold   string `yaml:"threshold"`
 	CompareWith string `yaml:"compareWith,omitempty"`
 }
 
+// EndCondition is minDuration or minCalls, which the stage waits for, or a limit which ends the stage before they are met:
+// maxDuration (e.g. "2h" since the stage started) or maxIdle (e.g. "10m" with no calls). A limit's outcome is one of the Outcome* values
 type EndCondition struct {
 	Name      string `yaml:"name"`
 	Threshold string `yaml:"threshold"`
+	Outcome   string `yaml:"outcome,omitempty"` // only maxDuration and maxIdle. OutcomeFail if not set
 }
 
+// the outcomes of a stage ended by a maxDuration or maxIdle end condition
+const (
+	OutcomeFail               = "fail"               // the stage fails, and runs its onFailure action
+	OutcomeRollback           = "rollback"           // the function is rolled back, regardless of the end action
+	OutcomeSucceedIfMetricsOk = "succeedIfMetricsOk" // the stage is judged by the metrics collected so far
+)
+
 type EndAction struct {
 	OnSuccess string `yaml:"onSuccess"`
 	OnFailure string `yaml:"onFailure"`
@@ -82,6 +134,8 @@ func LoadStrategy(filePath string) (*ReleaseStrategy, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error unmarshalling YAML data: %v", err)
 	}
+	releaseStrategy.Path = filePath
+	releaseStrategy.normalizeStages()
 
 	if errV := releaseStrategy.validateTrafficPercentage(); errV != nil {
 		return nil, errV
@@ -104,6 +158,36 @@ func LoadStrategy(filePath string) (*ReleaseStrategy, error) {
 	if errV7 := releaseStrategy.validateStageFunctionNames(); errV7 != nil {
 		return nil, errV7
 	}
+	if errV8 := releaseStrategy.validateCanaryStages(); errV8 != nil {
+		return nil, errV8
+	}
+	if errV9 := releaseStrategy.validateGradualStages(); errV9 != nil {
+		return nil, errV9
+	}
+	if errV10 := releaseStrategy.validateStageTypes(); errV10 != nil {
+		return nil, errV10
+	}
+	if errV11 := releaseStrategy.validateStageGraph(); errV11 != nil {
+		return nil, errV11
+	}
+	if errV12 := releaseStrategy.validateVersionNames(); errV12 != nil {
+		return nil, errV12
+	}
+	if errV13 := releaseStrategy.validateStageVariants(); errV13 != nil {
+		return nil, errV13
+	}
+	if errV14 := releaseStrategy.validateStatisticalTests(); errV14 != nil {
+		return nil, errV14
+	}
+	if errV15 := releaseStrategy.validateGuardrails(); errV15 != nil {
+		return nil, errV15
+	}
+	if errV16 := releaseStrategy.validateEndConditions(); errV16 != nil {
+		return nil, errV16
+	}
+	if errV17 := releaseStrategy.validateRelativeThresholds(); errV17 != nil {
+		return nil, errV17
+	}
 
 	log.Infof("using release strategy '%v' (%v). It has following stages: %v", releaseStrategy.Name, releaseStrategy.Type, mapStageNames(releaseStrategy.Stages))
 	log.Debugf("dump: %v", releaseStrategy)
@@ -128,37 +212,105 @@ func (f *Function) GetVersionByName(name string) (*Version, error) {
 	case "NewVersion", "new_version":
 		return &f.NewVersion, nil
 	default:
+		for i := range f.Versions {
+			if f.Versions[i].Name == name {
+				return &f.Versions[i], nil
+			}
+		}
 		return nil, fmt.Errorf("version '%s' not found in function '%s'", name, f.Name)
 	}
 }
 
-func (mc *MetricCondition) IsThresholdMet(actual float64) bool {
+// VersionNames returns the names of all versions of the function, starting with "base_version" and "new_version"
+func (f *Function) VersionNames() []string {
+	names := []string{"base_version", "new_version"}
+	for _, version := range f.Versions {
+		names = append(names, version.Name)
+	}
+	return names
+}
+
+// IsThresholdMet checks the actual value against the threshold. It returns ErrInvalidThreshold if it can't be checked
+func (mc *MetricCondition) IsThresholdMet(actual float64) (bool, error) {
 	if len(mc.Threshold) < 2 {
-		log.Fatalf("invalid threshold format: %s", mc.Threshold)
-		//return false, fmt.Errorf("invalid threshold format: %s", mc.Threshold)
+		return false, fmt.Errorf("%w: %s", ErrInvalidThreshold, mc.Threshold)
+	}
+	if mc.IsRelative() {
+		return false, fmt.Errorf("%w: '%s' is relative to the base version, but no base value is given", ErrInvalidThreshold, mc.Threshold)
 	}
 	operator, thrVal, errP := parseComparisonString(mc.Threshold)
 	if errP != nil {
-		log.Fatalf("Error parsing comparison string: %v", errP)
-		//return false, errP
+		return false, fmt.Errorf("%w: %v", ErrInvalidThreshold, errP)
+	}
+	return compare(operator, actual, thrVal)
+}
+
+// IsRelative checks if the threshold is relative to the base version (control), e.g. "<=base*1.1"
+func (mc *MetricCondition) IsRelative() bool {
+	_, rest, err := splitOperator(mc.Threshold)
+	return err == nil && strings.HasPrefix(strings.TrimSpace(rest), relativeThresholdPrefix)
+}
+
+// IsThresholdMetAgainst checks the actual value against the threshold, where a relative threshold is computed from the base value
+func (mc *MetricCondition) IsThresholdMetAgainst(actual, base float64) (bool, error) {
+	if !mc.IsRelative() {
+		return mc.IsThresholdMet(actual)
+	}
+	operator, factor, offset, errP := parseRelativeComparisonString(mc.Threshold)
+	if errP != nil {
+		return false, fmt.Errorf("%w: %v", ErrInvalidThreshold, errP)
 	}
+	return compare(operator, actual, base*factor+offset)
+}
 
-	switch operator {
-	case "<":
-		return actual < thrVal
-	case "<=":
-		return actual <= thrVal
-	case ">":
-		return actual > thrVal
-	case ">=":
-		return actual >= thrVal
-	case "=":
-		return actual == thrVal
-	default:
-		log.Fatalf("invalid threshold operator: %s", operator)
-		//return false, fmt.Errorf("invalid threshold operator: %s", operator)
-		return false // dummy
+// validateThreshold checks if the threshold is a valid absolute or relative comparison string
+func (mc *MetricCondition) validateThreshold() error {
+	if mc.IsRelative() {
+		_, _, _, err := parseRelativeComparisonString(mc.Threshold)
+		return err
 	}
+	_, _, err := parseComparisonString(mc.Threshold)
+	return err
+}
+
+// ThresholdValue returns the threshold value, where a relative threshold is computed from the base value
+func (mc *MetricCondition) ThresholdValue(base float64) float64 {
+	if mc.IsRelative() {
+		_, factor, offset, _ := parseRelativeComparisonString(mc.Threshold)
+		return base*factor + offset
+	}
+	_, thrVal, _ := parseComparisonString(mc.Threshold)
+	return thrVal
+}
+
+// AtStep returns the stage as it runs during its i-th step (only Gradual): new_version gets the step's traffic, and base_version the rest
+func (s Stage) AtStep(i int) Stage {
+	step := s.Steps[i]
+	s.Variants = []Variant{
+		{Name: "base_version", TrafficPercentage: 100 - step.TrafficPercentage},
+		{Name: "new_version", TrafficPercentage: step.TrafficPercentage},
+	}
+	if len(step.MetricsConditions) > 0 {
+		s.MetricsConditions = step.MetricsConditions
+	}
+	if len(step.EndConditions) > 0 {
+		s.EndConditions = step.EndConditions
+	}
+	return s
+}
+
+// Condition returns the guardrail as a metric condition, which is met when the guardrail is violated
+func (g *Guardrail) Condition() MetricCondition {
+	return MetricCondition{Name: g.Name, Threshold: g.Threshold, CompareWith: g.CompareWith}
+}
+
+// WindowDuration returns the guardrail's window, or 0 for the whole stage
+func (g *Guardrail) WindowDuration() time.Duration {
+	window, err := time.ParseDuration(g.Window)
+	if err != nil {
+		return 0
+	}
+	return window
 }
 
 func (rs *ReleaseStrategy) GetStageByName(name string) (*Stage, error) {
@@ -180,8 +332,123 @@ func mapStageNames(stages []Stage) []string {
 	return names
 }
 
+// normalizeStages fills in the variants of the stage types that don't list them explicitly,
+// and names base_version and new_version the same in all the variants and guardrails (see canonicalVersionName)
+func (rs *ReleaseStrategy) normalizeStages() {
+	for i := range rs.Stages {
+		stage := &rs.Stages[i]
+		for j := range stage.Variants {
+			stage.Variants[j].Name = canonicalVersionName(stage.Variants[j].Name)
+		}
+		for j := range stage.Guardrails {
+			stage.Guardrails[j].Variant = canonicalVersionName(stage.Guardrails[j].Variant)
+		}
+		if stage.Type == "Canary" && len(stage.Variants) == 0 {
+			stage.Variants = []Variant{
+				{Name: "base_version", TrafficPercentage: 100 - stage.TrafficPercentage},
+				{Name: "new_version", TrafficPercentage: stage.TrafficPercentage},
+			}
+		}
+		if stage.StatisticalTest != nil {
+			if stage.StatisticalTest.Confidence == 0 {
+				stage.StatisticalTest.Confidence = defaultConfidence
+			}
+			if stage.StatisticalTest.MinSamples == 0 {
+				stage.StatisticalTest.MinSamples = defaultMinSamples
+			}
+		}
+		if stage.Type == "Gradual" && len(stage.Variants) == 0 && len(stage.Steps) > 0 {
+			stage.Variants = stage.AtStep(0).Variants
+		}
+	}
+}
+
+// canonicalVersionName returns base_version and new_version for their aliases (BaseVersion and NewVersion), and other names as is
+func canonicalVersionName(name string) string {
+	switch name {
+	case "BaseVersion":
+		return "base_version"
+	case "NewVersion":
+		return "new_version"
+	}
+	return name
+}
+
+// baseTraffic returns the share of the traffic sent to base_version in the stage, 0 if it is not listed
+func (s *Stage) baseTraffic() int {
+	for _, variant := range s.Variants {
+		if variant.Name == "base_version" {
+			return variant.TrafficPercentage
+		}
+	}
+	return 0
+}
+
+// allMetricsConditions returns the metrics conditions of a stage, including the ones of its steps
+func (s *Stage) allMetricsConditions() []MetricCondition {
+	conditions := append([]MetricCondition{}, s.MetricsConditions...)
+	for _, step := range s.Steps {
+		conditions = append(conditions, step.MetricsConditions...)
+	}
+	return conditions
+}
+
+const relativeThresholdPrefix = "base"
+
 // parseComparisonString parses a string like "<0.02" and returns the operator and value
 func parseComparisonString(comp string) (string, float64, error) {
+	operator, valueStr, err := splitOperator(comp)
+	if err != nil {
+		return "", 0, err
+	}
+	value, err := strconv.ParseFloat(valueStr, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid number: %s", valueStr)
+	}
+
+	return operator, value, nil
+}
+
+// parseRelativeComparisonString parses a string relative to the base version like "<=base*1.1", "<=base+0.01", or "<=base+10%",
+// and returns the operator, and the factor and offset of the threshold value (base*factor + offset)
+func parseRelativeComparisonString(comp string) (string, float64, float64, error) {
+	operator, expr, err := splitOperator(comp)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	expr = strings.ReplaceAll(expr, " ", "")
+	if !strings.HasPrefix(expr, relativeThresholdPrefix) {
+		return "", 0, 0, fmt.Errorf("relative threshold should start with '%s': %s", relativeThresholdPrefix, comp)
+	}
+	expr = strings.TrimPrefix(expr, relativeThresholdPrefix)
+	if expr == "" { // e.g. "<=base"
+		return operator, 1, 0, nil
+	}
+
+	sign, valueStr := expr[:1], expr[1:]
+	isPercentage := strings.HasSuffix(valueStr, "%")
+	value, err := strconv.ParseFloat(strings.TrimSuffix(valueStr, "%"), 64)
+	if err != nil || strings.HasPrefix(valueStr, "-") || strings.HasPrefix(valueStr, "+") || math.IsNaN(value) || math.IsInf(value, 0) {
+		return "", 0, 0, fmt.Errorf("invalid number in relative threshold: %s", comp)
+	}
+	switch {
+	case sign == "*" && !isPercentage: // base*1.1
+		return operator, value, 0, nil
+	case sign == "+" && isPercentage: // base+10%
+		return operator, 1 + value/100, 0, nil
+	case sign == "-" && isPercentage: // base-10%
+		return operator, 1 - value/100, 0, nil
+	case sign == "+": // base+0.01
+		return operator, 1, value, nil
+	case sign == "-": // base-0.01
+		return operator, 1, -value, nil
+	default:
+		return "", 0, 0, fmt.Errorf("invalid relative threshold, expected 'base', 'base*<factor>', 'base+<delta>', or 'base+<percentage>%%': %s", comp)
+	}
+}
+
+// splitOperator splits a comparison string like "<0.02" into its operator and the rest
+func splitOperator(comp string) (string, string, error) {
 	var operator string
 	if strings.HasPrefix(comp, "<=") {
 		operator = "<="
@@ -194,16 +461,26 @@ func parseComparisonString(comp string) (string, float64, error) {
 	} else if strings.HasPrefix(comp, "=") {
 		operator = "="
 	} else {
-		return "", 0, fmt.Errorf("invalid comparison string: %s", comp)
+		return "", "", fmt.Errorf("invalid comparison string: %s", comp)
 	}
+	return operator, strings.TrimPrefix(comp, operator), nil
+}
 
-	valueStr := strings.TrimPrefix(comp, operator)
-	value, err := strconv.ParseFloat(valueStr, 64)
-	if err != nil {
-		return "", 0, fmt.Errorf("invalid number: %s", valueStr)
+func compare(operator string, actual, thrVal float64) (bool, error) {
+	switch operator {
+	case "<":
+		return actual < thrVal, nil
+	case "<=":
+		return actual <= thrVal, nil
+	case ">":
+		return actual > thrVal, nil
+	case ">=":
+		return actual >= thrVal, nil
+	case "=":
+		return actual == thrVal, nil
+	default:
+		return false, fmt.Errorf("%w: unknown operator %s", ErrInvalidThreshold, operator)
 	}
-
-	return operator, value, nil
 }
 
 // --- Validations ---
@@ -219,17 +496,23 @@ func (rs *ReleaseStrategy) validateTrafficPercentage() error {
 	}
 	return nil
 }
-func (rs *ReleaseStrategy) validateCompareWithValues() error {
-	allowedValues := map[string]bool{
-		"Minimum": true,
-		"Maximum": true,
-		"Median":  true,
-	}
 
+// compareWithValues are the allowed compareWith values of the responseTime metric conditions and guardrails
+var compareWithValues = map[string]bool{
+	"Minimum": true,
+	"Maximum": true,
+	"Median":  true,
+	"Mean":    true,
+	"P90":     true,
+	"P95":     true,
+	"P99":     true,
+}
+
+func (rs *ReleaseStrategy) validateCompareWithValues() error {
 	for _, stage := range rs.Stages {
-		for _, metricCondition := range stage.MetricsConditions {
-			if metricCondition.CompareWith != "" && !allowedValues[metricCondition.CompareWith] {
-				return fmt.Errorf("invalid CompareWith value '%s' in stage '%s', allowed values are 'Minimum', 'Maximum', 'Median'", metricCondition.CompareWith, stage.Name)
+		for _, metricCondition := range stage.allMetricsConditions() {
+			if metricCondition.CompareWith != "" && !compareWithValues[metricCondition.CompareWith] {
+				return fmt.Errorf("invalid CompareWith value '%s' in stage '%s', allowed values are 'Minimum', 'Maximum', 'Median', 'Mean', 'P90', 'P95', 'P99'", metricCondition.CompareWith, stage.Name)
 			}
 		}
 	}
@@ -246,8 +529,8 @@ func (rs *ReleaseStrategy) validateRollbackFunction() error {
 }
 func (rs *ReleaseStrategy) validateMetricConditions() error {
 	for _, stage := range rs.Stages {
-		for _, metricCondition := range stage.MetricsConditions {
-			if _, _, err := parseComparisonString(metricCondition.Threshold); err != nil {
+		for _, metricCondition := range stage.allMetricsConditions() {
+			if err := metricCondition.validateThreshold(); err != nil {
 				return fmt.Errorf("invalid threshold format '%s' in metric condition '%s' of stage '%s': %v", metricCondition.Threshold, metricCondition.Name, stage.Name, err)
 			}
 		}
@@ -275,9 +558,6 @@ func (rs *ReleaseStrategy) validateEndActions() error {
 		if !validEndActions[stage.EndAction.OnFailure] {
 			return fmt.Errorf("invalid onFailure value '%s' in end_action for stage '%s'", stage.EndAction.OnFailure, stage.Name)
 		}
-		if stage.EndAction.OnSuccess == stage.Name || stage.EndAction.OnFailure == stage.Name {
-			return fmt.Errorf("end_action for stage '%s' cannot have onSuccess or onFailure value same as the stage name (loop)", stage.Name)
-		}
 	}
 	return nil
 }
@@ -301,3 +581,315 @@ func (rs *ReleaseStrategy) validateStageFunctionNames() error {
 	}
 	return nil
 }
+
+// checks if the canary stages send a share of the traffic to new_version and have something to watch
+func (rs *ReleaseStrategy) validateCanaryStages() error {
+	for _, stage := range rs.Stages {
+		if stage.Type != "Canary" {
+			continue
+		}
+		canaryTraffic := 0
+		for _, variant := range stage.Variants {
+			if variant.Name == "new_version" {
+				canaryTraffic = variant.TrafficPercentage
+			}
+		}
+		if canaryTraffic <= 0 || canaryTraffic >= 100 {
+			return fmt.Errorf("canary stage '%s' should send between 0 and 100 percent of the traffic to new_version, got %d", stage.Name, canaryTraffic)
+		}
+		if len(stage.MetricsConditions) == 0 {
+			return fmt.Errorf("canary stage '%s' has no metrics_conditions to watch", stage.Name)
+		}
+	}
+	return nil
+}
+
+// checks if the gradual stages have a valid traffic ramp with a metric gate for each step.
+// Each step sends some traffic to new_version to be judged by, and only base_version and new_version are tested (see AtStep)
+func (rs *ReleaseStrategy) validateGradualStages() error {
+	for _, stage := range rs.Stages {
+		if stage.Type != "Gradual" {
+			if len(stage.Steps) > 0 {
+				return fmt.Errorf("stage '%s' has steps, but only Gradual stages support them", stage.Name)
+			}
+			continue
+		}
+		if len(stage.Steps) == 0 {
+			return fmt.Errorf("gradual stage '%s' has no steps", stage.Name)
+		}
+		for i, step := range stage.Steps {
+			if step.TrafficPercentage <= 0 || step.TrafficPercentage > 100 {
+				return fmt.Errorf("step %d of gradual stage '%s' has an invalid traffic percentage: %d", i+1, stage.Name, step.TrafficPercentage)
+			}
+			if len(stage.AtStep(i).MetricsConditions) == 0 {
+				return fmt.Errorf("step %d of gradual stage '%s' has no metrics_conditions", i+1, stage.Name)
+			}
+		}
+		for _, variant := range stage.Variants {
+			if variant.Name != "base_version" && variant.Name != "new_version" {
+				return fmt.Errorf("gradual stage '%s' only ramps new_version up against base_version, got variant '%s'", stage.Name, variant.Name)
+			}
+		}
+		for _, guardrail := range stage.Guardrails {
+			if guardrail.Variant != "" && guardrail.Variant != "base_version" && guardrail.Variant != "new_version" {
+				return fmt.Errorf("guardrail '%s' of gradual stage '%s' watches '%s', which is not tested by the stage", guardrail.Name, stage.Name, guardrail.Variant)
+			}
+		}
+	}
+	return nil
+}
+func (rs *ReleaseStrategy) validateStageTypes() error {
+	validTypes := map[string]bool{
+		"A/B":           true,
+		"WaitForSignal": true,
+		"Canary":        true,
+		"Gradual":       true,
+	}
+	for _, stage := range rs.Stages {
+		if !validTypes[stage.Type] {
+			return fmt.Errorf("invalid type '%s' for stage '%s'", stage.Type, stage.Name)
+		}
+	}
+	return nil
+}
+
+// checks that the stages, connected by their end actions, don't form a loop (e.g. A -> B -> A).
+// The release starts with the first stage, and a stage which is not reachable from it never runs
+func (rs *ReleaseStrategy) validateStageGraph() error {
+	const (
+		unvisited = iota
+		visiting  // on the current path
+		visited
+	)
+	states := make(map[string]int)
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		stage, err := rs.GetStageByName(name)
+		if err != nil { // rollout or rollback
+			return nil
+		}
+		path = append(path, name)
+		switch states[name] {
+		case visiting:
+			return fmt.Errorf("end_actions of stages form a loop: %s", strings.Join(path, " -> "))
+		case visited:
+			return nil
+		}
+		states[name] = visiting
+		for _, next := range []string{stage.EndAction.OnSuccess, stage.EndAction.OnFailure} {
+			if err := visit(next, path); err != nil {
+				return err
+			}
+		}
+		states[name] = visited
+		return nil
+	}
+
+	for _, stage := range rs.Stages {
+		if err := visit(stage.Name, nil); err != nil {
+			return err
+		}
+	}
+	for _, stage := range rs.Stages[min(1, len(rs.Stages)):] {
+		if !rs.isStageReachable(stage.Name) {
+			log.Warnf("stage '%s' is not reachable from the first stage '%s' and will never run", stage.Name, rs.Stages[0].Name)
+		}
+	}
+	return nil
+}
+
+// isStageReachable checks if a stage can be reached from the first stage through the end actions
+func (rs *ReleaseStrategy) isStageReachable(name string) bool {
+	seen := map[string]bool{rs.Stages[0].Name: true}
+	queue := []string{rs.Stages[0].Name}
+	for len(queue) > 0 {
+		stage, err := rs.GetStageByName(queue[0])
+		queue = queue[1:]
+		if err != nil {
+			continue
+		}
+		if stage.Name == name {
+			return true
+		}
+		for _, next := range []string{stage.EndAction.OnSuccess, stage.EndAction.OnFailure} {
+			if !seen[next] {
+				seen[next] = true
+				queue = append(queue, next)
+			}
+		}
+	}
+	return false
+}
+
+// checks if the additional versions of the functions have unique names, other than base_version and new_version
+func (rs *ReleaseStrategy) validateVersionNames() error {
+	for _, function := range rs.Functions {
+		names := map[string]bool{"BaseVersion": true, "NewVersion": true}
+		for _, name := range function.VersionNames() {
+			if name == "" {
+				return fmt.Errorf("the additional versions of function '%s' should have a name", function.Name)
+			}
+			if names[name] {
+				return fmt.Errorf("version names of function '%s' should be unique: %s", function.Name, name)
+			}
+			names[name] = true
+		}
+	}
+	return nil
+}
+
+// checks if the stage variants are versions of the stage's function
+func (rs *ReleaseStrategy) validateStageVariants() error {
+	for _, stage := range rs.Stages {
+		function, err := rs.GetFunctionByName(stage.FuncName)
+		if err != nil {
+			return err
+		}
+		names := make(map[string]bool)
+		for _, variant := range stage.Variants {
+			if _, err := function.GetVersionByName(variant.Name); err != nil {
+				return fmt.Errorf("variant '%s' of stage '%s' is not a version of function '%s'", variant.Name, stage.Name, function.Name)
+			}
+			if names[variant.Name] {
+				return fmt.Errorf("variant '%s' is listed more than once in stage '%s'", variant.Name, stage.Name)
+			}
+			names[variant.Name] = true
+		}
+	}
+	return nil
+}
+
+func (rs *ReleaseStrategy) validateStatisticalTests() error {
+	for _, stage := range rs.Stages {
+		st := stage.StatisticalTest
+		if st == nil {
+			continue
+		}
+		if st.Confidence <= 0 || st.Confidence >= 1 {
+			return fmt.Errorf("confidence of the statistical test in stage '%s' should be between 0 and 1, got %v", stage.Name, st.Confidence)
+		}
+		if st.MinSamples < 2 {
+			return fmt.Errorf("minSamples of the statistical test in stage '%s' should be at least 2, got %v", stage.Name, st.MinSamples)
+		}
+	}
+	return nil
+}
+
+func (rs *ReleaseStrategy) validateGuardrails() error {
+	for _, stage := range rs.Stages {
+		for _, guardrail := range stage.Guardrails {
+			switch guardrail.Name {
+			case "errorRate":
+			case "responseTime":
+				if !compareWithValues[guardrail.CompareWith] {
+					return fmt.Errorf("invalid compareWith value '%s' in the responseTime guardrail of stage '%s'", guardrail.CompareWith, stage.Name)
+				}
+			default:
+				return fmt.Errorf("invalid guardrail '%s' in stage '%s', allowed names are 'errorRate' and 'responseTime'", guardrail.Name, stage.Name)
+			}
+			condition := guardrail.Condition()
+			if err := condition.validateThreshold(); err != nil {
+				return fmt.Errorf("invalid threshold format '%s' in guardrail '%s' of stage '%s': %v", guardrail.Threshold, guardrail.Name, stage.Name, err)
+			}
+			if guardrail.Window != "" {
+				if window, err := time.ParseDuration(guardrail.Window); err != nil || window <= 0 {
+					return fmt.Errorf("invalid window '%s' in guardrail '%s' of stage '%s'", guardrail.Window, guardrail.Name, stage.Name)
+				}
+			}
+			if guardrail.Variant == "base_version" {
+				return fmt.Errorf("guardrail '%s' of stage '%s' can't watch the base version", guardrail.Name, stage.Name)
+			}
+			if guardrail.Variant != "" {
+				function, err := rs.GetFunctionByName(stage.FuncName)
+				if err != nil {
+					return err
+				}
+				if _, err := function.GetVersionByName(guardrail.Variant); err != nil {
+					return fmt.Errorf("guardrail '%s' of stage '%s' watches '%s', which is not a version of function '%s'", guardrail.Name, stage.Name, guardrail.Variant, function.Name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// validateEndConditions checks the end conditions of each stage (and Gradual step): known names, their thresholds,
+// and that the limits (maxDuration, maxIdle) have a known outcome and don't end the stage before its minDuration
+func (rs *ReleaseStrategy) validateEndConditions() error {
+	validOutcomes := map[string]bool{"": true, OutcomeFail: true, OutcomeRollback: true, OutcomeSucceedIfMetricsOk: true}
+	for _, stage := range rs.Stages {
+		endConditionSets := [][]EndCondition{stage.EndConditions}
+		for _, step := range stage.Steps {
+			endConditionSets = append(endConditionSets, step.EndConditions)
+		}
+		for _, endConditions := range endConditionSets {
+			var minDuration, maxDuration time.Duration
+			for _, ec := range endConditions {
+				switch ec.Name {
+				case "minCalls":
+					if calls, err := strconv.Atoi(ec.Threshold); err != nil || calls < 0 {
+						return fmt.Errorf("invalid minCalls '%s' in stage '%s'", ec.Threshold, stage.Name)
+					}
+				case "minDuration", "maxDuration", "maxIdle":
+					duration, err := time.ParseDuration(ec.Threshold)
+					if err != nil || duration < 0 || (ec.Name != "minDuration" && duration == 0) {
+						return fmt.Errorf("invalid %s '%s' in stage '%s'", ec.Name, ec.Threshold, stage.Name)
+					}
+					if ec.Name == "minDuration" {
+						minDuration = duration
+					} else if ec.Name == "maxDuration" {
+						maxDuration = duration
+					}
+				default:
+					return fmt.Errorf("invalid end condition '%s' in stage '%s', allowed names are 'minDuration', 'minCalls', 'maxDuration' and 'maxIdle'", ec.Name, stage.Name)
+				}
+				if ec.Outcome != "" && ec.Name != "maxDuration" && ec.Name != "maxIdle" {
+					return fmt.Errorf("end condition '%s' of stage '%s' can't have an outcome, only maxDuration and maxIdle", ec.Name, stage.Name)
+				}
+				if !validOutcomes[ec.Outcome] {
+					return fmt.Errorf("invalid outcome '%s' of '%s' in stage '%s', allowed values are '%s', '%s' and '%s'",
+						ec.Outcome, ec.Name, stage.Name, OutcomeFail, OutcomeRollback, OutcomeSucceedIfMetricsOk)
+				}
+			}
+			if maxDuration > 0 && maxDuration <= minDuration {
+				return fmt.Errorf("maxDuration (%v) of stage '%s' should be longer than its minDuration (%v)", maxDuration, stage.Name, minDuration)
+			}
+		}
+	}
+	return nil
+}
+
+// validateRelativeThresholds checks that the relative metric conditions and guardrails of a stage (or of each step of a Gradual stage)
+// can be compared with base_version, i.e. base_version gets some of the traffic. Otherwise, a relative condition always fails and
+// a relative guardrail never fires
+func (rs *ReleaseStrategy) validateRelativeThresholds() error {
+	for _, stage := range rs.Stages {
+		runs := []Stage{stage}
+		if stage.Type == "Gradual" {
+			runs = nil
+			for i := range stage.Steps {
+				runs = append(runs, stage.AtStep(i))
+			}
+		}
+		for i, run := range runs {
+			if run.baseTraffic() > 0 {
+				continue
+			}
+			where := fmt.Sprintf("stage '%s'", stage.Name)
+			if stage.Type == "Gradual" {
+				where = fmt.Sprintf("step %d of gradual stage '%s'", i+1, stage.Name)
+			}
+			for _, condition := range run.MetricsConditions {
+				if condition.IsRelative() {
+					return fmt.Errorf("metric condition '%s' (%s) of %s is relative to base_version, which gets no traffic", condition.Name, condition.Threshold, where)
+				}
+			}
+			for _, guardrail := range run.Guardrails {
+				if condition := guardrail.Condition(); condition.IsRelative() {
+					return fmt.Errorf("guardrail '%s' (%s) of %s is relative to base_version, which gets no traffic", guardrail.Name, guardrail.Threshold, where)
+				}
+			}
+		}
+	}
+	return nil
+}
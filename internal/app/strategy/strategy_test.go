@@ -0,0 +1,233 @@
+package strategy
+
+import (
+	"errors"
+	"math"
+	"os"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestMain(m *testing.M) {
+	log.SetLevel(log.ErrorLevel)
+	os.Exit(m.Run())
+}
+
+// stages returns stages of the given names and end actions ("name:onSuccess:onFailure")
+func stages(specs ...string) []Stage {
+	var result []Stage
+	for _, spec := range specs {
+		parts := strings.Split(spec, ":")
+		result = append(result, Stage{Name: parts[0], EndAction: EndAction{OnSuccess: parts[1], OnFailure: parts[2]}})
+	}
+	return result
+}
+
+func TestValidateStageGraph(t *testing.T) {
+	tests := []struct {
+		name    string
+		stages  []Stage
+		wantErr string // empty if valid
+	}{
+		{"linear", stages("ab:canary:rollback", "canary:rollout:rollback"), ""},
+		{"other stage on failure", stages("ab:canary:retry", "canary:rollout:rollback", "retry:rollout:rollback"), ""},
+		{"shared next stage", stages("ab:canary:fallback", "fallback:canary:rollback", "canary:rollout:rollback"), ""},
+		{"unreachable stage", stages("ab:rollout:rollback", "orphan:rollout:rollback"), ""},
+		{"self loop", stages("ab:rollout:ab"), "loop: ab -> ab"},
+		{"loop", stages("ab:canary:rollback", "canary:rollout:ab"), "loop: ab -> canary -> ab"},
+		{"loop of a later stage", stages("ab:canary:rollback", "canary:gradual:rollback", "gradual:canary:rollback"), "loop: ab -> canary -> gradual -> canary"},
+		{"loop of unreachable stages", stages("ab:rollout:rollback", "c:d:rollback", "d:rollout:c"), "loop: c -> d -> c"},
+		{"unknown onSuccess", stages("ab:canry:rollback", "canary:rollout:rollback"), "invalid onSuccess value 'canry'"},
+		{"unknown onFailure", stages("ab:rollout:rolback"), "invalid onFailure value 'rolback'"},
+		{"missing onFailure", stages("ab:rollout:"), "must have both onSuccess and onFailure"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs := &ReleaseStrategy{Stages: tt.stages}
+			err := rs.validateEndActions()
+			if err == nil {
+				err = rs.validateStageGraph()
+			}
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseRelativeComparisonString(t *testing.T) {
+	tests := []struct {
+		threshold      string
+		operator       string
+		factor, offset float64
+		wantErr        bool
+	}{
+		{"<=base", "<=", 1, 0, false},
+		{"<=base*1.1", "<=", 1.1, 0, false},
+		{"<base * 2", "<", 2, 0, false},
+		{"<=base+0.01", "<=", 1, 0.01, false},
+		{">=base-5", ">=", 1, -5, false},
+		{"<=base+10%", "<=", 1.1, 0, false},
+		{">base-10%", ">", 0.9, 0, false},
+		{"<=base*", "", 0, 0, true},
+		{"<=base+", "", 0, 0, true},
+		{"<=base+%", "", 0, 0, true},
+		{"<=base*%", "", 0, 0, true},
+		{"<=base*10%", "", 0, 0, true},
+		{"<=base/2", "", 0, 0, true},
+		{"<=base*1.1x", "", 0, 0, true},
+		{"<=base*-1.1", "", 0, 0, true},
+		{"<=base+-0.01", "", 0, 0, true},
+		{"<=base--10%", "", 0, 0, true},
+		{"<=base*+2", "", 0, 0, true},
+		{"<=base*NaN", "", 0, 0, true},
+		{"<=base+Inf", "", 0, 0, true},
+		{"<=bas*1.1", "", 0, 0, true},
+		{"base*1.1", "", 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.threshold, func(t *testing.T) {
+			operator, factor, offset, err := parseRelativeComparisonString(tt.threshold)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("got %s base*%v%+v, want an error", operator, factor, offset)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if operator != tt.operator || math.Abs(factor-tt.factor) > 1e-12 || math.Abs(offset-tt.offset) > 1e-12 {
+				t.Errorf("got %s base*%v%+v, want %s base*%v%+v", operator, factor, offset, tt.operator, tt.factor, tt.offset)
+			}
+		})
+	}
+}
+
+func TestRelativeThreshold(t *testing.T) {
+	tests := []struct {
+		threshold    string
+		actual, base float64
+		want         bool
+	}{
+		{"<=base*1.1", 110, 100, true},
+		{"<=base*1.1", 111, 100, false},
+		{"<=base+0.01", 0.03, 0.02, true},
+		{"<=base+0.01", 0.04, 0.02, false},
+		{"<=base+10%", 109, 100, true},
+		{"<=base+10%", 111, 100, false},
+		{">=base-10%", 95, 100, true},
+		{">=base-10%", 80, 100, false},
+	}
+	for _, tt := range tests {
+		condition := MetricCondition{Name: "responseTime", Threshold: tt.threshold, CompareWith: "Median"}
+		if !condition.IsRelative() {
+			t.Errorf("%s: not relative", tt.threshold)
+		}
+		if err := condition.validateThreshold(); err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.threshold, err)
+		}
+		met, err := condition.IsThresholdMetAgainst(tt.actual, tt.base)
+		if err != nil || met != tt.want {
+			t.Errorf("%s with %v against base %v: got %v (%v), want %v", tt.threshold, tt.actual, tt.base, met, err, tt.want)
+		}
+	}
+
+	for _, threshold := range []string{"<=base*", "<=base+%", "<=base*-2"} {
+		condition := MetricCondition{Name: "responseTime", Threshold: threshold, CompareWith: "Median"}
+		if err := condition.validateThreshold(); err == nil {
+			t.Errorf("%s: invalid threshold accepted", threshold)
+		}
+		if _, err := condition.IsThresholdMetAgainst(100, 100); !errors.Is(err, ErrInvalidThreshold) {
+			t.Errorf("%s: got %v, want an %v", threshold, err, ErrInvalidThreshold)
+		}
+	}
+	absolute := MetricCondition{Name: "errorRate", Threshold: "<0.1"}
+	if absolute.IsRelative() {
+		t.Errorf("%s: relative", absolute.Threshold)
+	}
+}
+
+func TestValidateRelativeThresholds(t *testing.T) {
+	relative := []MetricCondition{{Name: "responseTime", Threshold: "<=base*1.1", CompareWith: "Median"}}
+	absolute := []MetricCondition{{Name: "errorRate", Threshold: "<0.1"}}
+	relativeGuardrail := []Guardrail{{Name: "errorRate", Threshold: ">base+0.1"}}
+	split := func(base, new int) []Variant {
+		return []Variant{{Name: "base_version", TrafficPercentage: base}, {Name: "new_version", TrafficPercentage: new}}
+	}
+	tests := []struct {
+		name    string
+		stage   Stage
+		wantErr string // empty if valid
+	}{
+		{"A/B", Stage{Name: "ab", Type: "A/B", Variants: split(50, 50), MetricsConditions: relative, Guardrails: relativeGuardrail}, ""},
+		{"no base traffic, absolute", Stage{Name: "ab", Type: "A/B", Variants: split(0, 100), MetricsConditions: absolute}, ""},
+		{"no base traffic, relative condition", Stage{Name: "ab", Type: "A/B", Variants: split(0, 100), MetricsConditions: relative},
+			"metric condition 'responseTime' (<=base*1.1) of stage 'ab' is relative to base_version"},
+		{"base not listed", Stage{Name: "ab", Type: "A/B", Variants: []Variant{{Name: "new_version", TrafficPercentage: 100}}, MetricsConditions: relative},
+			"of stage 'ab' is relative to base_version"},
+		{"no base traffic, relative guardrail", Stage{Name: "ab", Type: "A/B", Variants: split(0, 100), MetricsConditions: absolute, Guardrails: relativeGuardrail},
+			"guardrail 'errorRate' (>base+0.1) of stage 'ab' is relative to base_version"},
+		{"gradual", Stage{Name: "ramp", Type: "Gradual", Steps: []Step{{TrafficPercentage: 10}, {TrafficPercentage: 50}}, MetricsConditions: relative}, ""},
+		{"gradual to 100%, relative condition", Stage{Name: "ramp", Type: "Gradual", Steps: []Step{{TrafficPercentage: 50}, {TrafficPercentage: 100}}, MetricsConditions: relative},
+			"step 2 of gradual stage 'ramp' is relative to base_version"},
+		{"gradual to 100%, absolute condition of the last step", Stage{Name: "ramp", Type: "Gradual",
+			Steps: []Step{{TrafficPercentage: 50}, {TrafficPercentage: 100, MetricsConditions: absolute}}, MetricsConditions: relative}, ""},
+		{"gradual to 100%, relative guardrail", Stage{Name: "ramp", Type: "Gradual",
+			Steps: []Step{{TrafficPercentage: 100}}, MetricsConditions: absolute, Guardrails: relativeGuardrail},
+			"guardrail 'errorRate' (>base+0.1) of step 1 of gradual stage 'ramp'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs := &ReleaseStrategy{Stages: []Stage{tt.stage}}
+			rs.normalizeStages()
+			err := rs.validateRelativeThresholds()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateGuardrailVariants(t *testing.T) {
+	tests := []struct {
+		variant string
+		wantErr string // empty if valid
+	}{
+		{"", ""},
+		{"new_version", ""},
+		{"NewVersion", ""},
+		{"candidate", ""},
+		{"base_version", "can't watch the base version"},
+		{"BaseVersion", "can't watch the base version"},
+		{"unknown", "watches 'unknown', which is not a version of function 'sieve'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.variant, func(t *testing.T) {
+			rs := &ReleaseStrategy{
+				Functions: []Function{{Name: "sieve", Versions: []Version{{Name: "candidate"}}}},
+				Stages: []Stage{{Name: "ab", Type: "A/B", FuncName: "sieve",
+					Guardrails: []Guardrail{{Name: "errorRate", Threshold: ">0.1", Variant: tt.variant}}}},
+			}
+			rs.normalizeStages()
+			err := rs.validateGuardrails()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
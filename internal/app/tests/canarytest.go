@@ -0,0 +1,73 @@
+package tests
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	"time"
+	FaaS "umbilical-choir-core/internal/app/faas"
+	MetricAgg "umbilical-choir-core/internal/app/metric_aggregator"
+	Strategy "umbilical-choir-core/internal/app/strategy"
+)
+
+// CanaryTest sends a small share of the traffic to the new version and checks the metrics conditions on every poll.
+// Unlike ReleaseTest, it doesn't wait for 'minDuration' and 'minCalls' before reacting: as soon as the canary crosses
+// a threshold, the test is aborted (testMeta.Aborted). Otherwise, it ends when the end conditions are met.
+func CanaryTest(ctx context.Context, stageData Strategy.Stage, funcMeta *Strategy.Function, prevDeployments map[string]string, store *MetricAgg.Store, metrics *MetricAgg.MetricServer, releaseID, agentHost string, faas FaaS.FaaS) (*TestMeta, *MetricAgg.MetricAggregator, error) {
+	funcName := stageData.FuncName
+	testMeta, err := newTestMeta(stageData, funcMeta, releaseID, agentHost, metrics, faas)
+	if err != nil {
+		return nil, nil, err
+	}
+	endConditions, err := parseEndConditions(stageData.EndConditions)
+	if err != nil {
+		return testMeta, nil, err
+	}
+	minDuration, minCalls := endConditions.minDuration, endConditions.minCalls
+	log.Infof("Running CanaryTest for '%s' function (%s). Minimum end conditions: %v calls and %v run time",
+		funcName, testMeta.trafficSplit(), minCalls, minDuration)
+
+	// set up functions, and run Metric Aggregator before starting the test
+	agg, err := testMeta.releaseTestSetup(ctx, prevDeployments, store)
+	if err != nil {
+		log.Errorf("Error in releaseTestSetup for '%s' function: %v", funcName, err)
+		return testMeta, agg, err
+	}
+	// Clean up the test after a clean finish or an error
+	defer testMeta.releaseTestCleanup(agg)
+
+	log.Info("now watching the canary in Metric Aggregator")
+	beginning := time.Now()
+	for {
+		elapse := time.Since(beginning)
+		callCount := int(agg.Calls())
+
+		canaryCalls := candidateCalls(agg)
+
+		if testMeta.checkLimits(agg, endConditions, beginning) {
+			return testMeta, agg, nil
+		}
+		if canaryCalls == 0 {
+			log.Debugf("no canary '%v()' calls after %v (%v calls in total), waiting...", funcName, elapse, callCount)
+		} else if testMeta.checkGuardrails(agg) {
+			return testMeta, agg, nil
+		} else {
+			// check the canary on every poll, regardless of the end conditions
+			if violation, violated := violatedCondition(stageData.MetricsConditions, agg.SummarizeResult()); violated {
+				log.Warnf("Canary crossed a threshold after %v (%v canary calls). %s. Aborting stage '%s'", elapse, canaryCalls, violation, testMeta.StageName)
+				testMeta.Aborted = true
+				return testMeta, agg, nil
+			}
+
+			if callCount >= minCalls && elapse > minDuration {
+				log.Infof("CanaryTest successful. The canary stayed within the thresholds. time: %v, calls: %v, canary calls: %v",
+					elapse, callCount, canaryCalls)
+				return testMeta, agg, nil
+			}
+			log.Infof("Canary in progress... %v calls (%v canary) | %v elapsed | stage: '%s'", callCount, canaryCalls, elapse, testMeta.StageName)
+		}
+		// Wait before polling again
+		if err := sleep(ctx, 1*time.Second); err != nil {
+			return testMeta, agg, err
+		}
+	}
+}
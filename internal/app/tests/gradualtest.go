@@ -0,0 +1,93 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	FaaS "umbilical-choir-core/internal/app/faas"
+	MetricAgg "umbilical-choir-core/internal/app/metric_aggregator"
+	Strategy "umbilical-choir-core/internal/app/strategy"
+)
+
+// GradualTest ramps the traffic of the new version up through the steps of a Gradual stage.
+// The base and new versions are deployed once, and only the proxy is updated with the new split (BCHANCE) on each step.
+// Each step runs until its own end conditions are met and then is checked against its own metric gate.
+// A failed step ends the test (testMeta.Aborted), and testMeta.Step tells which step it was. A step which reaches a limit (maxDuration
+// or maxIdle) also ends the test, unless its outcome is succeedIfMetricsOk: then, it is checked against its metric gate as usual.
+// The test starts from 'fromStep' (e.g. resumed after a restart), and calls 'onStep' before moving to each next step.
+// NOTE: the metrics are reset on each step, so the returned aggregator only has the metrics of the last run step
+func GradualTest(ctx context.Context, stageData Strategy.Stage, funcMeta *Strategy.Function, prevDeployments map[string]string, store *MetricAgg.Store, metrics *MetricAgg.MetricServer, releaseID, agentHost string, faas FaaS.FaaS, fromStep int, onStep func(step int)) (*TestMeta, *MetricAgg.MetricAggregator, error) {
+	funcName := stageData.FuncName
+	testMeta, err := newTestMeta(stageData.AtStep(fromStep), funcMeta, releaseID, agentHost, metrics, faas)
+	if err != nil {
+		return nil, nil, err
+	}
+	log.Infof("Running GradualTest for '%s' function in %v steps", funcName, len(stageData.Steps))
+
+	// set up functions, and run Metric Aggregator before starting the test
+	agg, err := testMeta.releaseTestSetup(ctx, prevDeployments, store)
+	if err != nil {
+		log.Errorf("Error in releaseTestSetup for '%s' function: %v", funcName, err)
+		return testMeta, agg, err
+	}
+	// Clean up the test after a clean finish or an error
+	defer testMeta.releaseTestCleanup(agg)
+	// the restored metrics are of another step, e.g. the agent crashed before the reset of the resumed step
+	if agg.Step != fromStep {
+		log.Warnf("The restored metrics of '%s' are of step %d, not %d. Starting the step from scratch", stageData.Name, agg.Step+1, fromStep+1)
+		agg.ResetStep(fromStep)
+	}
+
+	for i := fromStep; i < len(stageData.Steps); i++ {
+		step := stageData.AtStep(i)
+		testMeta.Step = i
+		testMeta.EndReason, testMeta.EndOutcome = "", "" // of the last run step
+		if i > fromStep {
+			if onStep != nil {
+				onStep(i) // e.g. journaled, so the step is resumed after a restart
+			}
+			err = testMeta.updateTrafficSplit(ctx, step)
+			if err != nil {
+				return testMeta, agg, fmt.Errorf("failed to move to step %d of '%s': %v", i+1, stageData.Name, err)
+			}
+			agg.ResetStep(i)
+		}
+
+		endConditions, err := parseEndConditions(step.EndConditions)
+		if err != nil {
+			return testMeta, agg, err
+		}
+		log.Infof("'%s' step %d/%d (%s). Minimum end conditions: %v calls and %v run time",
+			stageData.Name, i+1, len(stageData.Steps), testMeta.trafficSplit(), endConditions.minCalls, endConditions.minDuration)
+		if err := testMeta.waitForEndConditions(ctx, agg, endConditions); err != nil {
+			return testMeta, agg, err
+		}
+		if testMeta.GuardrailViolation != "" {
+			return testMeta, agg, nil
+		}
+		if testMeta.EndReason != "" && testMeta.EndOutcome != Strategy.OutcomeSucceedIfMetricsOk {
+			return testMeta, agg, nil // concluded by its outcome
+		}
+
+		success, rollbackRequired := ProcessStageResult(step, agg.SummarizeResult())
+		if rollbackRequired || !success {
+			log.Warnf("'%s' step %d/%d (%v%%) failed its metric gate. Stopping the ramp", stageData.Name, i+1, len(stageData.Steps), testMeta.Variants[1].TrafficPercentage)
+			testMeta.Aborted = true
+			return testMeta, agg, nil
+		}
+		log.Infof("'%s' step %d/%d (%v%%) passed its metric gate", stageData.Name, i+1, len(stageData.Steps), testMeta.Variants[1].TrafficPercentage)
+	}
+	return testMeta, agg, nil
+}
+
+// updateTrafficSplit moves the proxy to the traffic split of the given step, without redeploying the tested functions
+func (t *TestMeta) updateTrafficSplit(ctx context.Context, step Strategy.Stage) error {
+	for _, variant := range step.Variants {
+		for _, tested := range t.Variants {
+			if tested.Name == variant.Name {
+				tested.TrafficPercentage = variant.TrafficPercentage
+			}
+		}
+	}
+	return t.deployProxy(ctx)
+}
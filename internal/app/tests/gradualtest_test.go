@@ -0,0 +1,85 @@
+package tests
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	FaaS "umbilical-choir-core/internal/app/faas"
+	MetricAgg "umbilical-choir-core/internal/app/metric_aggregator"
+	Strategy "umbilical-choir-core/internal/app/strategy"
+)
+
+var gradualStage = Strategy.Stage{
+	Name:              "gradual",
+	Type:              "Gradual",
+	FuncName:          "sieve",
+	Steps:             []Strategy.Step{{TrafficPercentage: 20}, {TrafficPercentage: 50}},
+	MetricsConditions: []Strategy.MetricCondition{{Name: "errorRate", Threshold: "<0.1"}},
+	EndConditions:     []Strategy.EndCondition{{Name: "minDuration", Threshold: "1s"}, {Name: "minCalls", Threshold: "10"}},
+	EndAction:         Strategy.EndAction{OnSuccess: "rollout", OnFailure: "rollback"},
+}
+
+// runGradualStage runs gradualStage from a step on a mock FaaS while calling the function, and returns the steps it moved to
+func runGradualStage(t *testing.T, store *MetricAgg.Store, fromStep int) (*TestMeta, *MetricAgg.MetricAggregator, []int) {
+	t.Helper()
+	mock, err := FaaS.NewMockAdapter("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+	metrics := MetricAgg.NewMetricServer("127.0.0.1:0")
+	if err := metrics.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer metrics.Close()
+
+	loadCtx, stopLoad := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for loadCtx.Err() == nil {
+			mock.Call("sieve", "10")
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+	defer func() { stopLoad(); <-done }()
+
+	var steps []int
+	testMeta, agg, err := GradualTest(context.Background(), gradualStage, signalFunction, nil, store, metrics, "r1", "127.0.0.1", mock,
+		fromStep, func(step int) { steps = append(steps, step) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testMeta, agg, steps
+}
+
+func TestGradualTestMovesThroughSteps(t *testing.T) {
+	testMeta, _, steps := runGradualStage(t, nil, 0)
+	if testMeta.Aborted || testMeta.Step != 1 || testMeta.Variants[1].TrafficPercentage != 50 {
+		t.Errorf("ended at step %d (%v%%), aborted %v, want the last step (50%%)", testMeta.Step+1, testMeta.Variants[1].TrafficPercentage, testMeta.Aborted)
+	}
+	if !reflect.DeepEqual(steps, []int{1}) {
+		t.Errorf("moved to the steps %v, want [1]", steps)
+	}
+}
+
+func TestGradualTestResumesRestoredStep(t *testing.T) {
+	store, err := MetricAgg.OpenStore(t.TempDir(), "r1", "gradual")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Remove()
+	// the metrics of the second step, persisted before a restart
+	store.AppendReset(time.Now(), 1)
+	store.Append(MetricAgg.MetricUpdatePayload{Metrics: []MetricAgg.Metric{{MetricName: "call_count", Value: 1000}, {MetricName: "proxy_time", Value: 5}}}, time.Now())
+
+	testMeta, agg, steps := runGradualStage(t, store, 1)
+	if testMeta.Step != 1 || len(steps) != 0 {
+		t.Errorf("ended at step %d, moved to the steps %v, want to only run the second step", testMeta.Step+1, steps)
+	}
+	if calls := agg.Calls(); calls < 1000 {
+		t.Errorf("%v calls, want the restored 1000 calls of the step too", calls)
+	}
+}
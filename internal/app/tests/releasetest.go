@@ -1,226 +1,114 @@
 package tests
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"strconv"
+	"strings"
 	"time"
 	FaaS "umbilical-choir-core/internal/app/faas"
 	MetricAgg "umbilical-choir-core/internal/app/metric_aggregator"
 	Strategy "umbilical-choir-core/internal/app/strategy"
 )
 
+var (
+	// ErrDeployFailed is returned when the tested versions or the proxy can't be deployed
+	ErrDeployFailed = errors.New("deployment failed")
+	// ErrInvalidStage is returned for a stage which can't run as given, e.g. its traffic split doesn't sum up to 100
+	ErrInvalidStage = errors.New("invalid stage")
+)
+
 type TestMeta struct {
-	FuncName           string
-	AVersionName       string
-	BVersionName       string
-	AVersionPath       string
-	BVersionPath       string
-	AVersionRuntime    string
-	BVersionRuntime    string
-	ATrafficPercentage int
-	BTrafficPercentage int
-	AVersionURI        string
-	BVersionURI        string
-	Program            string
-	StageName          string
-	AgentHost          string
-	FaaS               FaaS.FaaS
+	FuncName     string
+	Variants     []*VariantMeta // in the proxy's order: Variants[0] is f1 (base version), Variants[1] is f2, ...
+	Program      string
+	StageName    string
+	ReleaseID    string
+	AgentHost    string
+	MetricServer *MetricAgg.MetricServer // receives the metrics of the proxy, see releaseTestSetup
+	pushSecret   string                  // the proxy signs its metrics with it, if the metric server requires it
+	FaaS         FaaS.FaaS
+	Aborted      bool              // the test was stopped before its end conditions were met (e.g. a failing canary)
+	Step         int               // only Gradual. index of the last step that ran
+	Winner       string            // the chosen version among the tested ones, set after processing the stage result
+	EndReason    string            // why the test ended before its end conditions were met (maxDuration or maxIdle)
+	EndOutcome   string            // the outcome of EndReason, one of Strategy.Outcome*
+	Released     *Strategy.Version // the version the function was replaced with at the end of the test, if it was (see ReplaceChosenFunction)
+
+	StatisticalTest    *Strategy.StatisticalTest // optional statistical decision mode of the stage
+	Guardrails         []Strategy.Guardrail      // checked on every poll
+	GuardrailViolation string                    // the violated guardrail, if the test was aborted by one
+}
+
+// VariantMeta is a tested version of the function, deployed as '<func name>0<n>' where n is its index in the function's versions
+type VariantMeta struct {
+	Name              string // version name, e.g. "new_version"
+	DeployName        string
+	Path              string
+	Runtime           string
+	TrafficPercentage int
+	URI               string
 }
 
 // TODO: replace hard-coded entrypoint from input strategy
 
 // ReleaseTest
-// the test runs at least for 'minDuration' seconds and at least 'minCalls' are made to the function + collect metrics
-func ReleaseTest(stageData Strategy.Stage, funcMeta *Strategy.Function, isReuseFunction bool, prevF1Uri, prevF2Uri, agentHost string, faas FaaS.FaaS) (*TestMeta, *MetricAgg.MetricAggregator, error) {
+// the test runs at least for 'minDuration' seconds and at least 'minCalls' are made to the function + collect metrics.
+// It returns the context's error if it is cancelled first
+func ReleaseTest(ctx context.Context, stageData Strategy.Stage, funcMeta *Strategy.Function, prevDeployments map[string]string, store *MetricAgg.Store, metrics *MetricAgg.MetricServer, releaseID, agentHost string, faas FaaS.FaaS) (*TestMeta, *MetricAgg.MetricAggregator, error) {
 	funcName := stageData.FuncName
-	a := funcMeta.BaseVersion
-	b := funcMeta.NewVersion
-	variants := stageData.Variants
-	aTrafficPercentage := 100
-	bTrafficPercentage := 0
-	for _, variant := range variants {
-		switch variant.Name {
-		case "base_version":
-			aTrafficPercentage = variant.TrafficPercentage
-		case "new_version":
-			bTrafficPercentage = variant.TrafficPercentage
-		default:
-			log.Warnf("Unknown variant: '%v'. more than two versions is not yet supported. Ignoring it", variant.Name)
-		}
-	}
-	if aTrafficPercentage+bTrafficPercentage != 100 {
-		log.Fatalf("Unexpected! Traffic percentage for A and B versions should sum up to 100. Got %v and %v", aTrafficPercentage, bTrafficPercentage)
-	}
-	testEndConditions := stageData.EndConditions
-	minDurationStr := "0s"
-	minCalls := 0
-	for _, req := range testEndConditions {
-		switch req.Name {
-		case "minDuration":
-			minDurationStr = req.Threshold
-		case "minCalls":
-			num, err := strconv.Atoi(req.Threshold)
-			if err != nil {
-				log.Fatal("Error converting string 'minCalls' to int in 'EndConditions':", err)
-			}
-			minCalls = num
-		default:
-			log.Warnf("Unknown requirement: %v. Ignoring it", req.Name)
-		}
-	}
-	log.Infof("Running ReleaseTest for '%s' function. Minimum end conditions: %v calls and %v run time", funcName, minCalls, minDurationStr)
-
-	// Create an instance of TestMeta
-	testMeta := &TestMeta{
-		FuncName:           funcName,
-		AVersionName:       funcName + "01",
-		BVersionName:       funcName + "02",
-		AVersionPath:       a.Path,
-		BVersionPath:       b.Path,
-		AVersionRuntime:    a.Env,
-		BVersionRuntime:    b.Env,
-		ATrafficPercentage: aTrafficPercentage,
-		BTrafficPercentage: bTrafficPercentage,
-		Program:            fmt.Sprintf("test-%s", funcName),
-		StageName:          stageData.Name,
-		AgentHost:          agentHost,
-		FaaS:               faas,
+	testMeta, err := newTestMeta(stageData, funcMeta, releaseID, agentHost, metrics, faas)
+	if err != nil {
+		return nil, nil, err
 	}
-
-	minDuration, err := time.ParseDuration(minDurationStr)
+	endConditions, err := parseEndConditions(stageData.EndConditions)
 	if err != nil {
-		return testMeta, nil, fmt.Errorf("error parsing duration '%v': %v", minDurationStr, err)
+		return testMeta, nil, err
 	}
+	log.Infof("Running ReleaseTest for '%s' function. Minimum end conditions: %v calls and %v run time", funcName, endConditions.minCalls, endConditions.minDuration)
 
 	// set up functions, and run Metric Aggregator before starting the test
-	agg, metricShutdownChan, f1Uri, f2Uri, err := testMeta.releaseTestSetup(isReuseFunction, prevF1Uri, prevF2Uri)
+	agg, err := testMeta.releaseTestSetup(ctx, prevDeployments, store)
 	if err != nil {
 		log.Errorf("Error in releaseTestSetup for '%s' function: %v", funcName, err)
 		return testMeta, agg, err
 	}
-	testMeta.AVersionURI = f1Uri
-	testMeta.BVersionURI = f2Uri
 	// Clean up the test after a clean finish or an error
-	defer testMeta.releaseTestCleanup(metricShutdownChan)
+	defer testMeta.releaseTestCleanup(agg)
 
 	log.Info("now polling Metric Aggregator for test result")
-	beginning := time.Now()
-	for {
-		elapse := time.Since(beginning)
-		// Query the count of proxyTime call metric
-		callCount := int(agg.CallCounts)
-
-		// If no calls were made, log and wait
-		if callCount == 0 {
-			log.Debugf("no '%v()' calls after %v, waiting...", funcName, elapse)
-		} else {
-			responseTimes := agg.ProxyTimes
-			var lastResponseTime float64
-
-			if len(responseTimes) == 0 {
-				lastResponseTime = -1 // no value
-				log.Errorf("Unexpected! no response time found in Metric Aggregator while call_count exist! Continuing...")
-			} else {
-				lastResponseTime = responseTimes[len(responseTimes)-1]
-			}
-
-			// If the count is at least minCalls, and minDuration passed, return true
-			if callCount >= minCalls {
-				if elapse > minDuration {
-					log.Infof("ReleaseTest successful. The minimum call count and duration satisfied. time: %v, calls: %v, last response time: %v",
-						elapse, callCount, lastResponseTime)
-					return testMeta, agg, nil
-				} else {
-					log.Infof("min call count is done(%v), but min duration not satisfied (%v/%v). last response time: %vms. Continuing to poll...", callCount, elapse, minDuration, lastResponseTime)
-				}
-			} else if elapse > minDuration {
-				log.Infof("min duration is done, but min calls not satisfied (%v/%v). last response time: %vms. Continuing to poll after %v...",
-					callCount, minCalls, lastResponseTime, elapse)
-			} else {
-				log.Infof("Release Test in progress... %v calls | last took %vms | %v elapsed", callCount, lastResponseTime, elapse)
-			}
-		}
-		// Wait before polling again
-		time.Sleep(1 * time.Second)
-	}
+	err = testMeta.waitForEndConditions(ctx, agg, endConditions) // returns early if a guardrail is violated, or a limit is reached
+	return testMeta, agg, err
 }
 
 // Alternative version of ReleaseTest that can be stopped by an external signal, or by error/failure after the requiement is met
-func ReleaseTestWithSignal(stageData Strategy.Stage, funcMeta *Strategy.Function, isReuseFunction bool, prevF1Uri, prevF2Uri, agentHost string, faas FaaS.FaaS, strategyID, parentHost, parentPort, id string) (*TestMeta, *MetricAgg.MetricAggregator, error) {
+func ReleaseTestWithSignal(ctx context.Context, stageData Strategy.Stage, funcMeta *Strategy.Function, prevDeployments map[string]string, store *MetricAgg.Store, metrics *MetricAgg.MetricServer, agentHost string, faas FaaS.FaaS, strategyID, parentHost, parentPort, id string) (*TestMeta, *MetricAgg.MetricAggregator, error) {
 	funcName := stageData.FuncName
-	a := funcMeta.BaseVersion
-	b := funcMeta.NewVersion
-	variants := stageData.Variants
-	aTrafficPercentage := 100
-	bTrafficPercentage := 0
-	for _, variant := range variants {
-		switch variant.Name {
-		case "base_version":
-			aTrafficPercentage = variant.TrafficPercentage
-		case "new_version":
-			bTrafficPercentage = variant.TrafficPercentage
-		default:
-			log.Warnf("Unknown variant: '%v'. more than two versions is not yet supported. Ignoring it", variant.Name)
-		}
-	}
-	if aTrafficPercentage+bTrafficPercentage != 100 {
-		log.Fatalf("Unexpected! Traffic percentage for A and B versions should sum up to 100. Got %v and %v", aTrafficPercentage, bTrafficPercentage)
-	}
-
-	testEndConditions := stageData.EndConditions
-	minDurationStr := "0s"
-	minCalls := 0
-	for _, req := range testEndConditions {
-		switch req.Name {
-		case "minDuration":
-			minDurationStr = req.Threshold
-		case "minCalls":
-			num, err := strconv.Atoi(req.Threshold)
-			if err != nil {
-				log.Fatal("Error converting string 'minCalls' to int in 'EndConditions':", err)
-			}
-			minCalls = num
-		default:
-			log.Warnf("Unknown requirement: %v. Ignoring it", req.Name)
-		}
-	}
-	log.Infof("Running ReleaseTestWithSignal for '%s' function.", funcName)
-
-	// Create an instance of TestMeta
-	testMeta := &TestMeta{
-		FuncName:           funcName,
-		AVersionName:       funcName + "01",
-		BVersionName:       funcName + "02",
-		AVersionPath:       a.Path,
-		BVersionPath:       b.Path,
-		AVersionRuntime:    a.Env,
-		BVersionRuntime:    b.Env,
-		ATrafficPercentage: aTrafficPercentage,
-		BTrafficPercentage: bTrafficPercentage,
-		Program:            fmt.Sprintf("test-%s", funcName),
-		StageName:          stageData.Name,
-		AgentHost:          agentHost,
-		FaaS:               faas,
+	testMeta, err := newTestMeta(stageData, funcMeta, strategyID, agentHost, metrics, faas)
+	if err != nil {
+		return nil, nil, err
 	}
-
-	minDuration, err := time.ParseDuration(minDurationStr)
+	endConditions, err := parseEndConditions(stageData.EndConditions)
 	if err != nil {
-		return testMeta, nil, fmt.Errorf("error parsing duration '%v': %v", minDurationStr, err)
+		return testMeta, nil, err
 	}
+	minDuration, minCalls := endConditions.minDuration, endConditions.minCalls
+	log.Infof("Running ReleaseTestWithSignal for '%s' function.", funcName)
 
 	// set up functions, and run Metric Aggregator before starting the test
-	agg, metricShutdownChan, f1Uri, f2Uri, err := testMeta.releaseTestSetup(isReuseFunction, prevF1Uri, prevF2Uri)
+	agg, err := testMeta.releaseTestSetup(ctx, prevDeployments, store)
 	if err != nil {
 		log.Errorf("Error in releaseTestSetup for '%s' function: %v", funcName, err)
 		return testMeta, agg, err
 	}
-	testMeta.AVersionURI = f1Uri
-	testMeta.BVersionURI = f2Uri
 	// TODO: add it to releaseTestSetup
-	doneChan := startPollingForSignal(parentHost, parentPort, id, strategyID, stageData.Name)
+	signalCtx, stopPolling := context.WithCancel(ctx)
+	defer stopPolling() // the test may also end without the signal
+	doneChan := startPollingForSignal(signalCtx, parentHost, parentPort, id, strategyID, stageData.Name)
 	// Clean up the test after a clean finish or an error
-	defer testMeta.releaseTestCleanup(metricShutdownChan)
+	defer testMeta.releaseTestCleanup(agg)
 
 	log.Info("now polling PARENT for the end signal...")
 	beginning := time.Now()
@@ -230,23 +118,26 @@ func ReleaseTestWithSignal(stageData Strategy.Stage, funcMeta *Strategy.Function
 		case <-doneChan:
 			log.Infof("Received external signal to end ReleaseTestWithSignal for '%s' function.", funcName)
 			return testMeta, agg, nil
+		case <-ctx.Done():
+			return testMeta, agg, ctx.Err()
 		default:
 			elapse := time.Since(beginning)
 			// Query the count of proxyTime call metric
-			callCount := int(agg.CallCounts)
+			callCount := int(agg.Calls())
 
+			// the limits apply until the requirements are met. then, the parent decides when the stage ends
+			if !isResultsAlredySent && testMeta.checkLimits(agg, endConditions, beginning) {
+				return testMeta, agg, nil
+			}
 			// If no calls were made, log and wait
 			if callCount == 0 {
 				log.Debugf("Stage: %s - no '%v()' calls, waiting...", testMeta.StageName, funcName)
+			} else if testMeta.checkGuardrails(agg) {
+				return testMeta, agg, nil
 			} else {
-				responseTimes := agg.ProxyTimes
-				var lastResponseTime float64
-
-				if len(responseTimes) == 0 {
-					lastResponseTime = -1 // no value
+				lastResponseTime := agg.LastResponseTime()
+				if lastResponseTime < 0 { // no value
 					log.Errorf("Unexpected! no response time found in Metric Aggregator while call_count exist! Continuing...")
-				} else {
-					lastResponseTime = responseTimes[len(responseTimes)-1]
 				}
 
 				if isResultsAlredySent {
@@ -270,7 +161,7 @@ func ReleaseTestWithSignal(stageData Strategy.Stage, funcMeta *Strategy.Function
 									nextStageName = onSucces
 								}
 
-								err = summary.SendResultSummary(strategyID, nextStageName, id, parentHost, parentPort)
+								err = summary.SendResultSummary(ctx, strategyID, nextStageName, id, parentHost, parentPort)
 								if err != nil {
 									log.Errorf("Failed to send result summary: %v", err)
 								} else {
@@ -289,24 +180,259 @@ func ReleaseTestWithSignal(stageData Strategy.Stage, funcMeta *Strategy.Function
 				}
 			}
 			// Wait before polling again
-			time.Sleep(1 * time.Second)
+			if err := sleep(ctx, 1*time.Second); err != nil {
+				return testMeta, agg, err
+			}
+		}
+	}
+}
+
+// waitForEndConditions polls the Metric Aggregator until at least 'minCalls' are made and 'minDuration' is passed,
+// or until a guardrail is violated (t.Aborted), or a limit is reached (t.EndReason). It returns the context's error if it is cancelled first
+func (t *TestMeta) waitForEndConditions(ctx context.Context, agg *MetricAgg.MetricAggregator, endConditions *endConditions) error {
+	minDuration, minCalls := endConditions.minDuration, endConditions.minCalls
+	beginning := time.Now()
+	for {
+		elapse := time.Since(beginning)
+		// Query the count of proxyTime call metric
+		callCount := int(agg.Calls())
+
+		if t.checkLimits(agg, endConditions, beginning) {
+			return nil
+		}
+		// If no calls were made, log and wait
+		if callCount == 0 {
+			log.Debugf("no '%v()' calls after %v, waiting...", t.FuncName, elapse)
+		} else if t.checkGuardrails(agg) {
+			return nil
+		} else {
+			lastResponseTime := agg.LastResponseTime()
+			if lastResponseTime < 0 { // no value
+				log.Errorf("Unexpected! no response time found in Metric Aggregator while call_count exist! Continuing...")
+			}
+
+			// If the count is at least minCalls, and minDuration passed, return true
+			if callCount >= minCalls {
+				if elapse > minDuration {
+					log.Infof("ReleaseTest successful ('%s'). The minimum call count and duration satisfied. time: %v, calls: %v, last response time: %v",
+						t.StageName, elapse, callCount, lastResponseTime)
+					return nil
+				} else {
+					log.Infof("min call count is done(%v), but min duration not satisfied (%v/%v). last response time: %vms. Continuing to poll...", callCount, elapse, minDuration, lastResponseTime)
+				}
+			} else if elapse > minDuration {
+				log.Infof("min duration is done, but min calls not satisfied (%v/%v). last response time: %vms. Continuing to poll after %v...",
+					callCount, minCalls, lastResponseTime, elapse)
+			} else {
+				log.Infof("Release Test in progress... %v calls | last took %vms | %v elapsed", callCount, lastResponseTime, elapse)
+			}
+		}
+		// Wait before polling again
+		if err := sleep(ctx, 1*time.Second); err != nil {
+			return err
+		}
+	}
+}
+
+// newTestMeta creates the TestMeta of a stage, with the traffic split between the tested versions.
+// The base version is always the first one (f1) as the control, followed by the other variants in the stage's order.
+// A stage that only lists the base version still deploys the new version (with no traffic)
+func newTestMeta(stageData Strategy.Stage, funcMeta *Strategy.Function, releaseID, agentHost string, metrics *MetricAgg.MetricServer, faas FaaS.FaaS) (*TestMeta, error) {
+	funcName := stageData.FuncName
+	trafficPercentages := map[string]int{"base_version": 100}
+	names := []string{"base_version"}
+	for _, variant := range stageData.Variants {
+		if variant.Name == "base_version" {
+			trafficPercentages[variant.Name] = variant.TrafficPercentage
+			continue
+		}
+		if _, err := funcMeta.GetVersionByName(variant.Name); err != nil {
+			log.Warnf("Unknown variant: '%v'. Ignoring it", variant.Name)
+			continue
+		}
+		trafficPercentages[variant.Name] = variant.TrafficPercentage
+		names = append(names, variant.Name)
+	}
+	if len(names) == 1 {
+		trafficPercentages["new_version"] = 0
+		names = append(names, "new_version")
+	}
+
+	testMeta := &TestMeta{
+		FuncName:     funcName,
+		Program:      fmt.Sprintf("test-%s", funcName),
+		StageName:    stageData.Name,
+		ReleaseID:    releaseID,
+		AgentHost:    agentHost,
+		MetricServer: metrics,
+		FaaS:         faas,
+
+		StatisticalTest: stageData.StatisticalTest,
+		Guardrails:      stageData.Guardrails,
+	}
+	totalTraffic := 0
+	for _, name := range names {
+		version, _ := funcMeta.GetVersionByName(name)
+		testMeta.Variants = append(testMeta.Variants, &VariantMeta{
+			Name:              name,
+			DeployName:        deployName(funcMeta, name),
+			Path:              version.Path,
+			Runtime:           version.Env,
+			TrafficPercentage: trafficPercentages[name],
+		})
+		totalTraffic += trafficPercentages[name]
+	}
+	if totalTraffic != 100 {
+		return nil, fmt.Errorf("%w: traffic percentage of the tested versions should sum up to 100. Got %v", ErrInvalidStage, testMeta.trafficSplit())
+	}
+	return testMeta, nil
+}
+
+// DeployNames returns the deployment names of all the versions of a function, e.g. to clean up its test functions
+func DeployNames(funcMeta *Strategy.Function) []string {
+	var names []string
+	for _, version := range funcMeta.VersionNames() {
+		names = append(names, deployName(funcMeta, version))
+	}
+	return names
+}
+
+func deployName(funcMeta *Strategy.Function, version string) string {
+	return fmt.Sprintf("%s%02d", funcMeta.Name, indexOf(funcMeta.VersionNames(), version)+1)
+}
+
+// VariantNames returns the names of the tested versions, in the proxy's order
+func (t *TestMeta) VariantNames() []string {
+	names := make([]string, len(t.Variants))
+	for i, variant := range t.Variants {
+		names[i] = variant.Name
+	}
+	return names
+}
+
+// DeployedURIs returns the URIs of the deployed test functions by version name
+func (t *TestMeta) DeployedURIs() map[string]string {
+	uris := make(map[string]string)
+	for _, variant := range t.Variants {
+		if variant.URI != "" {
+			uris[variant.Name] = variant.URI
 		}
 	}
+	return uris
+}
+
+// trafficSplit returns the traffic split as a readable string, e.g. "base_version:50% new_version:50%"
+func (t *TestMeta) trafficSplit() string {
+	split := make([]string, len(t.Variants))
+	for i, variant := range t.Variants {
+		split[i] = fmt.Sprintf("%s:%v%%", variant.Name, variant.TrafficPercentage)
+	}
+	return strings.Join(split, " ")
+}
+
+// endConditions are the parsed end conditions of a stage (or a Gradual step)
+type endConditions struct {
+	minDuration        time.Duration
+	minCalls           int
+	maxDuration        time.Duration // 0 if not set
+	maxDurationOutcome string
+	maxIdle            time.Duration // 0 if not set
+	maxIdleOutcome     string
 }
 
-// replaces the proxy function with the given (winner) function, and cleanups release test functions
-func (t *TestMeta) ReplaceChosenFunction(fVersion Strategy.Version) {
-	_, err := t.FaaS.Update(t.FuncName, fVersion.Path, fVersion.Env, "http", true, []string{})
+// parseEndConditions returns the minimum duration and the minimum number of calls of a stage, and its limits
+func parseEndConditions(conditions []Strategy.EndCondition) (*endConditions, error) {
+	parsed := &endConditions{}
+	for _, req := range conditions {
+		switch req.Name {
+		case "minCalls":
+			num, err := strconv.Atoi(req.Threshold)
+			if err != nil {
+				return nil, fmt.Errorf("%w: 'minCalls' should be an integer, got '%v'", Strategy.ErrInvalidThreshold, req.Threshold)
+			}
+			parsed.minCalls = num
+		case "minDuration", "maxDuration", "maxIdle":
+			duration, err := time.ParseDuration(req.Threshold)
+			if err != nil {
+				return nil, fmt.Errorf("%w: '%s' should be a duration, got '%v'", Strategy.ErrInvalidThreshold, req.Name, req.Threshold)
+			}
+			outcome := req.Outcome
+			if outcome == "" {
+				outcome = Strategy.OutcomeFail
+			}
+			switch req.Name {
+			case "minDuration":
+				parsed.minDuration = duration
+			case "maxDuration":
+				parsed.maxDuration, parsed.maxDurationOutcome = duration, outcome
+			case "maxIdle":
+				parsed.maxIdle, parsed.maxIdleOutcome = duration, outcome
+			}
+		default:
+			log.Warnf("Unknown requirement: %v. Ignoring it", req.Name)
+		}
+	}
+	return parsed, nil
+}
+
+// checkLimits ends the test (t.EndReason) if it is running longer than maxDuration, or received no calls for maxIdle,
+// and returns true. The succeedIfMetricsOk outcome falls back to fail if a version with traffic has no calls to be judged by
+func (t *TestMeta) checkLimits(agg *MetricAgg.MetricAggregator, endConditions *endConditions, beginning time.Time) bool {
+	elapse := time.Since(beginning)
+	reason, outcome := "", ""
+	if endConditions.maxDuration > 0 && elapse > endConditions.maxDuration {
+		reason = fmt.Sprintf("maxDuration: the end conditions were not met after %v (%v/%v calls)", endConditions.maxDuration, agg.Calls(), endConditions.minCalls)
+		outcome = endConditions.maxDurationOutcome
+	} else if endConditions.maxIdle > 0 {
+		idleSince := agg.LastCall()
+		if idleSince.Before(beginning) { // e.g. no calls yet, or the calls restored from before a restart
+			idleSince = beginning
+		}
+		if time.Since(idleSince) > endConditions.maxIdle {
+			reason = fmt.Sprintf("maxIdle: no calls for %v", endConditions.maxIdle)
+			outcome = endConditions.maxIdleOutcome
+		}
+	}
+	if reason == "" {
+		return false
+	}
+	if outcome == Strategy.OutcomeSucceedIfMetricsOk {
+		for i, variant := range t.Variants {
+			if variant.TrafficPercentage > 0 && agg.VariantCalls(i) == 0 {
+				log.Warnf("'%s' has no calls of f%d (%s) to be judged by. Failing the stage instead", t.StageName, i+1, variant.Name)
+				outcome = Strategy.OutcomeFail
+				break
+			}
+		}
+	}
+	t.EndReason, t.EndOutcome = reason, outcome
+	log.Warnf("Stage '%s' ended before its end conditions were met. %s (outcome: %s)", t.StageName, reason, outcome)
+	return true
+}
+
+// ReplaceChosenFunction replaces the proxy function with the given (winner or rollback) version, and cleans up the test functions.
+// If the version can't be deployed, it returns an ErrDeployFailed, and the test functions are kept (e.g. for a rollback)
+func (t *TestMeta) ReplaceChosenFunction(ctx context.Context, fVersion Strategy.Version) error {
+	_, err := t.FaaS.Update(ctx, t.FuncName, fVersion.Path, fVersion.Env, "http", true, []string{})
 	if err != nil {
-		log.Errorf("error replacing proxy function with %s's selected version: %v", t.FuncName, err)
+		return fmt.Errorf("%w: replacing '%s' with '%s': %w", ErrDeployFailed, t.FuncName, fVersion.Path, err)
 	}
+	t.Released = &fVersion
 	// Clean up the functions
-	err = t.FaaS.Delete(t.AVersionName)
-	if err != nil {
-		log.Errorf("Error cleaning up function %v: %v", t.AVersionName, err)
+	for _, variant := range t.Variants {
+		err = t.FaaS.Delete(ctx, variant.DeployName)
+		if err != nil {
+			log.Errorf("Error cleaning up function %v: %v", variant.DeployName, err)
+		}
 	}
-	err = t.FaaS.Delete(t.BVersionName)
-	if err != nil {
-		log.Errorf("Error cleaning up function %v: %v", t.BVersionName, err)
+	return nil
+}
+
+func indexOf(names []string, name string) int {
+	for i, n := range names {
+		if n == name {
+			return i
+		}
 	}
+	return -1
 }
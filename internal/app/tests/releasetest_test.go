@@ -0,0 +1,116 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	FaaS "umbilical-choir-core/internal/app/faas"
+	"umbilical-choir-core/internal/app/fakeparent"
+	MetricAgg "umbilical-choir-core/internal/app/metric_aggregator"
+	Strategy "umbilical-choir-core/internal/app/strategy"
+)
+
+func TestMain(m *testing.M) {
+	log.SetLevel(log.WarnLevel)
+	os.Exit(m.Run())
+}
+
+var (
+	signalFunction = &Strategy.Function{
+		Name:        "sieve",
+		BaseVersion: Strategy.Version{Path: "fns/base", Env: "nodejs"},
+		NewVersion:  Strategy.Version{Path: "fns/new", Env: "nodejs"},
+	}
+	signalStage = Strategy.Stage{
+		Name:     "wait",
+		Type:     "WaitForSignal",
+		FuncName: "sieve",
+		Variants: []Strategy.Variant{
+			{Name: "base_version", TrafficPercentage: 50},
+			{Name: "new_version", TrafficPercentage: 50},
+		},
+		MetricsConditions: []Strategy.MetricCondition{{Name: "errorRate", Threshold: "<0.1"}},
+		EndConditions:     []Strategy.EndCondition{{Name: "minDuration", Threshold: "1s"}, {Name: "minCalls", Threshold: "10"}},
+		EndAction:         Strategy.EndAction{OnSuccess: "rollout", OnFailure: "rollback"},
+	}
+)
+
+// runSignalStage runs signalStage on a mock FaaS while calling the function, against the fake parent
+func runSignalStage(t *testing.T, ctx context.Context, parent *fakeparent.Server) (*TestMeta, error) {
+	t.Helper()
+	mock, err := FaaS.NewMockAdapter("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+	metrics := MetricAgg.NewMetricServer("127.0.0.1:0")
+	if err := metrics.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer metrics.Close()
+
+	loadCtx, stopLoad := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for loadCtx.Err() == nil {
+			mock.Call("sieve", "10")
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+	defer func() { stopLoad(); <-done }()
+
+	testMeta, _, err := ReleaseTestWithSignal(ctx, signalStage, signalFunction, nil, nil, metrics, "127.0.0.1", mock,
+		"r1", parent.Host, parent.Port, "agent-1")
+	return testMeta, err
+}
+
+func TestReleaseTestWithSignalEndsOnSignal(t *testing.T) {
+	parent := fakeparent.New()
+	defer parent.Close()
+	parent.EndStageAfter("wait", 0)
+
+	testMeta, err := runSignalStage(t, context.Background(), parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if testMeta.Aborted || testMeta.EndReason != "" {
+		t.Errorf("the stage was aborted (%v) or ended early (%s)", testMeta.Aborted, testMeta.EndReason)
+	}
+	results := parent.Results()
+	if len(results) != 1 || results[0].ID != "agent-1" || results[0].ReleaseID != "r1" {
+		t.Fatalf("the parent received %+v, want one result of agent-1 for r1", results)
+	}
+	if summary := results[0].StageSummaries[0]; summary.StageName != "wait" || summary.Status != MetricAgg.SuccessWaiting {
+		t.Errorf("the parent received '%s' %v, want 'wait' %v", summary.StageName, summary.Status, MetricAgg.SuccessWaiting)
+	}
+	want := fakeparent.EndStagePoll{ID: "agent-1", StrategyID: "r1", StageName: "wait"}
+	if polls := parent.EndStagePolls(); len(polls) == 0 || polls[len(polls)-1] != want {
+		t.Errorf("the parent received the end_stage polls %+v, want %+v", polls, want)
+	}
+}
+
+func TestReleaseTestWithSignalCancelled(t *testing.T) {
+	parent := fakeparent.New()
+	defer parent.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { // cancelled while waiting for the signal, which never comes
+		if _, err := parent.WaitForResults(1, 30*time.Second); err != nil {
+			t.Error(err)
+		}
+		cancel()
+	}()
+
+	_, err := runSignalStage(t, ctx, parent)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+	if results := parent.Results(); len(results) != 1 || results[0].StageSummaries[0].Status != MetricAgg.SuccessWaiting {
+		t.Errorf("the parent received %+v, want one SuccessWaiting result", results)
+	}
+}
@@ -1,120 +1,146 @@
 package tests
 
 import (
+	"context"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	FaaS "umbilical-choir-core/internal/app/faas"
 	MetricAggregator "umbilical-choir-core/internal/app/metric_aggregator"
 )
 
-// if withoutDeployingFunctions is set to true, the function will not be deployed, and f1UriAdd and f2UriAdd must be provided
-func (t *TestMeta) releaseTestSetup(withoutDeployingFunctions bool, f1UriAdd, f2UriAdd string) (*MetricAggregator.MetricAggregator, chan struct{}, string, string, error) {
+// releaseTestSetup starts the metric aggregator, and deploys the tested versions and the proxy.
+// The aggregator is registered on the metric server before the proxy is deployed, so no pushed metrics are lost; release it by releaseTestCleanup.
+// The versions in prevDeployments (version name -> URI) are not deployed again, but re-used.
+// If a store is given, the metrics already persisted in it are restored, and the received ones are persisted to it
+func (t *TestMeta) releaseTestSetup(ctx context.Context, prevDeployments map[string]string, store *MetricAggregator.Store) (*MetricAggregator.MetricAggregator, error) {
+	log.Info("Starting metric aggregator")
+	aggregator := MetricAggregator.NewMetricAggregator(t.Program, t.StageName, t.VariantNames())
+	aggregator.ReleaseID = t.ReleaseID
+	if t.StatisticalTest != nil {
+		aggregator.Confidence = t.StatisticalTest.Confidence
+		aggregator.MinSamples = t.StatisticalTest.MinSamples
+	}
+	for _, guardrail := range t.Guardrails { // keep the timestamped metrics for the longest guardrail window
+		if window := guardrail.WindowDuration(); window > aggregator.Retention {
+			aggregator.Retention = window
+		}
+	}
+	if store != nil {
+		if err := aggregator.Restore(store); err != nil {
+			log.Errorf("%v. Starting with no metrics", err)
+			aggregator.Reset()
+		}
+		aggregator.Store = store
+	}
+	// e.g. another stage of the function is running. its proxy is not replaced
+	if err := t.MetricServer.Register(aggregator); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidStage, err)
+	}
+	t.pushSecret = aggregator.Secret
+
 	log.Info("Setting up release test and proxy functions")
-	programName := fmt.Sprintf("test-%s", t.FuncName) // TODO: update this to be more descriptive
-	var f1Uri, f2Uri string
-	var err error
+	if err := t.deployFunctions(ctx, prevDeployments); err != nil {
+		t.MetricServer.Unregister(aggregator)
+		return nil, err
+	}
 
-	if !withoutDeployingFunctions {
-		// duplicate the function with a new name
-		// Check if the function exists before updating
-		exists, err := t.FaaS.FunctionExists(t.AVersionName)
-		if err != nil {
-			log.Errorf("error when checking if the function '%s' exists: %v", t.AVersionName, err)
-			return nil, nil, f1Uri, f2Uri, err
-		}
-		if exists {
-			log.Infof("Function '%s' already exists, retrieving URI", t.AVersionName)
-			f1Uri, err = t.FaaS.FunctionUri(t.AVersionName)
-			if err != nil {
-				log.Errorf("error when retrieving URI for function '%s': %v", t.AVersionName, err)
-				return nil, nil, f1Uri, f2Uri, err
-			}
-		} else {
-			log.Infof("duplicating the base function '%s' from '%s'", t.AVersionName, t.AVersionPath)
-			f1Uri, err = t.FaaS.Upload(t.AVersionName, t.AVersionPath, t.AVersionRuntime, "http", true, []string{})
-			if err != nil {
-				log.Errorf("error when duplicating the '%s' function as '%s': %v", t.FuncName, t.AVersionName, err)
-				return nil, nil, f1Uri, f2Uri, err
+	log.Info("Successfully completed releaseTestSetup")
+	return aggregator, nil
+}
+
+// deployFunctions deploys the tested versions (or re-uses the ones in prevDeployments), and the proxy/metric function with the func name
+func (t *TestMeta) deployFunctions(ctx context.Context, prevDeployments map[string]string) error {
+	for _, variant := range t.Variants {
+		if uri, ok := prevDeployments[variant.Name]; ok {
+			if uri == "" { // guard clause
+				return fmt.Errorf("%w: re-using the deployment of '%s', but its URI is empty", ErrDeployFailed, variant.Name)
 			}
+			variant.URI = uri // re-register the previously deployed function
+			log.Infof("Skipped func deployment. Re-using the previously deployed '%s': %s", variant.Name, variant.URI)
+			continue
 		}
 
-		// deploy the new version
-		// Check if the new version function exists before updating
-		exists, err = t.FaaS.FunctionExists(t.BVersionName)
+		// Check if the function exists before deploying
+		exists, err := t.FaaS.FunctionExists(ctx, variant.DeployName)
 		if err != nil {
-			log.Errorf("error when checking if the function '%s' exists: %v", t.BVersionName, err)
-			return nil, nil, f1Uri, f2Uri, err
+			log.Errorf("error when checking if the function '%s' exists: %v", variant.DeployName, err)
+			return err
 		}
 		if exists {
-			log.Infof("Function '%s' already exists, retrieving URI", t.BVersionName)
-			f2Uri, err = t.FaaS.FunctionUri(t.BVersionName)
+			log.Infof("Function '%s' already exists, retrieving URI", variant.DeployName)
+			variant.URI, err = t.FaaS.FunctionUri(ctx, variant.DeployName)
 			if err != nil {
-				log.Errorf("error when retrieving URI for function '%s': %v", t.BVersionName, err)
-				return nil, nil, f1Uri, f2Uri, err
+				log.Errorf("error when retrieving URI for function '%s': %v", variant.DeployName, err)
+				return err
 			}
 		} else {
-			log.Infof("now, deploying the new version as '%s' from '%s'", t.BVersionName, t.BVersionPath)
-			f2Uri, err = t.FaaS.Upload(t.BVersionName, t.BVersionPath, t.BVersionRuntime, "http", true, []string{})
+			log.Infof("now, deploying '%s' as '%s' from '%s'", variant.Name, variant.DeployName, variant.Path)
+			variant.URI, err = t.FaaS.Upload(ctx, variant.DeployName, variant.Path, variant.Runtime, "http", true, []string{})
 			if err != nil {
-				log.Errorf("error when deploying the new '%s' function as '%s': %v", t.FuncName, t.BVersionName, err)
-				return nil, nil, f1Uri, f2Uri, err
+				log.Errorf("error when deploying the '%s' of '%s' function as '%s': %v", variant.Name, t.FuncName, variant.DeployName, err)
+				return fmt.Errorf("%w: '%s' as '%s': %w", ErrDeployFailed, variant.Name, variant.DeployName, err)
 			}
 		}
-	} else {
-		if f1UriAdd == "" || f2UriAdd == "" { // guard clause
-			log.Fatalf("Error: withoutDeployingFunctions is set to true, but f1UriAdd or f2UriAdd is empty")
-		}
-		f1Uri = f1UriAdd // re-register the previously deployed function
-		f2Uri = f2UriAdd
-		log.Infof("Skipped func deployment. Re-using the previously deployed functions: f1Uri: %s, f2Uri: %s", f1Uri, f2Uri)
 	}
 
 	// deploy the proxy/metric function with the func name
+	return t.deployProxy(ctx)
+}
+
+// deployProxy deploys (or updates) the proxy/metric function with the func name, and the current traffic split.
+// The proxy gets 'F<n>ENDPOINT', 'F<n>NAME' and 'F<n>CHANCE' (traffic percentage) for each tested version.
+// 'BCHANCE' is kept for the proxy builds that only support two versions (f1 and f2).
+// The proxy pushes the metrics to 'AGENTSCHEME'://'AGENTHOST':'AGENTPORT' (the metric server's) as 'PROGRAM', with 'STAGE' on the newer builds,
+// signed by 'PUSHSECRET' if the metric server requires it
+func (t *TestMeta) deployProxy(ctx context.Context) error {
 	args := []string{
-		fmt.Sprintf("F1ENDPOINT=%s", f1Uri),
-		fmt.Sprintf("F2ENDPOINT=%s", f2Uri),
 		fmt.Sprintf("AGENTHOST=%s", t.AgentHost),
-		fmt.Sprintf("F1NAME=%s", t.AVersionName),
-		fmt.Sprintf("F2NAME=%s", t.BVersionName),
-		fmt.Sprintf("PROGRAM=%s", programName),
-		fmt.Sprintf("BCHANCE=%v", t.BTrafficPercentage),
+		fmt.Sprintf("AGENTPORT=%s", t.MetricServer.Port()),
+		fmt.Sprintf("AGENTSCHEME=%s", t.MetricServer.Scheme()),
+		fmt.Sprintf("PROGRAM=%s", t.Program),
+		fmt.Sprintf("STAGE=%s", t.StageName),
+		fmt.Sprintf("BCHANCE=%v", t.Variants[1].TrafficPercentage),
+		fmt.Sprintf("FCOUNT=%d", len(t.Variants)),
+	}
+	if t.pushSecret != "" {
+		args = append(args, fmt.Sprintf("PUSHSECRET=%s", t.pushSecret))
+	}
+	for i, variant := range t.Variants {
+		args = append(args,
+			fmt.Sprintf("F%dENDPOINT=%s", i+1, variant.URI),
+			fmt.Sprintf("F%dNAME=%s", i+1, variant.DeployName),
+			fmt.Sprintf("F%dCHANCE=%v", i+1, variant.TrafficPercentage),
+		)
 	}
 
 	var proxyPath string
-	switch t.FaaS.(type) {
+	switch FaaS.Unwrap(t.FaaS).(type) {
 	case *FaaS.TinyFaaSAdapter:
 		proxyPath = "../umbilical-choir-proxy/go"
 		//proxyPath = "../umbilical-choir-proxy/binary/_tinyfaas-arm64"
 	case *FaaS.GCPAdapter:
 		proxyPath = "../umbilical-choir-proxy/binary/_gcp-amd64"
+	case *FaaS.OpenFaaSAdapter, *FaaS.KnativeAdapter:
+		proxyPath = "../umbilical-choir-proxy/container" // built as an image, serving on $PORT
+	case *FaaS.MockAdapter:
+		proxyPath = FaaS.MockProxy // the built-in proxy
+	case *FaaS.LambdaAdapter:
+		proxyPath = "../umbilical-choir-proxy/binary/_lambda-amd64" // a 'bootstrap' executable for the provided.al2023 runtime
 	default:
-		return nil, nil, f1Uri, f2Uri, fmt.Errorf("unknown FaaS type: %T", t.FaaS)
+		return fmt.Errorf("%w: unknown FaaS type: %T", ErrDeployFailed, t.FaaS)
 	}
 
-	log.Infof("now, uploading proxy function as '%s' from '%s'", t.FuncName, proxyPath)
-	_, err = t.FaaS.Update(t.FuncName, proxyPath, "go", "http", true, args)
+	log.Infof("now, uploading proxy function as '%s' from '%s' (%s)", t.FuncName, proxyPath, t.trafficSplit())
+	_, err := t.FaaS.Update(ctx, t.FuncName, proxyPath, "go", "http", true, args)
 	if err != nil {
 		log.Errorf("error when deploying the proxy function as '%s': %v", t.FuncName, err)
-		return nil, nil, f1Uri, f2Uri, err
+		return fmt.Errorf("%w: the proxy as '%s': %w", ErrDeployFailed, t.FuncName, err)
 	}
 	log.Infof("uploaded proxy function as '%s'. The traffic will now be managed by the proxy", t.FuncName)
-
-	log.Info("Starting metric aggregator")
-	aggregator := &MetricAggregator.MetricAggregator{
-		Program:   programName,
-		StageName: t.StageName,
-	}
-	shutdownChan := make(chan struct{})
-	go MetricAggregator.StartMetricServer(aggregator, shutdownChan)
-
-	log.Info("Successfully completed releaseTestSetup")
-	return aggregator, shutdownChan, f1Uri, f2Uri, nil
+	return nil
 }
 
 // releaseTestCleanup clean up the program after the test
-func (t *TestMeta) releaseTestCleanup(metricShutdownChan chan struct{}) {
-
-	close(metricShutdownChan) // shutdown the metric aggregator
-
-	//return nil
+func (t *TestMeta) releaseTestCleanup(aggregator *MetricAggregator.MetricAggregator) {
+	t.MetricServer.Unregister(aggregator) // its later metrics are rejected
 }
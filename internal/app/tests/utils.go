@@ -1,90 +1,71 @@
 package tests
 
 import (
+	"context"
+	"fmt"
 	log "github.com/sirupsen/logrus"
+	"math"
 	"time"
 	MetricAgg "umbilical-choir-core/internal/app/metric_aggregator"
 	"umbilical-choir-core/internal/app/poller"
 	Strategy "umbilical-choir-core/internal/app/strategy"
 )
 
-// used for WaitForSignal stage types. if it gets a "shouldEnd" signal, it will return
-func startPollingForSignal(host, port, id, strategyID, stageName string) chan struct{} {
+// used for WaitForSignal stage types. if it gets a "shouldEnd" signal, it will return. It stops polling when the context is done
+func startPollingForSignal(ctx context.Context, host, port, id, strategyID, stageName string) chan struct{} {
 	doneChan := make(chan struct{})
 	waitTime := 5 * time.Second
 	log.Infof("Polling for signal to end the test for stage '%s' after %v", stageName, waitTime)
 	go func() {
-		time.Sleep(waitTime)
+		if sleep(ctx, waitTime) != nil {
+			return
+		}
 		for {
-			select {
-			case <-doneChan:
+			endTest, err := poller.PollForSignal(ctx, host, port, id, strategyID, stageName)
+			//log.Debugf("Polled for signal: %v", endTest)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				log.Errorf("Polling error: %v. 1 sec backoff", err)
+			} else if endTest {
+				close(doneChan)
+				return
+			}
+			if sleep(ctx, 1*time.Second) != nil {
 				return
-			default:
-				endTest, err := poller.PollForSignal(host, port, id, strategyID, stageName)
-				//log.Debugf("Polled for signal: %v", endTest)
-				if err != nil {
-					log.Errorf("Polling error: %v. 1 sec backoff", err)
-					time.Sleep(1 * time.Second)
-					continue
-				}
-				if endTest {
-					close(doneChan)
-					return
-				}
 			}
-			time.Sleep(1 * time.Second)
 		}
 	}()
 	return doneChan
 }
 
-// ProcessStageResult processes the result of a stage, set the summary.Status, and returns if the stage was successful and if a rollback is required
-func ProcessStageResult(stage Strategy.Stage, summary *MetricAgg.ResultSummary) (bool, bool) {
-	success := true
-	rollbackRequired := false
+// sleep waits for the given duration, or returns the context's error if it is done first
+func sleep(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
 
-	for _, metricCondition := range stage.MetricsConditions {
-		switch metricCondition.Name {
-		case "responseTime":
-			switch metricCondition.CompareWith {
-			case "Median":
-				if metricCondition.IsThresholdMet(summary.F2TimesSummary.Median) {
-					log.Infof("Median response time (%v) requirement for f2 met: %v", summary.F2TimesSummary.Median, metricCondition.Threshold)
-				} else {
-					log.Warnf("Median response time (%v) requirement for f2 NOT met: %v", summary.F2TimesSummary.Median, metricCondition.Threshold)
-					success = false
-				}
-			case "Minimum":
-				if metricCondition.IsThresholdMet(summary.F2TimesSummary.Minimum) {
-					log.Infof("Minimum response time (%v) requirement for f2 met: %v", summary.F2TimesSummary.Minimum, metricCondition.Threshold)
-				} else {
-					log.Warnf("Minimum response time (%v) requirement for f2 NOT met: %v", summary.F2TimesSummary.Minimum, metricCondition.Threshold)
-					success = false
-				}
-			case "Maximum":
-				if metricCondition.IsThresholdMet(summary.F2TimesSummary.Maximum) {
-					log.Infof("Maximum response time (%v) requirement for f2 met: %v", summary.F2TimesSummary.Maximum, metricCondition.Threshold)
-				} else {
-					log.Warnf("Maximum response time (%v) requirement for f2 NOT met: %v", summary.F2TimesSummary.Maximum, metricCondition.Threshold)
-					success = false
-				}
-			default:
-				rollbackRequired = true
-				log.Errorf("Unknown compareWith parameter: %s", metricCondition.CompareWith)
-			}
+// ProcessStageResult processes the result of a stage, set the summary.Status, and returns if the stage was successful and if a rollback is required.
+// Each version tested against the base version (f1) is checked against the metrics conditions. The stage is successful if at least one
+// of them meets all the conditions, and the one with the lowest median response time is set as the summary.Winner
+func ProcessStageResult(stage Strategy.Stage, summary *MetricAgg.ResultSummary) (bool, bool) {
+	passing, rollbackRequired := passingCandidates(stage.MetricsConditions, summary)
+	success := len(passing) > 0
 
-		case "errorRate":
-			if metricCondition.IsThresholdMet(summary.F2ErrRate) {
-				log.Infof("Error rate (%v) requirement for f2 met: %v", summary.F2ErrRate, metricCondition.Threshold)
-			} else {
-				log.Warnf("Error rate (%v) requirement for f2 NOT met: %v", summary.F2ErrRate, metricCondition.Threshold)
-				success = false
-			}
-		default:
-			rollbackRequired = true
-			log.Warnf("Unknown metric condition: %s. Ignoring it", metricCondition.Name)
+	summary.Winner = ""
+	for _, candidate := range passing {
+		if summary.Winner == "" || medianOrInf(candidate) < medianOrInf(*summary.Variant(summary.Winner)) {
+			summary.Winner = candidate.Name
 		}
 	}
+	if success && len(summary.Variants) > 2 {
+		log.Infof("'%s' is chosen among the %d passing versions", summary.Winner, len(passing))
+	}
 
 	if success {
 		summary.Status = MetricAgg.Completed
@@ -97,3 +78,193 @@ func ProcessStageResult(stage Strategy.Stage, summary *MetricAgg.ResultSummary)
 
 	return success, rollbackRequired
 }
+
+// passingCandidates returns the tested versions (other than the base version) which meet all the metrics conditions,
+// and if a condition could not be checked (rollback required)
+func passingCandidates(conditions []Strategy.MetricCondition, summary *MetricAgg.ResultSummary) ([]MetricAgg.VariantSummary, bool) {
+	var passing []MetricAgg.VariantSummary
+	rollbackRequired := false
+	if len(summary.Variants) < 2 {
+		log.Errorf("Unexpected! no version was tested against the base version in '%s'", summary.StageName)
+		return passing, true
+	}
+
+	base := summary.Variants[0]
+	for i, candidate := range summary.Variants[1:] {
+		met := true
+		for _, metricCondition := range conditions {
+			actual, label, err := variantMetricValue(metricCondition, candidate)
+			if err != nil {
+				rollbackRequired = true
+				log.Errorf("%v. Ignoring it", err)
+				continue
+			}
+			var conditionMet bool
+			threshold := metricCondition.Threshold
+			if metricCondition.IsRelative() { // compared with the base version (control)
+				baseValue, _, _ := variantMetricValue(metricCondition, base)
+				if base.Calls == 0 || baseValue < 0 { // unlike while the test runs (violatedCondition), no data to compare with fails the version
+					log.Warnf("%s requirement for f%d (%s) can't be compared with f1 (%s), which has no data: %v", label, i+2, candidate.Name, base.Name, threshold)
+					met = false
+					continue
+				}
+				conditionMet, err = metricCondition.IsThresholdMetAgainst(actual, baseValue)
+				threshold = fmt.Sprintf("%s (%v, f1 had %v)", threshold, metricCondition.ThresholdValue(baseValue), baseValue)
+			} else {
+				conditionMet, err = metricCondition.IsThresholdMet(actual)
+			}
+			if err != nil { // can't be judged, same as an unknown condition
+				rollbackRequired = true
+				met = false
+				log.Errorf("%s requirement for f%d (%s) can't be checked: %v", label, i+2, candidate.Name, err)
+				continue
+			}
+
+			if conditionMet {
+				log.Infof("%s (%v) requirement for f%d (%s) met: %v", label, actual, i+2, candidate.Name, threshold)
+			} else {
+				log.Warnf("%s (%v) requirement for f%d (%s) NOT met: %v", label, actual, i+2, candidate.Name, threshold)
+				met = false
+			}
+		}
+		if sig := candidate.Significance; sig != nil { // statistical decision mode
+			log.Infof("f%d (%s) compared with f1 (%s) at %v confidence: %s (p-values: response time %.4f, error rate %.4f)",
+				i+2, candidate.Name, base.Name, sig.Confidence, sig.Verdict, sig.LatencyPValue, sig.ErrorRatePValue)
+			if sig.Verdict != MetricAgg.NoRegression {
+				met = false
+			}
+		}
+		if met {
+			passing = append(passing, candidate)
+		}
+	}
+	return passing, rollbackRequired
+}
+
+// violatedCondition checks the metrics conditions against the tested versions (other than the base version) while the test runs,
+// and returns true and what was crossed if one of them is actually violated. Unlike passingCandidates, a condition which can't
+// be judged yet (no calls, or no data of the base version to compare with) is not a violation. In the statistical decision mode,
+// only a Regression verdict is a violation: an InsufficientData verdict fails the version at the end of the stage instead
+func violatedCondition(conditions []Strategy.MetricCondition, summary *MetricAgg.ResultSummary) (string, bool) {
+	if len(summary.Variants) < 2 {
+		return "", false
+	}
+	base := summary.Variants[0]
+	for i, candidate := range summary.Variants[1:] {
+		if candidate.Calls == 0 {
+			continue
+		}
+		for _, condition := range conditions {
+			actual, label, err := variantMetricValue(condition, candidate)
+			if err != nil || actual < 0 {
+				continue
+			}
+			var met bool
+			if condition.IsRelative() {
+				baseValue, _, _ := variantMetricValue(condition, base)
+				if base.Calls == 0 || baseValue < 0 { // nothing to compare with yet
+					continue
+				}
+				met, err = condition.IsThresholdMetAgainst(actual, baseValue)
+			} else {
+				met, err = condition.IsThresholdMet(actual)
+			}
+			if err != nil { // left to the final verdict
+				continue
+			}
+			if !met {
+				return fmt.Sprintf("%s of f%d (%s) was %v: %s", label, i+2, candidate.Name, actual, condition.Threshold), true
+			}
+		}
+		if sig := candidate.Significance; sig != nil && sig.Verdict == MetricAgg.Regression {
+			return fmt.Sprintf("f%d (%s) is significantly worse than f1 (%s) at %v confidence (p-values: response time %.4f, error rate %.4f)",
+				i+2, candidate.Name, base.Name, sig.Confidence, sig.LatencyPValue, sig.ErrorRatePValue), true
+		}
+	}
+	return "", false
+}
+
+// checkGuardrails checks the guardrails of the test against the metrics of their window, and returns true if one is violated.
+// A violation aborts the test (t.Aborted), and t.GuardrailViolation tells which guardrail it was
+func (t *TestMeta) checkGuardrails(agg *MetricAgg.MetricAggregator) bool {
+	for _, guardrail := range t.Guardrails {
+		var summary *MetricAgg.ResultSummary
+		if window := guardrail.WindowDuration(); window > 0 {
+			summary = agg.SummarizeWindow(window)
+		} else {
+			summary = agg.SummarizeResult()
+		}
+		if len(summary.Variants) < 2 {
+			continue
+		}
+		condition := guardrail.Condition()
+		base := summary.Variants[0]
+		for i, variant := range summary.Variants[1:] {
+			if variant.Calls == 0 || (guardrail.Variant != "" && guardrail.Variant != variant.Name) {
+				continue
+			}
+			actual, label, err := variantMetricValue(condition, variant)
+			if err != nil || actual < 0 {
+				continue
+			}
+			var violated bool
+			if condition.IsRelative() {
+				baseValue, _, _ := variantMetricValue(condition, base)
+				if base.Calls == 0 || baseValue < 0 { // nothing to compare with yet
+					continue
+				}
+				violated, err = condition.IsThresholdMetAgainst(actual, baseValue)
+			} else {
+				violated, err = condition.IsThresholdMet(actual)
+			}
+			if err != nil {
+				log.Errorf("Guardrail '%s' of stage '%s' can't be checked: %v. Ignoring it", guardrail.Name, t.StageName, err)
+				break
+			}
+			if violated {
+				window := guardrail.Window
+				if window == "" {
+					window = "the stage"
+				}
+				t.GuardrailViolation = fmt.Sprintf("%s of f%d (%s) was %v over %s: %s", label, i+2, variant.Name, actual, window, guardrail.Threshold)
+				t.Aborted = true
+				log.Warnf("Guardrail violated in stage '%s'. %s. Aborting the stage", t.StageName, t.GuardrailViolation)
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// variantMetricValue returns the value of a tested version that the metric condition is checked against, and its label
+func variantMetricValue(metricCondition Strategy.MetricCondition, variant MetricAgg.VariantSummary) (float64, string, error) {
+	switch metricCondition.Name {
+	case "responseTime":
+		value, ok := variant.TimesSummary.Value(metricCondition.CompareWith)
+		if !ok {
+			return 0, "", fmt.Errorf("unknown compareWith parameter: %s", metricCondition.CompareWith)
+		}
+		return value, fmt.Sprintf("%s response time", metricCondition.CompareWith), nil
+	case "errorRate":
+		return variant.ErrRate, "Error rate", nil
+	default:
+		return 0, "", fmt.Errorf("unknown metric condition: %s", metricCondition.Name)
+	}
+}
+
+// medianOrInf returns the median response time of a version, or +Inf if it has no calls
+func medianOrInf(variant MetricAgg.VariantSummary) float64 {
+	if variant.TimesSummary.Median < 0 {
+		return math.Inf(1)
+	}
+	return variant.TimesSummary.Median
+}
+
+// candidateCalls returns the number of calls to the versions tested against the base version
+func candidateCalls(agg *MetricAgg.MetricAggregator) float64 {
+	var calls float64
+	for i := 1; i < len(agg.Variants); i++ {
+		calls += agg.VariantCalls(i)
+	}
+	return calls
+}
@@ -0,0 +1,70 @@
+package tests
+
+import (
+	"testing"
+
+	MetricAgg "umbilical-choir-core/internal/app/metric_aggregator"
+	Strategy "umbilical-choir-core/internal/app/strategy"
+)
+
+func variantSummary(name string, calls, median, errRate float64) MetricAgg.VariantSummary {
+	times := MetricAgg.TimeSummary{Median: -1, Minimum: -1, Maximum: -1, Mean: -1, P90: -1, P95: -1, P99: -1} // no successful calls
+	if median >= 0 {
+		times = MetricAgg.TimeSummary{Median: median, Minimum: median, Maximum: median, Mean: median, P90: median, P95: median, P99: median}
+	}
+	return MetricAgg.VariantSummary{Name: name, Calls: calls, TimesSummary: times, ErrRate: errRate}
+}
+
+func TestRelativeConditionWithoutBaseData(t *testing.T) {
+	conditions := []Strategy.MetricCondition{
+		{Name: "responseTime", Threshold: "<=base*1.1", CompareWith: "Median"},
+		{Name: "errorRate", Threshold: "<=base+0.01"},
+	}
+	tests := []struct {
+		name         string
+		base, new    MetricAgg.VariantSummary
+		wantViolated bool // while the test runs
+		wantPassing  bool // at the end of the stage
+	}{
+		{"only new_version was called", variantSummary("base_version", 0, -1, 0), variantSummary("new_version", 4, 10, 0), false, false},
+		{"all base_version calls failed", variantSummary("base_version", 4, -1, 1), variantSummary("new_version", 4, 10, 0), false, false},
+		{"new_version within the thresholds", variantSummary("base_version", 4, 10, 0), variantSummary("new_version", 4, 10.5, 0), false, true},
+		{"new_version slower than base_version", variantSummary("base_version", 4, 10, 0), variantSummary("new_version", 4, 20, 0), true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			summary := &MetricAgg.ResultSummary{StageName: "canary", Variants: []MetricAgg.VariantSummary{tt.base, tt.new}}
+			if _, violated := violatedCondition(conditions, summary); violated != tt.wantViolated {
+				t.Errorf("violatedCondition() = %v, want %v", violated, tt.wantViolated)
+			}
+			if passing, _ := passingCandidates(conditions, summary); (len(passing) == 1) != tt.wantPassing {
+				t.Errorf("passingCandidates() = %v, want passing: %v", passing, tt.wantPassing)
+			}
+		})
+	}
+}
+
+func TestSignificanceVerdictWhileRunning(t *testing.T) {
+	tests := []struct {
+		verdict      string
+		wantViolated bool // while the test runs
+		wantPassing  bool // at the end of the stage
+	}{
+		{MetricAgg.InsufficientData, false, false},
+		{MetricAgg.NoRegression, false, true},
+		{MetricAgg.Regression, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.verdict, func(t *testing.T) {
+			candidate := variantSummary("new_version", 4, 10, 0)
+			candidate.Significance = &MetricAgg.Significance{Confidence: 0.95, LatencyPValue: -1, ErrorRatePValue: -1, Verdict: tt.verdict}
+			summary := &MetricAgg.ResultSummary{StageName: "canary", Variants: []MetricAgg.VariantSummary{variantSummary("base_version", 4, 10, 0), candidate}}
+			if _, violated := violatedCondition(nil, summary); violated != tt.wantViolated {
+				t.Errorf("violatedCondition() = %v, want %v", violated, tt.wantViolated)
+			}
+			if passing, _ := passingCandidates(nil, summary); (len(passing) == 1) != tt.wantPassing {
+				t.Errorf("passingCandidates() = %v, want passing: %v", passing, tt.wantPassing)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+// Package tracing records the agent's phases (poll, download, deploy, test and report) as OpenTelemetry spans.
+// Without a tracing exporter in the config, the spans are no-ops
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"umbilical-choir-core/internal/app/config"
+)
+
+const (
+	serviceName = "umbilical-choir-agent"
+	tracerName  = "umbilical-choir-core"
+)
+
+// the attributes of the spans
+var (
+	ReleaseID = attribute.Key("uc.release.id")
+	Stage     = attribute.Key("uc.stage")
+	StageType = attribute.Key("uc.stage.type")
+	Function  = attribute.Key("uc.function")
+	Deployed  = attribute.Key("uc.faas.function") // the function deployed on the FaaS, e.g. a tested version ('sieve02') or the proxy ('sieve')
+	AgentID   = attribute.Key("uc.agent.id")
+)
+
+// Setup sets the global tracer provider by the tracing config: the spans are exported over OTLP/HTTP, or written to stdout or a file as JSON.
+// It returns a function which flushes the spans and stops exporting, to call before exiting
+func Setup(ctx context.Context, cfg *config.Config) (func(context.Context) error, error) {
+	var exporter sdktrace.SpanExporter
+	var file *os.File
+	var err error
+	switch cfg.Tracing.Exporter {
+	case "":
+		return func(context.Context) error { return nil }, nil
+	case "otlp": // OTEL_EXPORTER_OTLP_* are used for the options not set
+		var options []otlptracehttp.Option
+		if cfg.Tracing.Endpoint != "" {
+			options = append(options, otlptracehttp.WithEndpoint(cfg.Tracing.Endpoint))
+		}
+		if cfg.Tracing.Insecure {
+			options = append(options, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(ctx, options...)
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	case "file":
+		if cfg.Tracing.File == "" {
+			return nil, fmt.Errorf("no file set for the 'file' tracing exporter")
+		}
+		file, err = os.OpenFile(cfg.Tracing.File, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open the tracing file: %v", err)
+		}
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(file))
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter: '%s'", cfg.Tracing.Exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the '%s' tracing exporter: %v", cfg.Tracing.Exporter, err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(serviceName), semconv.HostName(cfg.Agent.Host)))
+	if err != nil {
+		log.Warnf("Failed to describe the agent in the traces: %v", err)
+		res = resource.Default()
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	log.Infof("Exporting the traces to '%s'", cfg.Tracing.Exporter)
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if file != nil {
+			file.Close()
+		}
+		return err
+	}, nil
+}
+
+type attributesKey struct{}
+
+// WithAttributes returns a context whose spans (see Start) get the given attributes too, e.g. the release ID for all the spans of a release
+func WithAttributes(ctx context.Context, attributes ...attribute.KeyValue) context.Context {
+	return context.WithValue(ctx, attributesKey{}, append(contextAttributes(ctx), attributes...))
+}
+
+func contextAttributes(ctx context.Context) []attribute.KeyValue {
+	attributes, _ := ctx.Value(attributesKey{}).([]attribute.KeyValue)
+	return attributes[:len(attributes):len(attributes)] // appending copies
+}
+
+// Start starts a span as a child of the context's span, with the attributes of the context and the given ones
+func Start(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(append(contextAttributes(ctx), attributes...)...))
+}
+
+// End ends a span, with the error (if any) as its status
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,177 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"umbilical-choir-core/internal/app/config"
+)
+
+func TestMain(m *testing.M) {
+	log.SetLevel(log.WarnLevel)
+	os.Exit(m.Run())
+}
+
+// record sets a global tracer provider which records the ended spans, until the end of the test
+func record(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+	return recorder
+}
+
+// attributes returns the attributes of a span by their keys
+func attributes(span sdktrace.ReadOnlySpan) map[attribute.Key]string {
+	values := map[attribute.Key]string{}
+	for _, kv := range span.Attributes() {
+		values[kv.Key] = kv.Value.Emit()
+	}
+	return values
+}
+
+func TestStartWithAttributes(t *testing.T) {
+	recorder := record(t)
+	ctx := WithAttributes(context.Background(), ReleaseID.String("1"))
+	stageCtx := WithAttributes(ctx, Stage.String("canary"))
+	otherCtx := WithAttributes(ctx, Stage.String("rollout")) // does not share (overwrite) the stage's attributes
+
+	_, span := Start(stageCtx, "Test", StageType.String("Canary"))
+	End(span, nil)
+	_, other := Start(otherCtx, "Test")
+	End(other, nil)
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("recorded %d spans, want 2", len(spans))
+	}
+	tests := []struct {
+		span sdktrace.ReadOnlySpan
+		want map[attribute.Key]string
+	}{
+		{spans[0], map[attribute.Key]string{ReleaseID: "1", Stage: "canary", StageType: "Canary"}},
+		{spans[1], map[attribute.Key]string{ReleaseID: "1", Stage: "rollout"}},
+	}
+	for i, test := range tests {
+		if got := attributes(test.span); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("span %d: got attributes %v, want %v", i, got, test.want)
+		}
+	}
+}
+
+func TestStartNestsSpans(t *testing.T) {
+	recorder := record(t)
+	ctx, release := Start(context.Background(), "Release")
+	stageCtx, test := Start(ctx, "Test")
+	_, upload := Start(stageCtx, "FaaS.Upload")
+	End(upload, nil)
+	End(test, nil)
+	End(release, nil)
+
+	spans := recorder.Ended()
+	if len(spans) != 3 {
+		t.Fatalf("recorded %d spans, want 3", len(spans))
+	}
+	for i, parent := range []sdktrace.ReadOnlySpan{spans[1], spans[2], nil} {
+		span := spans[i]
+		if span.SpanContext().TraceID() != spans[2].SpanContext().TraceID() {
+			t.Errorf("'%s' is not in the release's trace", span.Name())
+		}
+		if parent == nil {
+			if span.Parent().IsValid() {
+				t.Errorf("'%s' has a parent, want a root span", span.Name())
+			}
+		} else if span.Parent().SpanID() != parent.SpanContext().SpanID() {
+			t.Errorf("'%s' is not a child of '%s'", span.Name(), parent.Name())
+		}
+	}
+}
+
+func TestEndRecordsError(t *testing.T) {
+	recorder := record(t)
+	_, failed := Start(context.Background(), "FaaS.Upload")
+	End(failed, fmt.Errorf("upload failed"))
+	_, succeeded := Start(context.Background(), "FaaS.Upload")
+	End(succeeded, nil)
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("recorded %d spans, want 2", len(spans))
+	}
+	if status := spans[0].Status(); status.Code != codes.Error || status.Description != "upload failed" {
+		t.Errorf("got status %+v for an error", status)
+	}
+	if events := spans[0].Events(); len(events) != 1 || events[0].Name != "exception" {
+		t.Errorf("got events %+v, want the error", events)
+	}
+	if status := spans[1].Status(); status.Code != codes.Unset || len(spans[1].Events()) != 0 {
+		t.Errorf("got status %+v and events %+v without an error", status, spans[1].Events())
+	}
+}
+
+func TestSetup(t *testing.T) {
+	tests := []struct {
+		name     string
+		exporter string
+		wantErr  string
+	}{
+		{"disabled", "", ""},
+		{"unknown exporter", "jaeger", "unknown tracing exporter"},
+		{"file without a path", "file", "no file set"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := &config.Config{}
+			cfg.Tracing.Exporter = test.exporter
+			shutdown, err := Setup(context.Background(), cfg)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Errorf("got %v, want %s", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := shutdown(context.Background()); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestSetupFileExporter(t *testing.T) {
+	previous := otel.GetTracerProvider()
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+	cfg := &config.Config{}
+	cfg.Tracing.Exporter, cfg.Tracing.File = "file", filepath.Join(t.TempDir(), "traces.json")
+	shutdown, err := Setup(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, span := Start(WithAttributes(context.Background(), ReleaseID.String("1")), "Release")
+	End(span, nil)
+	if err := shutdown(context.Background()); err != nil { // flushes the span
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(cfg.Tracing.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"Name":"Release"`) || !strings.Contains(string(data), string(ReleaseID)) {
+		t.Errorf("got traces %s, want the release span", data)
+	}
+}
@@ -0,0 +1,249 @@
+// Package Knative is a minimal client of the Knative Serving API (serving.knative.dev/v1 services) through the Kubernetes API server
+package Knative
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const readyPollTimeout = 3 * time.Minute
+
+// readyPollInterval is the time between two checks of a deployment's readiness
+var readyPollInterval = time.Second
+
+type Knative struct {
+	APIServer string // e.g. "https://127.0.0.1:6443"
+	Namespace string // "default" if not set
+	token     string
+	client    *http.Client
+}
+
+// Function is a Knative service running a container image (see faas.ImageBuilder)
+type Function struct {
+	Name                 string
+	Image                string
+	EnvironmentVariables map[string]string
+}
+
+// ErrNotFound is returned when a service does not exist
+var ErrNotFound = fmt.Errorf("service not found")
+
+// service is the part of a Knative service that is used
+type service struct {
+	APIVersion string         `json:"apiVersion"`
+	Kind       string         `json:"kind"`
+	Metadata   map[string]any `json:"metadata"`
+	Spec       any            `json:"spec,omitempty"`
+	Status     struct {
+		ObservedGeneration int64  `json:"observedGeneration"`
+		URL                string `json:"url"`
+		Address            struct {
+			URL string `json:"url"`
+		} `json:"address"`
+		Conditions []struct {
+			Type    string `json:"type"`
+			Status  string `json:"status"`
+			Message string `json:"message"`
+		} `json:"conditions"`
+	} `json:"status,omitempty"`
+}
+
+// NewKnative creates a client of the API server, authenticated by a bearer token (e.g. of a service account).
+// The server's certificate is checked against the CA file if given, or not at all if 'insecure' is set
+func NewKnative(apiServer, namespace, token, caFile string, insecure bool) (*Knative, error) {
+	log.Infof("Initializing Knative client for API server '%s'", apiServer)
+	if namespace == "" {
+		namespace = "default"
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecure}
+	if caFile != "" {
+		ca, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificate found in the CA file '%s'", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return &Knative{
+		APIServer: strings.TrimSuffix(apiServer, "/"),
+		Namespace: namespace,
+		token:     token,
+		client:    &http.Client{Timeout: 60 * time.Second, Transport: &http.Transport{TLSClientConfig: tlsConfig}},
+	}, nil
+}
+
+// Apply creates or updates (replaces the container of) a service, waits until it is ready, and returns its in-cluster URL
+func (k *Knative) Apply(ctx context.Context, f *Function) (string, error) {
+	var env []map[string]string
+	for name, value := range f.EnvironmentVariables {
+		env = append(env, map[string]string{"name": name, "value": value})
+	}
+	spec := map[string]any{
+		"template": map[string]any{
+			"spec": map[string]any{
+				"containers": []map[string]any{{"image": f.Image, "env": env}},
+			},
+		},
+	}
+
+	_, err := k.get(ctx, f.Name)
+	switch err {
+	case ErrNotFound:
+		log.Infof("Creating %s service (%s)", f.Name, f.Image)
+		svc := service{
+			APIVersion: "serving.knative.dev/v1",
+			Kind:       "Service",
+			Metadata:   map[string]any{"name": f.Name, "namespace": k.Namespace},
+			Spec:       spec,
+		}
+		err = k.do(ctx, http.MethodPost, k.servicesPath(""), "application/json", svc, nil)
+	case nil:
+		log.Infof("Updating %s service (%s)", f.Name, f.Image)
+		err = k.do(ctx, http.MethodPatch, k.servicesPath(f.Name), "application/merge-patch+json", map[string]any{"spec": spec}, nil)
+	}
+	if err != nil {
+		return "", fmt.Errorf("error applying '%s': %v", f.Name, err)
+	}
+	return k.waitUntilReady(ctx, f.Name)
+}
+
+// URL returns the in-cluster URL of a ready service (or its public URL, if it has no address), or ErrNotFound
+func (k *Knative) URL(ctx context.Context, name string) (string, error) {
+	svc, err := k.get(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	return serviceURL(svc), nil
+}
+
+// List returns the names of the services of the namespace
+func (k *Knative) List(ctx context.Context) ([]string, error) {
+	var list struct {
+		Items []service `json:"items"`
+	}
+	if err := k.do(ctx, http.MethodGet, k.servicesPath(""), "", nil, &list); err != nil {
+		return nil, err
+	}
+	names := make([]string, len(list.Items))
+	for i, item := range list.Items {
+		names[i], _ = item.Metadata["name"].(string)
+	}
+	return names, nil
+}
+
+// Delete deletes a service
+func (k *Knative) Delete(ctx context.Context, name string) error {
+	log.Infof("Deleting %s service", name)
+	return k.do(ctx, http.MethodDelete, k.servicesPath(name), "", nil, nil)
+}
+
+func (k *Knative) get(ctx context.Context, name string) (*service, error) {
+	var svc service
+	if err := k.do(ctx, http.MethodGet, k.servicesPath(name), "", nil, &svc); err != nil {
+		return nil, err
+	}
+	return &svc, nil
+}
+
+// waitUntilReady waits until the service's 'Ready' condition is true for its last update, and returns its URL
+func (k *Knative) waitUntilReady(ctx context.Context, name string) (string, error) {
+	deadline := time.Now().Add(readyPollTimeout)
+	for {
+		svc, err := k.get(ctx, name)
+		if err != nil {
+			return "", err
+		}
+		generation, _ := svc.Metadata["generation"].(float64)
+		for _, condition := range svc.Status.Conditions {
+			if condition.Type != "Ready" || float64(svc.Status.ObservedGeneration) < generation { // not the status of the last update yet
+				continue
+			}
+			if condition.Status == "True" {
+				return serviceURL(svc), nil
+			}
+			if condition.Status == "False" {
+				return "", fmt.Errorf("service '%s' is not ready: %s", name, condition.Message)
+			}
+		}
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("service '%s' is not ready after %v", name, readyPollTimeout)
+		}
+		log.Debugf("Waiting for service '%s' to be ready", name)
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(readyPollInterval):
+		}
+	}
+}
+
+func (k *Knative) servicesPath(name string) string {
+	path := fmt.Sprintf("/apis/serving.knative.dev/v1/namespaces/%s/services", k.Namespace)
+	if name != "" {
+		path += "/" + name
+	}
+	return path
+}
+
+// serviceURL prefers the in-cluster address, as the proxy calls the versions from inside the cluster
+func serviceURL(svc *service) string {
+	if svc.Status.Address.URL != "" {
+		return svc.Status.Address.URL
+	}
+	return svc.Status.URL
+}
+
+// do sends a request to the API server, and decodes the JSON response into 'response' if given
+func (k *Knative) do(ctx context.Context, method, path, contentType string, request any, response any) error {
+	var body io.Reader
+	if request != nil {
+		data, err := json.Marshal(request)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, k.APIServer+path, body)
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("Accept", "application/json")
+	if k.token != "" {
+		req.Header.Set("Authorization", "Bearer "+k.token)
+	}
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("received non-OK response: %v: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	if response != nil && len(data) > 0 {
+		return json.Unmarshal(data, response)
+	}
+	return nil
+}
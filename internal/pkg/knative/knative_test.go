@@ -0,0 +1,312 @@
+package Knative
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestMain(m *testing.M) {
+	log.SetLevel(log.WarnLevel)
+	readyPollInterval = 10 * time.Millisecond
+	os.Exit(m.Run())
+}
+
+const servicesPath = "/apis/serving.knative.dev/v1/namespaces/uc/services"
+
+type emulatedService struct {
+	image        string
+	env          map[string]string
+	generation   int64
+	observed     int64 // the generation the status is of
+	pendingPolls int   // the polls before the last generation is observed
+	failure      string
+}
+
+// emulator emulates the Knative services of the API server, and checks the token and content type of every request
+type emulator struct {
+	*httptest.Server
+	t          *testing.T
+	mu         sync.Mutex
+	services   map[string]*emulatedService
+	readyAfter int    // the pending polls of a created or updated service
+	failure    string // the message of a service that fails to become ready
+}
+
+func newEmulator(t *testing.T) *emulator {
+	e := &emulator{t: t, services: map[string]*emulatedService{}, readyAfter: 2}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST "+servicesPath, e.handleCreate)
+	mux.HandleFunc("GET "+servicesPath, e.handleList)
+	mux.HandleFunc("GET "+servicesPath+"/{name}", e.handleGet)
+	mux.HandleFunc("PATCH "+servicesPath+"/{name}", e.handlePatch)
+	mux.HandleFunc("DELETE "+servicesPath+"/{name}", e.handleDelete)
+	e.Server = httptest.NewServer(e.verified(mux))
+	t.Cleanup(e.Close)
+	return e
+}
+
+func (e *emulator) client(t *testing.T) *Knative {
+	k, err := NewKnative(e.URL+"/", "uc", "token", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func (e *emulator) verified(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auth := r.Header.Get("Authorization"); auth != "Bearer token" {
+			e.t.Errorf("%s %s: authorization '%s'", r.Method, r.URL, auth)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		want := map[string]string{http.MethodPost: "application/json", http.MethodPatch: "application/merge-patch+json"}[r.Method]
+		if contentType := r.Header.Get("Content-Type"); contentType != want {
+			e.t.Errorf("%s %s: content type '%s', want '%s'", r.Method, r.URL, contentType, want)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// decodeSpec decodes the container of a service (or of a patch) spec
+func decodeSpec(r *http.Request) (metadata map[string]any, image string, env map[string]string, err error) {
+	var request struct {
+		Metadata map[string]any `json:"metadata"`
+		Spec     struct {
+			Template struct {
+				Spec struct {
+					Containers []struct {
+						Image string              `json:"image"`
+						Env   []map[string]string `json:"env"`
+					} `json:"containers"`
+				} `json:"spec"`
+			} `json:"template"`
+		} `json:"spec"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		return nil, "", nil, err
+	}
+	env = map[string]string{}
+	for _, container := range request.Spec.Template.Spec.Containers {
+		image = container.Image
+		for _, variable := range container.Env {
+			env[variable["name"]] = variable["value"]
+		}
+	}
+	return request.Metadata, image, env, nil
+}
+
+func (e *emulator) handleCreate(w http.ResponseWriter, r *http.Request) {
+	metadata, image, env, err := decodeSpec(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	name, _ := metadata["name"].(string)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, exists := e.services[name]; exists {
+		http.Error(w, "services.serving.knative.dev \""+name+"\" already exists", http.StatusConflict)
+		return
+	}
+	e.services[name] = &emulatedService{image: image, env: env, generation: 1, pendingPolls: e.readyAfter, failure: e.failure}
+	e.writeService(w, http.StatusCreated, name)
+}
+
+func (e *emulator) handlePatch(w http.ResponseWriter, r *http.Request) {
+	_, image, env, err := decodeSpec(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if svc := e.service(w, r); svc != nil {
+		svc.image, svc.env = image, env
+		svc.generation++
+		svc.pendingPolls = e.readyAfter
+		svc.failure = e.failure
+		e.writeService(w, http.StatusOK, r.PathValue("name"))
+	}
+}
+
+func (e *emulator) handleGet(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if svc := e.service(w, r); svc != nil {
+		e.writeService(w, http.StatusOK, r.PathValue("name"))
+		if svc.pendingPolls--; svc.pendingPolls <= 0 {
+			svc.observed = svc.generation
+		}
+	}
+}
+
+func (e *emulator) handleList(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var items []map[string]any
+	for name := range e.services {
+		items = append(items, map[string]any{"metadata": map[string]any{"name": name}})
+	}
+	json.NewEncoder(w).Encode(map[string]any{"items": items})
+}
+
+func (e *emulator) handleDelete(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if svc := e.service(w, r); svc != nil {
+		delete(e.services, r.PathValue("name"))
+		json.NewEncoder(w).Encode(map[string]any{"status": "Success"})
+	}
+}
+
+// service returns the service of the request, or writes a 404
+func (e *emulator) service(w http.ResponseWriter, r *http.Request) *emulatedService {
+	svc, exists := e.services[r.PathValue("name")]
+	if !exists {
+		http.Error(w, "services.serving.knative.dev \""+r.PathValue("name")+"\" not found", http.StatusNotFound)
+	}
+	return svc
+}
+
+// writeService writes a service, ready (or failed) once its last generation is observed, and unknown before
+func (e *emulator) writeService(w http.ResponseWriter, code int, name string) {
+	svc := e.services[name]
+	ready := map[string]string{"type": "Ready", "status": "Unknown"}
+	if svc.observed == svc.generation {
+		ready["status"] = "True"
+		if svc.failure != "" {
+			ready["status"], ready["message"] = "False", svc.failure
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]any{
+		"apiVersion": "serving.knative.dev/v1",
+		"kind":       "Service",
+		"metadata":   map[string]any{"name": name, "namespace": "uc", "generation": svc.generation},
+		"status": map[string]any{
+			"observedGeneration": svc.observed,
+			"url":                "http://" + name + ".uc.example.com",
+			"address":            map[string]any{"url": "http://" + name + ".uc.svc.cluster.local"},
+			"conditions":         []map[string]string{ready},
+		},
+	})
+}
+
+// deployed returns a copy of the deployed service
+func (e *emulator) deployed(t *testing.T, name string) emulatedService {
+	t.Helper()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	svc, exists := e.services[name]
+	if !exists {
+		t.Fatalf("service '%s' is not deployed", name)
+	}
+	return *svc
+}
+
+func TestApplyCreates(t *testing.T) {
+	e := newEmulator(t)
+	k := e.client(t)
+	f := &Function{Name: "sieve", Image: "registry.local/sieve:1", EnvironmentVariables: map[string]string{"F1ENDPOINT": "http://f1"}}
+
+	uri, err := k.Apply(context.Background(), f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uri != "http://sieve.uc.svc.cluster.local" {
+		t.Errorf("got URL %s, want the in-cluster address", uri)
+	}
+	deployed := e.deployed(t, "sieve")
+	if deployed.image != f.Image || !reflect.DeepEqual(deployed.env, f.EnvironmentVariables) || deployed.observed != 1 {
+		t.Errorf("deployed %+v", deployed)
+	}
+}
+
+func TestApplyUpdates(t *testing.T) {
+	e := newEmulator(t)
+	k := e.client(t)
+	ctx := context.Background()
+	f := &Function{Name: "sieve", Image: "registry.local/sieve:1"}
+	if _, err := k.Apply(ctx, f); err != nil {
+		t.Fatal(err)
+	}
+
+	// the status of the first generation is ready, but the client waits for the update's
+	f.Image = "registry.local/sieve:2"
+	if _, err := k.Apply(ctx, f); err != nil {
+		t.Fatal(err)
+	}
+	if deployed := e.deployed(t, "sieve"); deployed.image != f.Image || deployed.generation != 2 || deployed.observed != 2 {
+		t.Errorf("updated %+v", deployed)
+	}
+}
+
+func TestApplyNotReady(t *testing.T) {
+	e := newEmulator(t)
+	k := e.client(t)
+	e.failure = "RevisionFailed: image pull failed"
+
+	_, err := k.Apply(context.Background(), &Function{Name: "sieve", Image: "registry.local/sieve:1"})
+	if err == nil || !strings.Contains(err.Error(), e.failure) {
+		t.Errorf("got %v for a failed revision, want its message", err)
+	}
+
+	e.failure = ""
+	e.readyAfter = 1 << 30
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := k.Apply(ctx, &Function{Name: "sieve", Image: "registry.local/sieve:2"}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v for a service that is never ready, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestURLListAndDelete(t *testing.T) {
+	e := newEmulator(t)
+	k := e.client(t)
+	ctx := context.Background()
+	if _, err := k.Apply(ctx, &Function{Name: "sieve", Image: "registry.local/sieve:1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if names, err := k.List(ctx); err != nil || !reflect.DeepEqual(names, []string{"sieve"}) {
+		t.Errorf("got services %v (%v)", names, err)
+	}
+	if uri, err := k.URL(ctx, "sieve"); err != nil || uri != "http://sieve.uc.svc.cluster.local" {
+		t.Errorf("got URL %s (%v)", uri, err)
+	}
+
+	if err := k.Delete(ctx, "sieve"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := k.URL(ctx, "sieve"); err != ErrNotFound {
+		t.Errorf("got %v for a deleted service, want %v", err, ErrNotFound)
+	}
+	if err := k.Delete(ctx, "sieve"); err != ErrNotFound {
+		t.Errorf("got %v deleting a deleted service, want %v", err, ErrNotFound)
+	}
+}
+
+func TestServiceURL(t *testing.T) {
+	var svc service
+	svc.Status.URL = "http://sieve.uc.example.com"
+	if got := serviceURL(&svc); got != svc.Status.URL {
+		t.Errorf("got %s without an address, want the public URL", got)
+	}
+	svc.Status.Address.URL = "http://sieve.uc.svc.cluster.local"
+	if got := serviceURL(&svc); got != svc.Status.Address.URL {
+		t.Errorf("got %s, want the in-cluster address", got)
+	}
+}
@@ -0,0 +1,271 @@
+// Package Lambda is a minimal client of AWS Lambda (functions and function URLs), on top of the AWS SDK.
+// It can be pointed to a Lambda-compatible emulator (e.g. LocalStack) by its endpoint
+package Lambda
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	"github.com/aws/aws-sdk-go-v2/service/lambda/types"
+	log "github.com/sirupsen/logrus"
+)
+
+const readyPollTimeout = 2 * time.Minute
+
+// readyPollInterval is the time between two checks of a function's state
+var readyPollInterval = time.Second
+
+type Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string // optional
+}
+
+type Lambda struct {
+	Region   string
+	Endpoint string // an emulator's, e.g. "http://localhost:4566". empty for the AWS endpoint of the region
+	Role     string // ARN of the execution role of the created functions
+	client   *lambda.Client
+}
+
+type Function struct {
+	Name                 string
+	SourceLocalPath      string // a directory, zipped when uploading
+	Runtime              string // e.g. "nodejs20.x"
+	Handler              string // e.g. "index.handler"
+	EnvironmentVariables map[string]string
+	MemorySize           int // MB. default 128
+	Timeout              int // seconds. default 30
+}
+
+// IsNotFound tells if the error is a 'ResourceNotFoundException'
+func IsNotFound(err error) bool {
+	var notFound *types.ResourceNotFoundException
+	return errors.As(err, &notFound)
+}
+
+// NewLambda creates a Lambda client. An empty endpoint means the AWS endpoint of the region
+func NewLambda(region, endpoint, role string, creds Credentials) (*Lambda, error) {
+	if region == "" {
+		return nil, fmt.Errorf("region is required for Lambda")
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return nil, fmt.Errorf("access key ID and secret access key are required for Lambda")
+	}
+	options := lambda.Options{
+		Region:      region,
+		Credentials: aws.NewCredentialsCache(credentials.NewStaticCredentialsProvider(creds.AccessKeyID, creds.SecretAccessKey, creds.SessionToken)),
+		HTTPClient:  awshttp.NewBuildableClient().WithTimeout(60 * time.Second),
+	}
+	if endpoint != "" {
+		options.BaseEndpoint = aws.String(endpoint)
+		log.Infof("Initializing Lambda client for region '%s' (%s)", region, endpoint)
+	} else {
+		log.Infof("Initializing Lambda client for region '%s'", region)
+	}
+	return &Lambda{
+		Region:   region,
+		Endpoint: endpoint,
+		Role:     role,
+		client:   lambda.New(options),
+	}, nil
+}
+
+// CreateFunction creates the function and its public function URL, and returns the URL
+func (l *Lambda) CreateFunction(ctx context.Context, f *Function) (string, error) {
+	log.Infof("Creating %s function in %s", f.Name, l.Region)
+	zipFile, err := zipDir(f.SourceLocalPath)
+	if err != nil {
+		return "", fmt.Errorf("error packaging the source of '%s': %v", f.Name, err)
+	}
+	memorySize, timeout := f.MemorySize, f.Timeout
+	if memorySize == 0 {
+		memorySize = 128
+	}
+	if timeout == 0 {
+		timeout = 30
+	}
+	_, err = l.client.CreateFunction(ctx, &lambda.CreateFunctionInput{
+		FunctionName: aws.String(f.Name),
+		Runtime:      types.Runtime(f.Runtime),
+		Handler:      aws.String(f.Handler),
+		Role:         aws.String(l.Role),
+		Code:         &types.FunctionCode{ZipFile: zipFile},
+		Environment:  &types.Environment{Variables: f.EnvironmentVariables},
+		MemorySize:   aws.Int32(int32(memorySize)),
+		Timeout:      aws.Int32(int32(timeout)),
+	})
+	if err != nil {
+		return "", err
+	}
+	waiter := lambda.NewFunctionActiveV2Waiter(l.client, func(o *lambda.FunctionActiveV2WaiterOptions) {
+		o.MinDelay, o.MaxDelay = readyPollInterval, readyPollInterval
+	})
+	if err := waiter.Wait(ctx, &lambda.GetFunctionInput{FunctionName: aws.String(f.Name)}, readyPollTimeout); err != nil {
+		return "", fmt.Errorf("function '%s' is not active: %w", f.Name, err)
+	}
+	return l.createFunctionURL(ctx, f.Name)
+}
+
+// UpdateFunction updates the code and the configuration of an existing function, and returns its function URL
+func (l *Lambda) UpdateFunction(ctx context.Context, f *Function) (string, error) {
+	log.Infof("Updating %s function in %s", f.Name, l.Region)
+	zipFile, err := zipDir(f.SourceLocalPath)
+	if err != nil {
+		return "", fmt.Errorf("error packaging the source of '%s': %v", f.Name, err)
+	}
+	_, err = l.client.UpdateFunctionCode(ctx, &lambda.UpdateFunctionCodeInput{FunctionName: aws.String(f.Name), ZipFile: zipFile})
+	if err != nil {
+		return "", err
+	}
+	// a function can't be updated again while the last update is in progress
+	if err := l.waitUntilUpdated(ctx, f.Name); err != nil {
+		return "", err
+	}
+	_, err = l.client.UpdateFunctionConfiguration(ctx, &lambda.UpdateFunctionConfigurationInput{
+		FunctionName: aws.String(f.Name),
+		Runtime:      types.Runtime(f.Runtime),
+		Handler:      aws.String(f.Handler),
+		Environment:  &types.Environment{Variables: f.EnvironmentVariables},
+	})
+	if err != nil {
+		return "", err
+	}
+	if err := l.waitUntilUpdated(ctx, f.Name); err != nil {
+		return "", err
+	}
+	uri, err := l.FunctionURL(ctx, f.Name)
+	if IsNotFound(err) { // e.g. created by someone else without a function URL
+		return l.createFunctionURL(ctx, f.Name)
+	}
+	return uri, err
+}
+
+// GetFunction returns the configuration of a function. IsNotFound tells if it does not exist
+func (l *Lambda) GetFunction(ctx context.Context, name string) (*types.FunctionConfiguration, error) {
+	output, err := l.client.GetFunction(ctx, &lambda.GetFunctionInput{FunctionName: aws.String(name)})
+	if err != nil {
+		return nil, err
+	}
+	return output.Configuration, nil
+}
+
+// ListFunctions returns the names of all the functions of the region
+func (l *Lambda) ListFunctions(ctx context.Context) ([]string, error) {
+	var names []string
+	paginator := lambda.NewListFunctionsPaginator(l.client, &lambda.ListFunctionsInput{})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range page.Functions {
+			names = append(names, aws.ToString(f.FunctionName))
+		}
+	}
+	return names, nil
+}
+
+// DeleteFunction deletes a function, with its function URL
+func (l *Lambda) DeleteFunction(ctx context.Context, name string) error {
+	log.Infof("Deleting %s function in %s", name, l.Region)
+	_, err := l.client.DeleteFunction(ctx, &lambda.DeleteFunctionInput{FunctionName: aws.String(name)})
+	return err
+}
+
+// FunctionURL returns the function URL of a function
+func (l *Lambda) FunctionURL(ctx context.Context, name string) (string, error) {
+	output, err := l.client.GetFunctionUrlConfig(ctx, &lambda.GetFunctionUrlConfigInput{FunctionName: aws.String(name)})
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(output.FunctionUrl), nil
+}
+
+// createFunctionURL creates a public function URL (no auth), and allows everyone to invoke it
+func (l *Lambda) createFunctionURL(ctx context.Context, name string) (string, error) {
+	output, err := l.client.CreateFunctionUrlConfig(ctx, &lambda.CreateFunctionUrlConfigInput{
+		FunctionName: aws.String(name),
+		AuthType:     types.FunctionUrlAuthTypeNone,
+	})
+	if err != nil {
+		return "", fmt.Errorf("error creating the function URL of '%s': %v", name, err)
+	}
+	_, err = l.client.AddPermission(ctx, &lambda.AddPermissionInput{
+		FunctionName:        aws.String(name),
+		StatementId:         aws.String("FunctionURLAllowPublicAccess"),
+		Action:              aws.String("lambda:InvokeFunctionUrl"),
+		Principal:           aws.String("*"),
+		FunctionUrlAuthType: types.FunctionUrlAuthTypeNone,
+	})
+	var conflict *types.ResourceConflictException
+	if err != nil && !errors.As(err, &conflict) { // conflict: already allowed
+		return "", fmt.Errorf("error allowing public access to the function URL of '%s': %v", name, err)
+	}
+	log.Infof("Function '%s' is available at %s", name, aws.ToString(output.FunctionUrl))
+	return aws.ToString(output.FunctionUrl), nil
+}
+
+// waitUntilUpdated waits until the last update of the function is done
+func (l *Lambda) waitUntilUpdated(ctx context.Context, name string) error {
+	waiter := lambda.NewFunctionUpdatedV2Waiter(l.client, func(o *lambda.FunctionUpdatedV2WaiterOptions) {
+		o.MinDelay, o.MaxDelay = readyPollInterval, readyPollInterval
+	})
+	if err := waiter.Wait(ctx, &lambda.GetFunctionInput{FunctionName: aws.String(name)}, readyPollTimeout); err != nil {
+		return fmt.Errorf("function '%s' is not updated: %w", name, err)
+	}
+	return nil
+}
+
+// zipDir zips the files of a directory (or a single file) in memory, keeping the executable bits (e.g. of a 'bootstrap' binary)
+func zipDir(src string) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := zip.NewWriter(&buf)
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		relPath, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if relPath == "." { // src is a file
+			relPath = filepath.Base(path)
+		}
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(relPath)
+		header.Method = zip.Deflate
+		w, err := writer.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(w, file)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,396 @@
+package Lambda
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/lambda/types"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestMain(m *testing.M) {
+	log.SetLevel(log.WarnLevel)
+	readyPollInterval = 10 * time.Millisecond
+	os.Exit(m.Run())
+}
+
+var testCredentials = Credentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+
+type emulatedFunction struct {
+	configuration map[string]any
+	code          []byte // the zip file
+	url           string
+	public        bool
+}
+
+// emulator emulates the Lambda API of the client, and checks that every request is signed with the credentials
+type emulator struct {
+	*httptest.Server
+	t         *testing.T
+	mu        sync.Mutex
+	functions map[string]*emulatedFunction
+}
+
+func newEmulator(t *testing.T) *emulator {
+	e := &emulator{t: t, functions: map[string]*emulatedFunction{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /2015-03-31/functions", e.handleCreate)
+	mux.HandleFunc("GET /2015-03-31/functions/{$}", e.handleList)
+	mux.HandleFunc("GET /2015-03-31/functions/{name}", e.handleGet)
+	mux.HandleFunc("DELETE /2015-03-31/functions/{name}", e.handleDelete)
+	mux.HandleFunc("PUT /2015-03-31/functions/{name}/code", e.handleUpdateCode)
+	mux.HandleFunc("PUT /2015-03-31/functions/{name}/configuration", e.handleUpdateConfiguration)
+	mux.HandleFunc("POST /2015-03-31/functions/{name}/policy", e.handleAddPermission)
+	mux.HandleFunc("GET /2021-10-31/functions/{name}/url", e.handleGetURL)
+	mux.HandleFunc("POST /2021-10-31/functions/{name}/url", e.handleCreateURL)
+	e.Server = httptest.NewServer(e.verified(mux))
+	t.Cleanup(e.Close)
+	return e
+}
+
+func (e *emulator) client(t *testing.T) *Lambda {
+	l, err := NewLambda("eu-central-1", e.URL, "arn:aws:iam::123456789012:role/lambda", testCredentials)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+// verified checks the credential scope of a request's signature
+func (e *emulator) verified(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential="+testCredentials.AccessKeyID+"/") || !strings.Contains(auth, "/eu-central-1/lambda/aws4_request") {
+			e.t.Errorf("%s %s: authorization %s", r.Method, r.URL, auth)
+			writeError(w, http.StatusForbidden, "InvalidSignatureException", "signature mismatch")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeError(w http.ResponseWriter, status int, errorType, message string) {
+	w.Header().Set("X-Amzn-ErrorType", errorType)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"Type": "User", "message": message})
+}
+
+func writeJSON(w http.ResponseWriter, status int, response any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+// function returns the function of the request, or writes a 404
+func (e *emulator) function(w http.ResponseWriter, r *http.Request) *emulatedFunction {
+	f, exists := e.functions[r.PathValue("name")]
+	if !exists {
+		writeError(w, http.StatusNotFound, "ResourceNotFoundException", "Function not found: "+r.PathValue("name"))
+	}
+	return f
+}
+
+func (e *emulator) handleCreate(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		FunctionName, Runtime, Handler, Role string
+		Code                                 struct{ ZipFile []byte }
+		Environment                          struct{ Variables map[string]string }
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidParameterValueException", err.Error())
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, exists := e.functions[request.FunctionName]; exists {
+		writeError(w, http.StatusConflict, "ResourceConflictException", "Function already exist: "+request.FunctionName)
+		return
+	}
+	configuration := map[string]any{
+		"FunctionName": request.FunctionName,
+		"Runtime":      request.Runtime,
+		"Handler":      request.Handler,
+		"Role":         request.Role,
+		"Environment":  map[string]any{"Variables": request.Environment.Variables},
+		"State":        "Pending", // active after it is polled once
+	}
+	e.functions[request.FunctionName] = &emulatedFunction{configuration: configuration, code: request.Code.ZipFile}
+	writeJSON(w, http.StatusCreated, configuration)
+}
+
+// handleList lists the functions one per page, to check the paging of the client
+func (e *emulator) handleList(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var names []string
+	for name := range e.functions {
+		if name >= r.URL.Query().Get("Marker") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	response := map[string]any{"Functions": []map[string]any{}}
+	if len(names) > 0 {
+		response["Functions"] = []map[string]any{e.functions[names[0]].configuration}
+	}
+	if len(names) > 1 {
+		response["NextMarker"] = names[1]
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (e *emulator) handleGet(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if f := e.function(w, r); f != nil {
+		writeJSON(w, http.StatusOK, map[string]any{"Configuration": f.configuration})
+		f.configuration["State"] = "Active"
+		f.configuration["LastUpdateStatus"] = "Successful"
+	}
+}
+
+func (e *emulator) handleDelete(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if f := e.function(w, r); f != nil {
+		delete(e.functions, r.PathValue("name"))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (e *emulator) handleUpdateCode(w http.ResponseWriter, r *http.Request) {
+	var request struct{ ZipFile []byte }
+	json.NewDecoder(r.Body).Decode(&request)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if f := e.function(w, r); f != nil {
+		e.checkNotInProgress(f)
+		f.code = request.ZipFile
+		f.configuration["LastUpdateStatus"] = "InProgress"
+		writeJSON(w, http.StatusOK, f.configuration)
+	}
+}
+
+func (e *emulator) handleUpdateConfiguration(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Runtime, Handler string
+		Environment      struct{ Variables map[string]string }
+	}
+	json.NewDecoder(r.Body).Decode(&request)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if f := e.function(w, r); f != nil {
+		e.checkNotInProgress(f)
+		f.configuration["Runtime"] = request.Runtime
+		f.configuration["Handler"] = request.Handler
+		f.configuration["Environment"] = map[string]any{"Variables": request.Environment.Variables}
+		f.configuration["LastUpdateStatus"] = "InProgress"
+		writeJSON(w, http.StatusOK, f.configuration)
+	}
+}
+
+// checkNotInProgress checks that the client waits for the last update, as Lambda rejects an update in progress
+func (e *emulator) checkNotInProgress(f *emulatedFunction) {
+	if f.configuration["State"] != "Active" || f.configuration["LastUpdateStatus"] == "InProgress" {
+		e.t.Errorf("function '%s' was updated while not ready: %v", f.configuration["FunctionName"], f.configuration)
+	}
+}
+
+func (e *emulator) handleAddPermission(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if f := e.function(w, r); f != nil {
+		if f.public {
+			writeError(w, http.StatusConflict, "ResourceConflictException", "The statement id provided already exists")
+			return
+		}
+		f.public = true
+		writeJSON(w, http.StatusCreated, map[string]any{})
+	}
+}
+
+func (e *emulator) handleGetURL(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if f := e.function(w, r); f != nil {
+		if f.url == "" {
+			writeError(w, http.StatusNotFound, "ResourceNotFoundException", "The resource you requested does not exist.")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"FunctionUrl": f.url, "AuthType": "NONE"})
+	}
+}
+
+func (e *emulator) handleCreateURL(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if f := e.function(w, r); f != nil {
+		f.url = "https://" + r.PathValue("name") + ".lambda-url.eu-central-1.on.aws/"
+		writeJSON(w, http.StatusCreated, map[string]any{"FunctionUrl": f.url, "AuthType": "NONE"})
+	}
+}
+
+// deployed returns a copy of the deployed function, and its files
+func (e *emulator) deployed(t *testing.T, name string) (emulatedFunction, map[string]string) {
+	t.Helper()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	f, exists := e.functions[name]
+	if !exists {
+		t.Fatalf("function '%s' is not deployed", name)
+	}
+	reader, err := zip.NewReader(bytes.NewReader(f.code), int64(len(f.code)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	for _, file := range reader.File {
+		r, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(r)
+		r.Close()
+		files[file.Name] = string(data)
+	}
+	return *f, files
+}
+
+// source writes a function source directory with an index.js
+func source(t *testing.T, code string) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "index.js"), []byte(code), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestCreateFunction(t *testing.T) {
+	e := newEmulator(t)
+	l := e.client(t)
+	ctx := context.Background()
+	f := &Function{
+		Name:                 "sieve",
+		SourceLocalPath:      source(t, "exports.handler = async () => 'base'"),
+		Runtime:              "nodejs20.x",
+		Handler:              "index.handler",
+		EnvironmentVariables: map[string]string{"F1ENDPOINT": "https://f1"},
+	}
+
+	uri, err := l.CreateFunction(ctx, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uri != "https://sieve.lambda-url.eu-central-1.on.aws/" {
+		t.Errorf("got URL %s", uri)
+	}
+	deployed, files := e.deployed(t, "sieve")
+	if files["index.js"] != "exports.handler = async () => 'base'" || !deployed.public {
+		t.Errorf("deployed files %v, public %v", files, deployed.public)
+	}
+	env := deployed.configuration["Environment"].(map[string]any)["Variables"].(map[string]string)
+	if deployed.configuration["Runtime"] != "nodejs20.x" || deployed.configuration["Role"] != l.Role || env["F1ENDPOINT"] != "https://f1" {
+		t.Errorf("deployed configuration %v", deployed.configuration)
+	}
+
+	var conflict *types.ResourceConflictException
+	if _, err := l.CreateFunction(ctx, f); !errors.As(err, &conflict) {
+		t.Errorf("got %v for an existing function, want a conflict", err)
+	}
+}
+
+func TestUpdateFunction(t *testing.T) {
+	e := newEmulator(t)
+	l := e.client(t)
+	ctx := context.Background()
+	f := &Function{Name: "sieve", SourceLocalPath: source(t, "base"), Runtime: "nodejs20.x", Handler: "index.handler"}
+	created, err := l.CreateFunction(ctx, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.SourceLocalPath = source(t, "new")
+	f.EnvironmentVariables = map[string]string{"F2ENDPOINT": "https://f2"}
+	uri, err := l.UpdateFunction(ctx, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uri != created {
+		t.Errorf("got URL %s after the update, want %s", uri, created)
+	}
+	deployed, files := e.deployed(t, "sieve")
+	env := deployed.configuration["Environment"].(map[string]any)["Variables"].(map[string]string)
+	if files["index.js"] != "new" || env["F2ENDPOINT"] != "https://f2" {
+		t.Errorf("deployed files %v, configuration %v", files, deployed.configuration)
+	}
+
+	// a function without a function URL gets one
+	e.mu.Lock()
+	e.functions["sieve"].url = ""
+	e.mu.Unlock()
+	if uri, err := l.UpdateFunction(ctx, f); err != nil || uri != created {
+		t.Errorf("got URL %s (%v), want %s", uri, err, created)
+	}
+
+	f.Name = "unknown"
+	if _, err := l.UpdateFunction(ctx, f); !IsNotFound(err) {
+		t.Errorf("got %v for an unknown function, want not found", err)
+	}
+}
+
+func TestFunctionURL(t *testing.T) {
+	e := newEmulator(t)
+	l := e.client(t)
+	ctx := context.Background()
+	created, err := l.CreateFunction(ctx, &Function{Name: "sieve", SourceLocalPath: source(t, "base"), Runtime: "nodejs20.x", Handler: "index.handler"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if uri, err := l.FunctionURL(ctx, "sieve"); err != nil || uri != created {
+		t.Errorf("got URL %s (%v), want %s", uri, err, created)
+	}
+	if err := l.DeleteFunction(ctx, "sieve"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.FunctionURL(ctx, "sieve"); !IsNotFound(err) {
+		t.Errorf("got %v for a deleted function, want not found", err)
+	}
+}
+
+func TestListFunctions(t *testing.T) {
+	e := newEmulator(t)
+	l := e.client(t)
+	ctx := context.Background()
+	if names, err := l.ListFunctions(ctx); err != nil || len(names) != 0 {
+		t.Errorf("got functions %v (%v) without any", names, err)
+	}
+	for _, name := range []string{"sieve", "sieve-proxy", "primes"} {
+		if _, err := l.CreateFunction(ctx, &Function{Name: name, SourceLocalPath: source(t, name), Runtime: "nodejs20.x", Handler: "index.handler"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	names, err := l.ListFunctions(ctx)
+	if err != nil || !reflect.DeepEqual(names, []string{"primes", "sieve", "sieve-proxy"}) {
+		t.Errorf("got functions %v (%v) of all the pages", names, err)
+	}
+	if configuration, err := l.GetFunction(ctx, "sieve"); err != nil || *configuration.FunctionName != "sieve" || configuration.State != types.StateActive {
+		t.Errorf("got configuration %+v (%v)", configuration, err)
+	}
+}
@@ -0,0 +1,182 @@
+// Package OpenFaaS is a minimal client of the OpenFaaS gateway REST API (/system/functions)
+package OpenFaaS
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const readyPollTimeout = 2 * time.Minute
+
+// readyPollInterval is the time between two checks of a deployment's readiness
+var readyPollInterval = time.Second
+
+type OpenFaaS struct {
+	Gateway   string // e.g. "http://127.0.0.1:8080"
+	Namespace string // functions' namespace. the gateway's default (openfaas-fn) if not set
+	username  string
+	password  string
+	client    *http.Client
+}
+
+// Function is a function deployment. OpenFaaS deploys container images, see faas.ImageBuilder
+type Function struct {
+	Service              string            `json:"service"`
+	Image                string            `json:"image"`
+	Namespace            string            `json:"namespace,omitempty"`
+	EnvironmentVariables map[string]string `json:"envVars,omitempty"`
+	Labels               map[string]string `json:"labels,omitempty"`
+}
+
+// FunctionStatus is the status of a deployed function
+type FunctionStatus struct {
+	Name              string `json:"name"`
+	Image             string `json:"image"`
+	Replicas          int    `json:"replicas"`
+	AvailableReplicas int    `json:"availableReplicas"`
+}
+
+// ErrNotFound is returned when a function does not exist
+var ErrNotFound = fmt.Errorf("function not found")
+
+// NewOpenFaaS creates an OpenFaaS gateway client, with the basic auth credentials of the gateway (e.g. 'admin')
+func NewOpenFaaS(gateway, namespace, username, password string) *OpenFaaS {
+	log.Infof("Initializing OpenFaaS client for gateway '%s'", gateway)
+	return &OpenFaaS{
+		Gateway:   strings.TrimSuffix(gateway, "/"),
+		Namespace: namespace,
+		username:  username,
+		password:  password,
+		client:    &http.Client{Timeout: 60 * time.Second},
+	}
+}
+
+// Deploy deploys a new function, or updates it if 'update' is set, and waits until it has an available replica
+func (o *OpenFaaS) Deploy(ctx context.Context, f *Function, update bool) error {
+	f.Namespace = o.Namespace
+	method := http.MethodPost
+	if update {
+		method = http.MethodPut
+	}
+	log.Infof("Deploying %s function (%s)", f.Service, f.Image)
+	if err := o.do(ctx, method, "/system/functions", f, nil); err != nil {
+		return fmt.Errorf("error deploying '%s': %v", f.Service, err)
+	}
+	return o.waitUntilReady(ctx, f.Service)
+}
+
+// Function returns the status of a function, or ErrNotFound
+func (o *OpenFaaS) Function(ctx context.Context, name string) (*FunctionStatus, error) {
+	var status FunctionStatus
+	if err := o.do(ctx, http.MethodGet, "/system/function/"+url.PathEscape(name)+o.namespaceQuery(), nil, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// Functions returns the names of the deployed functions
+func (o *OpenFaaS) Functions(ctx context.Context) ([]string, error) {
+	var functions []FunctionStatus
+	if err := o.do(ctx, http.MethodGet, "/system/functions"+o.namespaceQuery(), nil, &functions); err != nil {
+		return nil, err
+	}
+	names := make([]string, len(functions))
+	for i, f := range functions {
+		names[i] = f.Name
+	}
+	return names, nil
+}
+
+// Delete deletes a function
+func (o *OpenFaaS) Delete(ctx context.Context, name string) error {
+	log.Infof("Deleting %s function", name)
+	request := map[string]string{"functionName": name, "namespace": o.Namespace}
+	return o.do(ctx, http.MethodDelete, "/system/functions", request, nil)
+}
+
+// FunctionURL returns the URL of a function behind the given gateway (e.g. the in-cluster gateway, for the proxy)
+func (o *OpenFaaS) FunctionURL(gateway, name string) string {
+	if o.Namespace != "" {
+		name = name + "." + o.Namespace
+	}
+	return fmt.Sprintf("%s/function/%s", strings.TrimSuffix(gateway, "/"), name)
+}
+
+func (o *OpenFaaS) namespaceQuery() string {
+	if o.Namespace == "" {
+		return ""
+	}
+	return "?namespace=" + url.QueryEscape(o.Namespace)
+}
+
+// waitUntilReady waits until the function has an available replica
+func (o *OpenFaaS) waitUntilReady(ctx context.Context, name string) error {
+	deadline := time.Now().Add(readyPollTimeout)
+	for {
+		status, err := o.Function(ctx, name)
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+		if status != nil && status.AvailableReplicas > 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("function '%s' has no available replica after %v", name, readyPollTimeout)
+		}
+		log.Debugf("Waiting for function '%s' to be ready", name)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(readyPollInterval):
+		}
+	}
+}
+
+// do sends a request to the gateway, and decodes the JSON response into 'response' if given
+func (o *OpenFaaS) do(ctx context.Context, method, path string, request any, response any) error {
+	var body io.Reader
+	if request != nil {
+		data, err := json.Marshal(request)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, o.Gateway+path, body)
+	if err != nil {
+		return err
+	}
+	if request != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if o.username != "" {
+		req.SetBasicAuth(o.username, o.password)
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("received non-OK response: %v: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	if response != nil && len(data) > 0 {
+		return json.Unmarshal(data, response)
+	}
+	return nil
+}
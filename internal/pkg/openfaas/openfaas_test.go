@@ -0,0 +1,252 @@
+package OpenFaaS
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestMain(m *testing.M) {
+	log.SetLevel(log.WarnLevel)
+	readyPollInterval = 10 * time.Millisecond
+	os.Exit(m.Run())
+}
+
+type emulatedFunction struct {
+	Function
+	pendingPolls int // the status polls before the function has an available replica
+	polls        int
+}
+
+// emulator emulates the gateway's /system API, and checks the basic auth and namespace of every request
+type emulator struct {
+	*httptest.Server
+	t          *testing.T
+	mu         sync.Mutex
+	functions  map[string]*emulatedFunction
+	readyAfter int // the pending polls of a deployed function. never ready if negative
+}
+
+func newEmulator(t *testing.T) *emulator {
+	e := &emulator{t: t, functions: map[string]*emulatedFunction{}, readyAfter: 2}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /system/functions", e.handleDeploy)
+	mux.HandleFunc("PUT /system/functions", e.handleDeploy)
+	mux.HandleFunc("GET /system/functions", e.handleList)
+	mux.HandleFunc("DELETE /system/functions", e.handleDelete)
+	mux.HandleFunc("GET /system/function/{name}", e.handleGet)
+	e.Server = httptest.NewServer(e.verified(mux))
+	t.Cleanup(e.Close)
+	return e
+}
+
+func (e *emulator) client() *OpenFaaS {
+	return NewOpenFaaS(e.URL+"/", "uc-fn", "admin", "secret")
+}
+
+func (e *emulator) verified(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if username, password, ok := r.BasicAuth(); !ok || username != "admin" || password != "secret" {
+			e.t.Errorf("%s %s: basic auth %s:%s", r.Method, r.URL, username, password)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Method == http.MethodGet && r.URL.Query().Get("namespace") != "uc-fn" {
+			e.t.Errorf("%s %s: no namespace", r.Method, r.URL)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (e *emulator) handleDeploy(w http.ResponseWriter, r *http.Request) {
+	var f Function
+	if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if f.Namespace != "uc-fn" {
+		e.t.Errorf("%s %s: namespace '%s'", r.Method, r.URL, f.Namespace)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, exists := e.functions[f.Service]
+	switch {
+	case r.Method == http.MethodPost && exists:
+		http.Error(w, "function "+f.Service+" already exists", http.StatusConflict)
+		return
+	case r.Method == http.MethodPut && !exists:
+		http.Error(w, "function "+f.Service+" not found", http.StatusNotFound)
+		return
+	}
+	e.functions[f.Service] = &emulatedFunction{Function: f, pendingPolls: e.readyAfter}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (e *emulator) handleList(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	statuses := []FunctionStatus{}
+	for _, f := range e.functions {
+		statuses = append(statuses, f.status())
+	}
+	json.NewEncoder(w).Encode(statuses)
+}
+
+func (e *emulator) handleGet(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	f, exists := e.functions[r.PathValue("name")]
+	if !exists {
+		http.Error(w, "function "+r.PathValue("name")+" not found", http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(f.status())
+	f.polls++
+	if f.pendingPolls > 0 {
+		f.pendingPolls--
+	}
+}
+
+func (e *emulator) handleDelete(w http.ResponseWriter, r *http.Request) {
+	var request struct{ FunctionName, Namespace string }
+	json.NewDecoder(r.Body).Decode(&request)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, exists := e.functions[request.FunctionName]; !exists || request.Namespace != "uc-fn" {
+		http.Error(w, "function "+request.FunctionName+" not found", http.StatusNotFound)
+		return
+	}
+	delete(e.functions, request.FunctionName)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (f *emulatedFunction) status() FunctionStatus {
+	status := FunctionStatus{Name: f.Service, Image: f.Image, Replicas: 1}
+	if f.pendingPolls == 0 {
+		status.AvailableReplicas = 1
+	}
+	return status
+}
+
+// deployed returns a copy of the deployed function
+func (e *emulator) deployed(t *testing.T, name string) emulatedFunction {
+	t.Helper()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	f, exists := e.functions[name]
+	if !exists {
+		t.Fatalf("function '%s' is not deployed", name)
+	}
+	return *f
+}
+
+func TestDeploy(t *testing.T) {
+	e := newEmulator(t)
+	o := e.client()
+	ctx := context.Background()
+	f := &Function{Service: "sieve", Image: "registry.local/sieve:1", EnvironmentVariables: map[string]string{"F1ENDPOINT": "http://f1"}}
+
+	if err := o.Deploy(ctx, f, false); err != nil {
+		t.Fatal(err)
+	}
+	deployed := e.deployed(t, "sieve")
+	if deployed.pendingPolls != 0 || deployed.polls != e.readyAfter+1 {
+		t.Errorf("returned after %d polls, want %d", deployed.polls, e.readyAfter+1)
+	}
+	if deployed.Image != f.Image || !reflect.DeepEqual(deployed.EnvironmentVariables, f.EnvironmentVariables) {
+		t.Errorf("deployed %+v", deployed.Function)
+	}
+
+	if err := o.Deploy(ctx, f, false); err == nil {
+		t.Error("deployed an existing function again")
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	e := newEmulator(t)
+	o := e.client()
+	ctx := context.Background()
+	f := &Function{Service: "sieve", Image: "registry.local/sieve:1"}
+	if err := o.Deploy(ctx, f, false); err != nil {
+		t.Fatal(err)
+	}
+
+	f.Image = "registry.local/sieve:2"
+	if err := o.Deploy(ctx, f, true); err != nil {
+		t.Fatal(err)
+	}
+	if deployed := e.deployed(t, "sieve"); deployed.Image != f.Image || deployed.pendingPolls != 0 {
+		t.Errorf("updated %+v, %d pending polls", deployed.Function, deployed.pendingPolls)
+	}
+
+	if err := o.Deploy(ctx, &Function{Service: "unknown", Image: f.Image}, true); err == nil {
+		t.Error("updated an unknown function")
+	}
+}
+
+func TestDeployNotReady(t *testing.T) {
+	e := newEmulator(t)
+	e.readyAfter = -1
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if err := e.client().Deploy(ctx, &Function{Service: "sieve", Image: "registry.local/sieve:1"}, false); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v for a function without an available replica, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestFunctionAndDelete(t *testing.T) {
+	e := newEmulator(t)
+	o := e.client()
+	ctx := context.Background()
+	for _, name := range []string{"sieve", "sieve-proxy"} {
+		if err := o.Deploy(ctx, &Function{Service: name, Image: "registry.local/" + name + ":1"}, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	names, err := o.Functions(ctx)
+	sort.Strings(names)
+	if err != nil || !reflect.DeepEqual(names, []string{"sieve", "sieve-proxy"}) {
+		t.Errorf("got functions %v (%v)", names, err)
+	}
+	if status, err := o.Function(ctx, "sieve"); err != nil || status.Image != "registry.local/sieve:1" || status.AvailableReplicas != 1 {
+		t.Errorf("got status %+v (%v)", status, err)
+	}
+
+	if err := o.Delete(ctx, "sieve"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := o.Function(ctx, "sieve"); err != ErrNotFound {
+		t.Errorf("got %v for a deleted function, want %v", err, ErrNotFound)
+	}
+	if err := o.Delete(ctx, "sieve"); err != ErrNotFound {
+		t.Errorf("got %v deleting a deleted function, want %v", err, ErrNotFound)
+	}
+}
+
+func TestFunctionURL(t *testing.T) {
+	tests := []struct {
+		namespace string
+		want      string
+	}{
+		{"", "http://gateway.openfaas:8080/function/sieve"},
+		{"uc-fn", "http://gateway.openfaas:8080/function/sieve.uc-fn"},
+	}
+	for _, test := range tests {
+		o := NewOpenFaaS("http://127.0.0.1:8080", test.namespace, "", "")
+		if got := o.FunctionURL("http://gateway.openfaas:8080/", "sieve"); got != test.want {
+			t.Errorf("namespace '%s': got %s, want %s", test.namespace, got, test.want)
+		}
+	}
+}
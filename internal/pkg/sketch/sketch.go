@@ -0,0 +1,206 @@
+// Package sketch implements a mergeable quantile sketch (DDSketch) for the response times.
+// A value v is counted in the bin of index ceil(log_gamma(v)), where gamma = (1+a)/(1-a),
+// so any quantile is returned with a relative error of at most 'a', in a memory bounded by the number of bins
+package sketch
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"umbilical-choir-core/internal/pkg/stats"
+)
+
+const (
+	DefaultRelativeAccuracy = 0.01 // 1%
+	DefaultMaxBins          = 2048 // with 1% accuracy, it covers more than 17 orders of magnitude before collapsing
+	minIndexableValue       = 1e-9 // smaller values (e.g. 0ms) are counted as zero
+)
+
+// Sketch is a DDSketch of non-negative values, with the exact count, sum, minimum and maximum.
+// Two sketches with the same relative accuracy can be merged, e.g. by the parent to combine the distributions of many agents
+type Sketch struct {
+	RelativeAccuracy float64         `json:"relative_accuracy"`
+	MaxBins          int             `json:"max_bins"`
+	Bins             map[int]float64 `json:"bins"`       // bin index -> count
+	ZeroCount        float64         `json:"zero_count"` // count of the values smaller than 1e-9
+	Count            float64         `json:"count"`
+	Sum              float64         `json:"sum"`
+	Min              float64         `json:"min"`
+	Max              float64         `json:"max"`
+	gamma            float64
+	logGamma         float64
+}
+
+// New creates an empty sketch with the default relative accuracy and number of bins
+func New() *Sketch {
+	return NewWithAccuracy(DefaultRelativeAccuracy, DefaultMaxBins)
+}
+
+// NewWithAccuracy creates an empty sketch with the given relative accuracy (0..1) and maximum number of bins.
+// Once there are more than 'maxBins' bins, the lowest ones are collapsed, losing the accuracy of the lowest quantiles first
+func NewWithAccuracy(relativeAccuracy float64, maxBins int) *Sketch {
+	s := &Sketch{RelativeAccuracy: relativeAccuracy, MaxBins: maxBins, Bins: make(map[int]float64)}
+	s.init()
+	return s
+}
+
+func (s *Sketch) init() {
+	s.gamma = (1 + s.RelativeAccuracy) / (1 - s.RelativeAccuracy)
+	s.logGamma = math.Log(s.gamma)
+	if s.Bins == nil {
+		s.Bins = make(map[int]float64)
+	}
+}
+
+// Add adds a value. Negative values are counted as zero
+func (s *Sketch) Add(v float64) {
+	s.AddWithCount(v, 1)
+}
+
+// AddWithCount adds a value 'count' times
+func (s *Sketch) AddWithCount(v, count float64) {
+	if count <= 0 {
+		return
+	}
+	if s.logGamma == 0 { // e.g. unmarshalled
+		s.init()
+	}
+	if s.Count == 0 || v < s.Min {
+		s.Min = v
+	}
+	if s.Count == 0 || v > s.Max {
+		s.Max = v
+	}
+	s.Count += count
+	s.Sum += v * count
+	if v < minIndexableValue {
+		s.ZeroCount += count
+		return
+	}
+	s.Bins[s.index(v)] += count
+	s.collapse()
+}
+
+// Merge adds all the values of another sketch with the same relative accuracy
+func (s *Sketch) Merge(other *Sketch) error {
+	if other == nil || other.Count == 0 {
+		return nil
+	}
+	if other.RelativeAccuracy != s.RelativeAccuracy {
+		return fmt.Errorf("can't merge sketches of different relative accuracies (%v and %v)", s.RelativeAccuracy, other.RelativeAccuracy)
+	}
+	if s.logGamma == 0 {
+		s.init()
+	}
+	if s.Count == 0 || other.Min < s.Min {
+		s.Min = other.Min
+	}
+	if s.Count == 0 || other.Max > s.Max {
+		s.Max = other.Max
+	}
+	s.Count += other.Count
+	s.Sum += other.Sum
+	s.ZeroCount += other.ZeroCount
+	for i, count := range other.Bins {
+		s.Bins[i] += count
+	}
+	s.collapse()
+	return nil
+}
+
+// Quantile returns the q-th (0..1) quantile, or -1 if the sketch is empty
+func (s *Sketch) Quantile(q float64) float64 {
+	if s.Count == 0 {
+		return -1
+	}
+	if q <= 0 {
+		return s.Min
+	}
+	if q >= 1 {
+		return s.Max
+	}
+	rank := q * (s.Count - 1)
+	var cumulative float64
+	for _, bin := range s.Histogram() { // the zero bin first
+		cumulative += bin.Count
+		if cumulative > rank {
+			return s.clamp(bin.Value)
+		}
+	}
+	return s.Max
+}
+
+// Mean returns the exact mean, or -1 if the sketch is empty
+func (s *Sketch) Mean() float64 {
+	if s.Count == 0 {
+		return -1
+	}
+	return s.Sum / s.Count
+}
+
+// Histogram returns the non-empty bins (including the zero bin) as their representative values and counts, in increasing order
+func (s *Sketch) Histogram() []stats.Bin {
+	if s.logGamma == 0 {
+		s.init()
+	}
+	indexes := make([]int, 0, len(s.Bins))
+	for i := range s.Bins {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	histogram := make([]stats.Bin, 0, len(indexes)+1)
+	if s.ZeroCount > 0 {
+		histogram = append(histogram, stats.Bin{Value: 0, Count: s.ZeroCount})
+	}
+	for _, i := range indexes {
+		histogram = append(histogram, stats.Bin{Value: s.value(i), Count: s.Bins[i]})
+	}
+	return histogram
+}
+
+// Clone returns a deep copy of the sketch, e.g. to send it while the original keeps changing
+func (s *Sketch) Clone() *Sketch {
+	clone := *s
+	clone.Bins = make(map[int]float64, len(s.Bins))
+	for i, count := range s.Bins {
+		clone.Bins[i] = count
+	}
+	return &clone
+}
+
+// Reset drops all the values
+func (s *Sketch) Reset() {
+	s.Bins = make(map[int]float64)
+	s.ZeroCount, s.Count, s.Sum, s.Min, s.Max = 0, 0, 0, 0, 0
+}
+
+func (s *Sketch) index(v float64) int {
+	return int(math.Ceil(math.Log(v) / s.logGamma))
+}
+
+// value returns the representative value of a bin, which is within the relative accuracy of all its values
+func (s *Sketch) value(i int) float64 {
+	return 2 * math.Pow(s.gamma, float64(i)) / (s.gamma + 1)
+}
+
+func (s *Sketch) clamp(v float64) float64 {
+	return math.Max(s.Min, math.Min(s.Max, v))
+}
+
+// collapse merges the lowest bins into one, until there are at most 'MaxBins'
+func (s *Sketch) collapse() {
+	if s.MaxBins <= 0 || len(s.Bins) <= s.MaxBins {
+		return
+	}
+	indexes := make([]int, 0, len(s.Bins))
+	for i := range s.Bins {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	excess := len(indexes) - s.MaxBins
+	target := indexes[excess]
+	for _, i := range indexes[:excess] {
+		s.Bins[target] += s.Bins[i]
+		delete(s.Bins, i)
+	}
+}
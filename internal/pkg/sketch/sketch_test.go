@@ -0,0 +1,137 @@
+package sketch
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+var quantiles = []float64{0.01, 0.1, 0.25, 0.5, 0.75, 0.9, 0.95, 0.99, 0.999}
+
+func uniform(n int, seed int64) []float64 {
+	r := rand.New(rand.NewSource(seed))
+	values := make([]float64, n)
+	for i := range values {
+		values[i] = 1 + r.Float64()*999 // 1..1000ms
+	}
+	return values
+}
+
+func lognormal(n int, seed int64) []float64 {
+	r := rand.New(rand.NewSource(seed))
+	values := make([]float64, n)
+	for i := range values {
+		values[i] = math.Exp(3 + r.NormFloat64()) // a median of 20ms, and a long tail
+	}
+	return values
+}
+
+// exactQuantile returns the value of rank q*(n-1) of the sorted values, the one the sketch approximates
+func exactQuantile(sorted []float64, q float64) float64 {
+	return sorted[int(q*float64(len(sorted)-1))]
+}
+
+// checkQuantiles checks the quantiles of a sketch against the exact ones of its values, within its relative accuracy
+func checkQuantiles(t *testing.T, s *Sketch, values []float64, quantiles []float64) {
+	t.Helper()
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	for _, q := range quantiles {
+		got, want := s.Quantile(q), exactQuantile(sorted, q)
+		if math.Abs(got-want) > s.RelativeAccuracy*want {
+			t.Errorf("quantile %v = %v, want %v within %v%%", q, got, want, s.RelativeAccuracy*100)
+		}
+	}
+	if s.Count != float64(len(values)) || s.Min != sorted[0] || s.Max != sorted[len(sorted)-1] {
+		t.Errorf("count %v, min %v, max %v, want %v, %v, %v", s.Count, s.Min, s.Max, len(values), sorted[0], sorted[len(sorted)-1])
+	}
+}
+
+func TestQuantile(t *testing.T) {
+	for name, values := range map[string][]float64{"uniform": uniform(10000, 1), "lognormal": lognormal(10000, 2)} {
+		t.Run(name, func(t *testing.T) {
+			s := New()
+			var sum float64
+			for _, v := range values {
+				s.Add(v)
+				sum += v
+			}
+			checkQuantiles(t, s, values, quantiles)
+			if math.Abs(s.Mean()-sum/float64(len(values))) > 1e-9 {
+				t.Errorf("mean %v, want %v", s.Mean(), sum/float64(len(values)))
+			}
+		})
+	}
+}
+
+func TestQuantileEdges(t *testing.T) {
+	s := New()
+	if s.Quantile(0.5) != -1 || s.Mean() != -1 {
+		t.Errorf("an empty sketch has median %v and mean %v, want -1", s.Quantile(0.5), s.Mean())
+	}
+	for _, v := range []float64{0, 0, 5, 10} {
+		s.Add(v)
+	}
+	if s.Quantile(0) != 0 || s.Quantile(1) != 10 || s.Quantile(0.3) != 0 {
+		t.Errorf("got min %v, max %v, p30 %v, want 0, 10, 0", s.Quantile(0), s.Quantile(1), s.Quantile(0.3))
+	}
+	if got := s.Quantile(0.7); math.Abs(got-5) > 0.05 {
+		t.Errorf("p70 = %v, want 5", got)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	for name, values := range map[string][]float64{"uniform": uniform(10000, 3), "lognormal": lognormal(10000, 4)} {
+		t.Run(name, func(t *testing.T) {
+			// e.g. the sketches of two agents, merged by the parent
+			a, b := New(), New()
+			for i, v := range values {
+				if i%3 == 0 {
+					a.Add(v)
+				} else {
+					b.Add(v)
+				}
+			}
+			if err := a.Merge(b); err != nil {
+				t.Fatal(err)
+			}
+			checkQuantiles(t, a, values, quantiles)
+		})
+	}
+
+	other := NewWithAccuracy(0.02, DefaultMaxBins)
+	other.Add(1)
+	if err := New().Merge(other); err == nil {
+		t.Error("merged sketches of different relative accuracies")
+	}
+}
+
+func TestCollapse(t *testing.T) {
+	const maxBins = 128 // with 1% accuracy, the highest bins cover a factor of 13 (1.02^128)
+	values := lognormal(10000, 5)
+	s := NewWithAccuracy(DefaultRelativeAccuracy, maxBins)
+	for _, v := range values {
+		s.Add(v)
+	}
+	if len(s.Bins) > maxBins {
+		t.Fatalf("%d bins, want at most %d", len(s.Bins), maxBins)
+	}
+	// the lowest bins are collapsed, so only the highest quantiles keep their accuracy
+	highest := []float64{0.99, 0.999}
+	checkQuantiles(t, s, values, highest)
+
+	// and after merging collapsed sketches
+	other := lognormal(10000, 6)
+	o := NewWithAccuracy(DefaultRelativeAccuracy, maxBins)
+	for _, v := range other {
+		o.Add(v)
+	}
+	if err := s.Merge(o); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Bins) > maxBins {
+		t.Fatalf("%d bins after merging, want at most %d", len(s.Bins), maxBins)
+	}
+	checkQuantiles(t, s, append(values, other...), highest)
+}
@@ -0,0 +1,108 @@
+// Package stats implements the statistical tests used to compare a tested version with the base version
+package stats
+
+import (
+	"errors"
+	"math"
+	"sort"
+)
+
+var ErrEmptySample = errors.New("both samples should have at least one value")
+
+// Bin is a value observed 'Count' times, e.g. a bin of a histogram
+type Bin struct {
+	Value float64
+	Count float64
+}
+
+// MannWhitneyU tests if the values of y tend to be greater than the values of x (one-sided), e.g. if a version is slower than the base.
+// It uses the normal approximation of U with tie and continuity corrections, and returns the z-score and the p-value
+func MannWhitneyU(x, y []float64) (float64, float64, error) {
+	return MannWhitneyUBins(toBins(x), toBins(y))
+}
+
+// MannWhitneyUBins is MannWhitneyU for binned values, e.g. the histograms of two sketches. The values of the same bin are ties
+func MannWhitneyUBins(x, y []Bin) (float64, float64, error) {
+	n1, n2 := totalCount(x), totalCount(y)
+	if n1 == 0 || n2 == 0 {
+		return 0, 1, ErrEmptySample
+	}
+
+	type value struct {
+		v      float64
+		counts [2]float64 // of x and y
+	}
+	values := make([]value, 0, len(x)+len(y))
+	for _, bin := range x {
+		values = append(values, value{v: bin.Value, counts: [2]float64{bin.Count, 0}})
+	}
+	for _, bin := range y {
+		values = append(values, value{v: bin.Value, counts: [2]float64{0, bin.Count}})
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i].v < values[j].v })
+
+	// rank the values, giving the average rank to ties
+	var rankSumY, tieCorrection, ranked float64
+	for i := 0; i < len(values); {
+		var countX, countY float64
+		j := i
+		for j < len(values) && values[j].v == values[i].v {
+			countX += values[j].counts[0]
+			countY += values[j].counts[1]
+			j++
+		}
+		t := countX + countY
+		rank := ranked + (t+1)/2 // average of the ranks ranked+1..ranked+t
+		rankSumY += rank * countY
+		tieCorrection += t*t*t - t
+		ranked += t
+		i = j
+	}
+
+	n := n1 + n2
+	u := rankSumY - n2*(n2+1)/2
+	mean := n1 * n2 / 2
+	sigma := math.Sqrt(n1 * n2 / 12 * ((n + 1) - tieCorrection/(n*(n-1))))
+	if sigma == 0 || math.IsNaN(sigma) { // all values are the same
+		return 0, 1, nil
+	}
+	z := (u - mean - 0.5) / sigma
+	return z, upperTail(z), nil
+}
+
+// TwoProportionZTest tests if the proportion of y (e.g. error rate of a version) is greater than the one of x (one-sided),
+// given the number of successes (e.g. errors) and trials (calls) of each. It returns the z-score and the p-value
+func TwoProportionZTest(successesX, trialsX, successesY, trialsY float64) (float64, float64, error) {
+	if trialsX <= 0 || trialsY <= 0 {
+		return 0, 1, ErrEmptySample
+	}
+	pX, pY := successesX/trialsX, successesY/trialsY
+	pooled := (successesX + successesY) / (trialsX + trialsY)
+	se := math.Sqrt(pooled * (1 - pooled) * (1/trialsX + 1/trialsY))
+	if se == 0 { // both have no successes, or only successes
+		return 0, 1, nil
+	}
+	z := (pY - pX) / se
+	return z, upperTail(z), nil
+}
+
+// upperTail returns P(Z > z) for the standard normal distribution
+func upperTail(z float64) float64 {
+	return 0.5 * math.Erfc(z/math.Sqrt2)
+}
+
+func toBins(values []float64) []Bin {
+	bins := make([]Bin, len(values))
+	for i, v := range values {
+		bins[i] = Bin{Value: v, Count: 1}
+	}
+	return bins
+}
+
+func totalCount(bins []Bin) float64 {
+	var total float64
+	for _, bin := range bins {
+		total += bin.Count
+	}
+	return total
+}
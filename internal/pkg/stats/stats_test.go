@@ -0,0 +1,98 @@
+package stats
+
+import (
+	"math"
+	"testing"
+)
+
+func near(got, want, tolerance float64) bool {
+	return math.Abs(got-want) <= tolerance
+}
+
+func TestMannWhitneyU(t *testing.T) {
+	// the example of scipy.stats.mannwhitneyu: U = 17, and the two-sided asymptotic p-value is 0.11134688653314041
+	females := []float64{20, 11, 17, 12}
+	males := []float64{19, 22, 16, 29, 24}
+	z, p, err := MannWhitneyU(females, males)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (17 - 10 - 0.5) / math.Sqrt(5*4*10/12.0); !near(z, want, 1e-12) {
+		t.Errorf("z = %v, want %v", z, want)
+	}
+	if want := 0.11134688653314041 / 2; !near(p, want, 1e-9) { // one-sided
+		t.Errorf("p = %v, want %v", p, want)
+	}
+
+	// reversed, the values of y tend to be smaller
+	if _, p, _ := MannWhitneyU(males, females); p < 0.9 {
+		t.Errorf("p = %v for the reversed samples, want > 0.9", p)
+	}
+}
+
+func TestMannWhitneyUTies(t *testing.T) {
+	x := []float64{1, 2, 2, 3, 3, 3, 4}
+	y := []float64{2, 3, 3, 4, 4, 5, 5, 5}
+	z, p, err := MannWhitneyU(x, y)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the same values, binned
+	zBins, pBins, err := MannWhitneyUBins(
+		[]Bin{{Value: 1, Count: 1}, {Value: 2, Count: 2}, {Value: 3, Count: 3}, {Value: 4, Count: 1}},
+		[]Bin{{Value: 2, Count: 1}, {Value: 3, Count: 2}, {Value: 4, Count: 2}, {Value: 5, Count: 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !near(z, zBins, 1e-12) || !near(p, pBins, 1e-12) {
+		t.Errorf("binned: z = %v, p = %v, want z = %v, p = %v", zBins, pBins, z, p)
+	}
+	// the rank sum of y is 3*1 + 7*2 + 11*2 + 14*3 = 81, so U = 81 - 8*9/2 = 45 (of 56).
+	// The tie corrected variance is n1*n2/12 * ((n+1) - sum(t^3-t)/(n(n-1))), with ties of 3 (2s), 5 (3s), 3 (4s) and 3 (5s)
+	sigma := math.Sqrt(7 * 8 / 12.0 * (16 - (24+120+24+24)/(15*14.0)))
+	if want := (45 - 28 - 0.5) / sigma; !near(z, want, 1e-12) {
+		t.Errorf("z = %v, want %v", z, want)
+	}
+
+	if _, p, err := MannWhitneyU([]float64{3, 3}, []float64{3, 3, 3}); err != nil || p != 1 {
+		t.Errorf("all the same values: p = %v (%v), want 1", p, err)
+	}
+	if _, _, err := MannWhitneyU(nil, y); err != ErrEmptySample {
+		t.Errorf("got %v for an empty sample, want %v", err, ErrEmptySample)
+	}
+}
+
+func TestTwoProportionZTest(t *testing.T) {
+	// 10/100 and 20/100: the pooled proportion is 0.15, so z = 0.1 / sqrt(0.15*0.85*(1/100+1/100)) = 1.98
+	z, p, err := TwoProportionZTest(10, 100, 20, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !near(z, 1.9802950859533488, 1e-12) {
+		t.Errorf("z = %v, want 1.98029", z)
+	}
+	if !near(p, 0.0238352, 1e-6) {
+		t.Errorf("p = %v, want 0.0238352", p)
+	}
+
+	if _, p, _ := TwoProportionZTest(0, 100, 0, 50); p != 1 {
+		t.Errorf("no errors in both: p = %v, want 1", p)
+	}
+	if _, _, err := TwoProportionZTest(1, 0, 1, 10); err != ErrEmptySample {
+		t.Errorf("got %v for no trials, want %v", err, ErrEmptySample)
+	}
+}
+
+func TestUpperTail(t *testing.T) {
+	for _, c := range []struct{ z, p float64 }{
+		{0, 0.5},
+		{1.959963984540054, 0.025},
+		{1.6448536269514722, 0.05},
+		{-1.6448536269514722, 0.95},
+		{2.3263478740408408, 0.01},
+	} {
+		if got := upperTail(c.z); !near(got, c.p, 1e-12) {
+			t.Errorf("upperTail(%v) = %v, want %v", c.z, got, c.p)
+		}
+	}
+}
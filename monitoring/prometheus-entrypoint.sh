@@ -0,0 +1,49 @@
+#!/bin/sh
+# Starts Prometheus with prometheus.yml, scraping the agent's metric server over https (trusting its certificate)
+# if agent.metricTLSCert is set in the agent's config, and over http otherwise.
+# If agent.prometheusAddr is set, the agent is scraped on its port instead, over http
+set -e
+config=${AGENT_CONFIG:-/agent/config/config.yml}
+
+# setting prints the value of a setting of the agent's config, unquoted
+setting() {
+  sed -n "s/^[[:space:]]*$1:[[:space:]]*[\"']\{0,1\}\([^\"'#[:space:]]*\).*/\1/p" "$config" | head -n 1
+}
+
+cert=""
+port=""
+if [ -f "$config" ]; then
+  cert=$(setting metricTLSCert)
+  prometheusAddr=$(setting prometheusAddr)
+  if [ -n "$prometheusAddr" ]; then
+    port=${prometheusAddr##*:}
+    cert="" # served over http
+  fi
+fi
+scheme=http
+ca=""
+if [ -n "$cert" ]; then
+  scheme=https
+  case "$cert" in
+    /*) ca=$cert ;;
+    *) ca=/agent/$cert ;; # relative to the agent's working directory (the repository)
+  esac
+fi
+echo "scraping the agent over $scheme${ca:+ (CA: $ca)}${port:+ on port $port}"
+
+awk -v scheme="$scheme" -v ca="$ca" -v port="$port" '
+  /^ *scheme: http # / {
+    print "    scheme: " scheme
+    if (ca != "") {
+      print "    tls_config:"
+      print "      ca_file: " ca
+    }
+    next
+  }
+  /^ *- targets: .*:9999.\] # / && port != "" {
+    sub(/:9999/, ":" port)
+  }
+  { print }
+' /etc/prometheus/prometheus.yml > /prometheus/prometheus.yml
+
+exec /bin/prometheus --config.file=/prometheus/prometheus.yml --storage.tsdb.path=/prometheus "$@"